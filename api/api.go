@@ -10,11 +10,23 @@ var (
 	NewGen3FuseConfigFromYaml = internal.NewGen3FuseConfigFromYaml
 	InitializeApp             = internal.InitializeApp
 	Mount                     = internal.Mount
+	NewMultiFuse              = internal.NewMultiFuse
+	MountMulti                = internal.MountMulti
+	NewSidecar                = internal.NewSidecar
+	RunSidecar                = internal.RunSidecar
+	ValidateManifest          = internal.ValidateManifest
 	Unmount                   = internal.Unmount
+	RegisterExpiryDetector    = internal.RegisterExpiryDetector
 )
 
+const SidecarLogName = internal.SidecarLogName
+
 type (
 	Gen3Fuse       = internal.Gen3Fuse
+	MultiFuse      = internal.MultiFuse
+	Sidecar        = internal.Sidecar
 	Gen3FuseConfig = internal.Gen3FuseConfig
 	FileInfo       = internal.FileInfo
+	ExpiryDetector = internal.ExpiryDetector
+	ManifestReport = internal.ManifestReport
 )
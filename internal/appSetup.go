@@ -56,6 +56,22 @@ func Mount(ctx context.Context, mountPoint string, gen3FuseConfig *Gen3FuseConfi
 		err = fmt.Errorf("Mount: initialization failed")
 		return
 	}
+	mfs, err = mountFileSystem(mountPoint, fs)
+	return
+}
+
+// MountMulti mounts a file system holding no manifests yet, for the caller
+// to add them with AddManifest
+func MountMulti(ctx context.Context, mountPoint string, gen3FuseConfig *Gen3FuseConfig) (m *MultiFuse, mfs *fuse.MountedFileSystem, err error) {
+	m, err = NewMultiFuse(gen3FuseConfig)
+	if err != nil {
+		return
+	}
+	mfs, err = mountFileSystem(mountPoint, m)
+	return
+}
+
+func mountFileSystem(mountPoint string, fs fuseutil.FileSystem) (mfs *fuse.MountedFileSystem, err error) {
 	server := fuseutil.NewFileSystemServer(fs)
 
 	// Mount the file system.
@@ -0,0 +1,277 @@
+package internal
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultCacheBlockSize int64 = 4 * 1024 * 1024
+	DefaultCacheMaxBytes  int64 = 10 * 1024 * 1024 * 1024
+)
+
+// BlockCache is a persistent cache of fixed-size file blocks kept on local disk.
+// Blocks are keyed by DID and block index, and the least recently used blocks
+// are evicted once the cache grows past its byte budget. Blocks are written to
+// a temporary file and renamed into place, so a crash never leaves a partially
+// written block behind.
+type BlockCache struct {
+	dir       string
+	blockSize int64
+	maxBytes  int64
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+}
+
+type cacheEntry struct {
+	path string
+	size int64
+}
+
+func NewBlockCache(cacheDir string, maxBytes int64, blockSize int64) (cache *BlockCache, err error) {
+	if blockSize <= 0 {
+		blockSize = DefaultCacheBlockSize
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultCacheMaxBytes
+	}
+
+	cache = &BlockCache{
+		dir:       filepath.Join(cacheDir, fmt.Sprintf("blocks-%d", blockSize)),
+		blockSize: blockSize,
+		maxBytes:  maxBytes,
+		lru:       list.New(),
+		entries:   make(map[string]*list.Element),
+	}
+
+	err = os.MkdirAll(cache.dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	// Blocks written with a different block size can never be hit again
+	err = removeStaleBlockDirs(cacheDir, filepath.Base(cache.dir))
+	if err != nil {
+		return nil, err
+	}
+
+	err = cache.load()
+	if err != nil {
+		return nil, err
+	}
+
+	FuseLog(fmt.Sprintf("Block cache at %v holds %v bytes in %v blocks", cache.dir, cache.size, cache.lru.Len()))
+	return cache, nil
+}
+
+func removeStaleBlockDirs(cacheDir string, current string) error {
+	dirEntries, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dirEntries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), "blocks-") && entry.Name() != current {
+			FuseLog(fmt.Sprintf("Removing stale block cache directory %v", entry.Name()))
+			err = os.RemoveAll(filepath.Join(cacheDir, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// load rebuilds the in-memory index from the blocks left on disk by a previous
+// run, treating the modification time as the last access time. Get touches
+// the modification time of the blocks it serves for this.
+func (cache *BlockCache) load() error {
+	type diskBlock struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	blocks := []diskBlock{}
+
+	err := filepath.Walk(cache.dir, func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fileInfo.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(path, ".tmp") {
+			// Left behind by a write that never completed
+			return os.Remove(path)
+		}
+		blocks = append(blocks, diskBlock{path, fileInfo.Size(), fileInfo.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].modTime.After(blocks[j].modTime)
+	})
+
+	for _, block := range blocks {
+		cache.entries[block.path] = cache.lru.PushBack(&cacheEntry{block.path, block.size})
+		cache.size += block.size
+	}
+
+	cache.mu.Lock()
+	cache.evictLocked()
+	cache.mu.Unlock()
+	return nil
+}
+
+func (cache *BlockCache) BlockSize() int64 {
+	return cache.blockSize
+}
+
+func (cache *BlockCache) blockPath(DID string, index int64) string {
+	sum := sha256.Sum256([]byte(DID))
+	key := hex.EncodeToString(sum[:])
+	return filepath.Join(cache.dir, key[:2], key+"."+strconv.FormatInt(index, 10))
+}
+
+// Get returns the contents of a cached block. The caller supplies the expected
+// length of the block, and anything on disk that does not match it is dropped.
+func (cache *BlockCache) Get(DID string, index int64, length int64) (data []byte, ok bool) {
+	path := cache.blockPath(DID, index)
+
+	cache.mu.Lock()
+	element, ok := cache.entries[path]
+	if ok {
+		cache.lru.MoveToFront(element)
+	}
+	cache.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil || int64(len(data)) != length {
+		FuseLog(fmt.Sprintf("Discarding unreadable cache block %v of %v", index, DID))
+		cache.remove(path)
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return data, true
+}
+
+// Put stores a block in the cache, evicting older blocks if needed
+func (cache *BlockCache) Put(DID string, index int64, data []byte) (err error) {
+	path := cache.blockPath(DID, index)
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	// The block is renamed into place under the lock, so that a concurrent
+	// eviction of the same block cannot delete it after it was written
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	err = os.Rename(tmpFile.Name(), path)
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	if element, ok := cache.entries[path]; ok {
+		entry := element.Value.(*cacheEntry)
+		cache.size += int64(len(data)) - entry.size
+		entry.size = int64(len(data))
+		cache.lru.MoveToFront(element)
+	} else {
+		cache.entries[path] = cache.lru.PushFront(&cacheEntry{path, int64(len(data))})
+		cache.size += int64(len(data))
+	}
+	cache.evictLocked()
+	return nil
+}
+
+// evictLocked drops least recently used blocks until the cache fits in its
+// budget. The files are deleted before cache.mu, which must be held, is
+// released, so that a block written again in the meantime is not deleted.
+func (cache *BlockCache) evictLocked() {
+	for cache.size > cache.maxBytes && cache.lru.Len() > 0 {
+		entry := cache.lru.Remove(cache.lru.Back()).(*cacheEntry)
+		delete(cache.entries, entry.path)
+		cache.size -= entry.size
+		err := os.Remove(entry.path)
+		if err != nil && !os.IsNotExist(err) {
+			FuseLog(fmt.Sprintf("Failed to evict cache block %v: %v", entry.path, err))
+		}
+	}
+}
+
+func (cache *BlockCache) remove(path string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if element, ok := cache.entries[path]; ok {
+		cache.lru.Remove(element)
+		delete(cache.entries, path)
+		cache.size -= element.Value.(*cacheEntry).size
+	}
+	os.Remove(path)
+}
+
+// Size returns the number of bytes currently held in the cache
+func (cache *BlockCache) Size() int64 {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.size
+}
+
+// MaxBytes is the capacity of the cache
+func (cache *BlockCache) MaxBytes() int64 {
+	return cache.maxBytes
+}
+
+// FreeBytes is how much more the cache can hold before it starts evicting
+// blocks, or the free space of the disk holding it if that is less
+func (cache *BlockCache) FreeBytes() int64 {
+	free := cache.maxBytes - cache.Size()
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(cache.dir, &stat); err == nil {
+		if diskFree := int64(stat.Bavail) * int64(stat.Bsize); diskFree < free {
+			free = diskFree
+		}
+	}
+	if free < 0 {
+		free = 0
+	}
+	return free
+}
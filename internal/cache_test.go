@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockCachePutGet(t *testing.T) {
+	cache, err := NewBlockCache(t.TempDir(), 1024, 16)
+	assert.Nil(t, err)
+
+	err = cache.Put("dg.1234/abc", 0, []byte("0123456789abcdef"))
+	assert.Nil(t, err)
+
+	data, ok := cache.Get("dg.1234/abc", 0, 16)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("0123456789abcdef"), data)
+
+	_, ok = cache.Get("dg.1234/abc", 1, 16)
+	assert.False(t, ok)
+
+	// a block that does not have the expected length is dropped
+	_, ok = cache.Get("dg.1234/abc", 0, 8)
+	assert.False(t, ok)
+	_, ok = cache.Get("dg.1234/abc", 0, 16)
+	assert.False(t, ok)
+	assert.Equal(t, int64(0), cache.Size())
+}
+
+func TestBlockCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache, err := NewBlockCache(t.TempDir(), 32, 16)
+	assert.Nil(t, err)
+
+	block := bytes.Repeat([]byte("x"), 16)
+	assert.Nil(t, cache.Put("did", 0, block))
+	assert.Nil(t, cache.Put("did", 1, block))
+
+	// touch block 0 so that block 1 becomes the eviction candidate
+	_, ok := cache.Get("did", 0, 16)
+	assert.True(t, ok)
+
+	assert.Nil(t, cache.Put("did", 2, block))
+	assert.Equal(t, int64(32), cache.Size())
+
+	_, ok = cache.Get("did", 1, 16)
+	assert.False(t, ok)
+	_, ok = cache.Get("did", 0, 16)
+	assert.True(t, ok)
+	_, ok = cache.Get("did", 2, 16)
+	assert.True(t, ok)
+}
+
+func TestBlockCacheSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewBlockCache(dir, 1024, 16)
+	assert.Nil(t, err)
+	assert.Nil(t, cache.Put("did", 3, []byte("persisted")))
+
+	// simulate a write interrupted by a crash
+	leftover := filepath.Join(filepath.Dir(cache.blockPath("did", 4)), "partial.tmp")
+	assert.Nil(t, ioutil.WriteFile(leftover, []byte("garbage"), 0600))
+
+	reopened, err := NewBlockCache(dir, 1024, 16)
+	assert.Nil(t, err)
+	data, ok := reopened.Get("did", 3, int64(len("persisted")))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("persisted"), data)
+	assert.Equal(t, int64(len("persisted")), reopened.Size())
+
+	_, err = os.Stat(leftover)
+	assert.True(t, os.IsNotExist(err))
+
+	// changing the block size invalidates everything cached with the old one
+	resized, err := NewBlockCache(dir, 1024, 32)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), resized.Size())
+	_, err = os.Stat(cache.dir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBlockCacheRestartKeepsRecentlyReadBlocks(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewBlockCache(dir, 32, 16)
+	assert.Nil(t, err)
+	block := bytes.Repeat([]byte("x"), 16)
+	assert.Nil(t, cache.Put("did", 0, block))
+	assert.Nil(t, cache.Put("did", 1, block))
+	longAgo := time.Now().Add(-time.Hour)
+	assert.Nil(t, os.Chtimes(cache.blockPath("did", 0), longAgo, longAgo))
+	assert.Nil(t, os.Chtimes(cache.blockPath("did", 1), longAgo.Add(time.Minute), longAgo.Add(time.Minute)))
+
+	// block 0 was written first, but read last
+	_, ok := cache.Get("did", 0, 16)
+	assert.True(t, ok)
+
+	reopened, err := NewBlockCache(dir, 16, 16)
+	assert.Nil(t, err)
+	_, ok = reopened.Get("did", 0, 16)
+	assert.True(t, ok)
+	_, ok = reopened.Get("did", 1, 16)
+	assert.False(t, ok)
+}
+
+func TestBlockCacheConcurrentPutsKeepIndexedBlocks(t *testing.T) {
+	cache, err := NewBlockCache(t.TempDir(), 64, 16)
+	assert.Nil(t, err)
+	block := bytes.Repeat([]byte("x"), 16)
+
+	// blocks are evicted and written again by other goroutines all the time
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				assert.Nil(t, cache.Put("did", int64((worker+i)%8), block))
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	// every block in the index is still on disk
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for path := range cache.entries {
+		_, err := os.Stat(path)
+		assert.Nil(t, err)
+	}
+}
+
+func TestReadFileServesCachedBlocksWithoutNetwork(t *testing.T) {
+	content := []byte("the quick brown fox jumps over the lazy dog")
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	cache, err := NewBlockCache(t.TempDir(), 1024, 8)
+	assert.Nil(t, err)
+
+	fs := newTestFs(&Gen3FuseConfig{}, len(content))
+	fs.blockCache = cache
+	handle := openTestFile(fs, server.URL)
+
+	read := func(offset int64, size int) []byte {
+		op := &fuseops.ReadFileOp{Inode: testInode, Handle: handle, Offset: offset, Dst: make([]byte, size)}
+		assert.Nil(t, fs.ReadFile(context.Background(), op))
+		return op.Dst[:op.BytesRead]
+	}
+
+	// the four missing blocks are fetched over the handle's stream
+	assert.Equal(t, content[5:30], read(5, 25))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// everything in this range is already cached
+	fs.handles.closeIdleStreams(time.Now())
+	assert.Equal(t, content[8:24], read(8, 16))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// the final short block
+	assert.Equal(t, content[40:], read(40, 100))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strings"
+	"sync"
+)
+
+// Checksum policies. Files read from start to end are checked against the
+// hashes recorded in Indexd; a mismatch is logged under "warn" and also fails
+// the read with EIO under "enforce".
+const (
+	ChecksumPolicyOff     = "off"
+	ChecksumPolicyWarn    = "warn"
+	ChecksumPolicyEnforce = "enforce"
+
+	DefaultChecksumPolicy = ChecksumPolicyWarn
+
+	// Reads that arrive ahead of the data hashed so far are held back, up to
+	// this many bytes, until the gap before them has been read
+	checksumReorderLimit int64 = 16 * 1024 * 1024
+)
+
+// Hash algorithms Indexd records, strongest first. Only the strongest one a
+// file has is computed.
+var checksumAlgorithms = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	{"sha512", sha512.New},
+	{"sha256", sha256.New},
+	{"sha1", sha1.New},
+	{"md5", md5.New},
+	{"crc", func() hash.Hash { return crc32.NewIEEE() }},
+}
+
+// ChecksumError reports a file whose content does not match its Indexd hash
+type ChecksumError struct {
+	DID       string
+	Algorithm string
+	Expected  string
+	Actual    string
+	BytesRead int64
+	Size      int64
+}
+
+func (e *ChecksumError) Error() string {
+	if e.BytesRead < e.Size {
+		return fmt.Sprintf("Checksum mismatch for %v: the object ended after %v of %v bytes", e.DID, e.BytesRead, e.Size)
+	}
+	return fmt.Sprintf("Checksum mismatch for %v: %v is %v, Indexd has %v", e.DID, e.Algorithm, e.Actual, e.Expected)
+}
+
+func validChecksumPolicy(policy string) bool {
+	switch policy {
+	case ChecksumPolicyOff, ChecksumPolicyWarn, ChecksumPolicyEnforce:
+		return true
+	}
+	return false
+}
+
+func (fs *Gen3Fuse) checksumPolicy() string {
+	if fs.gen3FuseConfig.ChecksumPolicy == "" {
+		return DefaultChecksumPolicy
+	}
+	return fs.gen3FuseConfig.ChecksumPolicy
+}
+
+// checksumVerifier hashes the content of one open file as it is read, for as
+// long as the reads cover the file in order from its first byte
+type checksumVerifier struct {
+	did       string
+	algorithm string
+	expected  string
+	size      int64
+
+	mu   sync.Mutex
+	hash hash.Hash
+	// The offset of the next byte to hash
+	next int64
+	// Reads past next, by offset
+	pending      map[int64][]byte
+	pendingBytes int64
+	// Set once the file has been read out of order and cannot be verified
+	abandoned bool
+	done      bool
+	err       error
+}
+
+// newChecksumVerifier returns a verifier for a file with the given hashes, or
+// nil if the file has none that can be checked
+func newChecksumVerifier(did string, hashes map[string]string, size int64) *checksumVerifier {
+	for _, algorithm := range checksumAlgorithms {
+		expected, ok := hashes[algorithm.name]
+		if !ok || expected == "" {
+			continue
+		}
+		return &checksumVerifier{
+			did:       did,
+			algorithm: algorithm.name,
+			expected:  strings.ToLower(expected),
+			size:      size,
+			hash:      algorithm.new(),
+			pending:   make(map[int64][]byte),
+		}
+	}
+	return nil
+}
+
+// Update adds the data read at offset. It returns a ChecksumError when the
+// read completes the file and the digest does not match. A read of nothing
+// before the end of the file means the object is shorter than Indexd says.
+func (verifier *checksumVerifier) Update(offset int64, data []byte) error {
+	verifier.mu.Lock()
+	defer verifier.mu.Unlock()
+
+	if verifier.done || verifier.abandoned {
+		return nil
+	}
+
+	end := offset + int64(len(data))
+	switch {
+	case offset == verifier.next:
+		verifier.hash.Write(data)
+		verifier.next = end
+		verifier.drainPendingLocked()
+	case end <= verifier.next:
+		// Data that has been hashed already
+	case offset < verifier.next:
+		// A read overlapping what has been hashed
+		verifier.hash.Write(data[verifier.next-offset:])
+		verifier.next = end
+		verifier.drainPendingLocked()
+	default:
+		if verifier.pendingBytes+int64(len(data)) > checksumReorderLimit {
+			FuseLog(fmt.Sprintf("Not verifying the checksum of %v, it is not being read in order", verifier.did))
+			verifier.abandoned = true
+			verifier.pending = nil
+			return nil
+		}
+		verifier.pending[offset] = append([]byte(nil), data...)
+		verifier.pendingBytes += int64(len(data))
+		return nil
+	}
+
+	if verifier.next >= verifier.size || (len(data) == 0 && offset == verifier.next) {
+		return verifier.finishLocked()
+	}
+	return nil
+}
+
+// drainPendingLocked hashes held back reads that have become contiguous
+func (verifier *checksumVerifier) drainPendingLocked() {
+	for len(verifier.pending) > 0 {
+		progressed := false
+		for offset, data := range verifier.pending {
+			end := offset + int64(len(data))
+			if offset > verifier.next {
+				continue
+			}
+			if end > verifier.next {
+				verifier.hash.Write(data[verifier.next-offset:])
+				verifier.next = end
+			}
+			delete(verifier.pending, offset)
+			verifier.pendingBytes -= int64(len(data))
+			progressed = true
+		}
+		if !progressed {
+			return
+		}
+	}
+}
+
+func (verifier *checksumVerifier) finishLocked() error {
+	verifier.done = true
+	actual := hex.EncodeToString(verifier.hash.Sum(nil))
+	if verifier.next == verifier.size && actual == verifier.expected {
+		FuseLog(fmt.Sprintf("Verified the %v of %v", verifier.algorithm, verifier.did))
+		return nil
+	}
+	verifier.err = &ChecksumError{
+		DID:       verifier.did,
+		Algorithm: verifier.algorithm,
+		Expected:  verifier.expected,
+		Actual:    actual,
+		BytesRead: verifier.next,
+		Size:      verifier.size,
+	}
+	return verifier.err
+}
+
+// Err returns the mismatch found, if any
+func (verifier *checksumVerifier) Err() error {
+	verifier.mu.Lock()
+	defer verifier.mu.Unlock()
+	return verifier.err
+}
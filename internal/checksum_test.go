@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+)
+
+func md5Hex(content []byte) string {
+	sum := md5.Sum(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func sha256Hex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestChecksumVerifierInOrder(t *testing.T) {
+	content := make([]byte, 10000)
+	rand.Read(content)
+
+	verifier := newChecksumVerifier("did", map[string]string{"md5": md5Hex(content)}, int64(len(content)))
+	for offset := 0; offset < len(content); offset += 4096 {
+		end := offset + 4096
+		if end > len(content) {
+			end = len(content)
+		}
+		assert.Nil(t, verifier.Update(int64(offset), content[offset:end]))
+	}
+	assert.True(t, verifier.done)
+	assert.Nil(t, verifier.Err())
+}
+
+func TestChecksumVerifierReorderedAndRepeatedReads(t *testing.T) {
+	content := make([]byte, 10000)
+	rand.Read(content)
+
+	verifier := newChecksumVerifier("did", map[string]string{"md5": md5Hex(content)}, int64(len(content)))
+	assert.Nil(t, verifier.Update(4000, content[4000:8000]))
+	assert.Nil(t, verifier.Update(0, content[0:3000]))
+	assert.Nil(t, verifier.Update(0, content[0:1000]))
+	assert.Nil(t, verifier.Update(2000, content[2000:5000]))
+	assert.False(t, verifier.done)
+	assert.Nil(t, verifier.Update(8000, content[8000:]))
+	assert.True(t, verifier.done)
+	assert.Nil(t, verifier.Err())
+}
+
+func TestChecksumVerifierMismatch(t *testing.T) {
+	content := []byte("the content Indexd knows about")
+	corrupted := []byte("the content Indexd knows abOut")
+
+	verifier := newChecksumVerifier("did", map[string]string{"md5": md5Hex(content)}, int64(len(content)))
+	err := verifier.Update(0, corrupted)
+	assert.IsType(t, &ChecksumError{}, err)
+	assert.Equal(t, err, verifier.Err())
+	assert.Contains(t, err.Error(), md5Hex(content))
+
+	// an object that ends early never matches
+	verifier = newChecksumVerifier("did", map[string]string{"md5": md5Hex(content)}, int64(len(content)))
+	assert.Nil(t, verifier.Update(0, content[:10]))
+	err = verifier.Update(10, nil)
+	assert.IsType(t, &ChecksumError{}, err)
+	assert.Contains(t, err.Error(), "ended after 10 of 30 bytes")
+}
+
+func TestChecksumVerifierAlgorithms(t *testing.T) {
+	content := []byte("abc")
+
+	// the strongest hash is used
+	verifier := newChecksumVerifier("did", map[string]string{"md5": "wrong", "sha256": sha256Hex(content)}, 3)
+	assert.Equal(t, "sha256", verifier.algorithm)
+	assert.Nil(t, verifier.Update(0, content))
+
+	verifier = newChecksumVerifier("did", map[string]string{"crc": "352441C2"}, 3)
+	assert.Nil(t, verifier.Update(0, content))
+	assert.Nil(t, verifier.Err())
+
+	assert.Nil(t, newChecksumVerifier("did", map[string]string{"etag": "abc-2"}, 3))
+	assert.Nil(t, newChecksumVerifier("did", nil, 3))
+}
+
+func TestReadFileChecksumPolicies(t *testing.T) {
+	content := make([]byte, 100000)
+	rand.Read(content)
+	corrupted := append([]byte(nil), content...)
+	corrupted[50000] ^= 1
+
+	for _, c := range []struct {
+		policy   string
+		served   []byte
+		mismatch bool
+	}{
+		{ChecksumPolicyEnforce, content, false},
+		{ChecksumPolicyEnforce, corrupted, true},
+		{ChecksumPolicyWarn, corrupted, false},
+		{ChecksumPolicyOff, corrupted, false},
+	} {
+		served := c.served
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(served))
+		}))
+
+		fs := newTestFs(&Gen3FuseConfig{ChecksumPolicy: c.policy}, len(content))
+		fs.inodes[testInode].record = &FileInfo{Hashes: map[string]string{"md5": md5Hex(content)}}
+		handle := openTestFile(fs, server.URL)
+
+		var err error
+		for offset := int64(0); offset < int64(len(content)) && err == nil; offset += 32768 {
+			op := &fuseops.ReadFileOp{Inode: testInode, Handle: handle, Offset: offset, Dst: make([]byte, 32768)}
+			err = fs.ReadFile(context.Background(), op)
+		}
+		if c.mismatch {
+			assert.Equal(t, fuse.EIO, err, c.policy)
+
+			// the file stays unreadable through this handle
+			op := &fuseops.ReadFileOp{Inode: testInode, Handle: handle, Dst: make([]byte, 10)}
+			assert.Equal(t, fuse.EIO, fs.ReadFile(context.Background(), op))
+		} else {
+			assert.Nil(t, err, c.policy)
+		}
+		fs.releaseHandle(handle)
+		server.Close()
+	}
+}
@@ -0,0 +1,282 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// The hidden directory at the mount root describing the mount. Its files are
+// generated when they are opened, so they always show the current state.
+const controlDirName = ".gen3fuse"
+
+var controlFiles = map[string]func(fs *Gen3Fuse) interface{}{
+	"status.json":   (*Gen3Fuse).controlStatus,
+	"errors.json":   (*Gen3Fuse).controlErrors,
+	"stats.json":    (*Gen3Fuse).controlStats,
+	"manifest.json": (*Gen3Fuse).controlManifest,
+}
+
+// mountStats counts what the file system has done since it was mounted
+type mountStats struct {
+	opens              int64
+	reads              int64
+	bytesRead          int64
+	bytesDownloaded    int64
+	readAheadBytes     int64
+	cacheHits          int64
+	cacheMisses        int64
+	retries            int64
+	checksumMismatches int64
+}
+
+// mountStatus holds what was learned while mounting the manifest
+type mountStatus struct {
+	manifestFilePath string
+	mounted          time.Time
+
+	mu sync.Mutex
+	// Why the DIDs that could not be mounted were left out, by DID
+	unresolved map[string]string
+}
+
+func (status *mountStatus) setUnresolved(did string, reason string) {
+	status.mu.Lock()
+	defer status.mu.Unlock()
+	if status.unresolved == nil {
+		status.unresolved = make(map[string]string)
+	}
+	status.unresolved[did] = reason
+}
+
+// replaceUnresolved takes the unresolved DIDs of staged, which was filled
+// while reloading the manifest
+func (status *mountStatus) replaceUnresolved(staged *mountStatus) {
+	staged.mu.Lock()
+	unresolved := staged.unresolved
+	staged.mu.Unlock()
+	if unresolved == nil {
+		unresolved = make(map[string]string)
+	}
+	status.mu.Lock()
+	defer status.mu.Unlock()
+	status.unresolved = unresolved
+}
+
+// findUnresolved records the DIDs of the manifest that have no file to mount
+func (status *mountStatus) findUnresolved(DIDs []string, didToFileInfo map[string]*FileInfo) {
+	status.mu.Lock()
+	defer status.mu.Unlock()
+	if status.unresolved == nil {
+		status.unresolved = make(map[string]string)
+	}
+	for _, did := range DIDs {
+		fileInfo, ok := didToFileInfo[did]
+		if !ok {
+			// Failed lookups have recorded why already
+			if _, known := status.unresolved[did]; !known {
+				status.unresolved[did] = "no record was found"
+			}
+		} else if len(fileInfo.URLs) == 0 {
+			status.unresolved[did] = "the record has no URLs"
+		}
+	}
+}
+
+// createControlDir adds the control directory and its files below the root.
+// They are all marked as control inodes, which are left out of file counts,
+// sizes and times.
+func createControlDir(inodes map[fuseops.InodeID]*inodeInfo, inodeID fuseops.InodeID, rootInode fuseops.InodeID, mounted time.Time) fuseops.InodeID {
+	createInode(inodes, rootInode, inodeID, controlDirName, "", 0, false, nil)
+	dirInode := inodeID
+	inodeID++
+	dir := inodes[dirInode]
+	dir.control = controlDirName
+	dir.attributes.Atime = mounted
+	dir.attributes.Mtime = mounted
+	dir.attributes.Ctime = mounted
+	dir.attributes.Crtime = mounted
+
+	names := make([]string, 0, len(controlFiles))
+	for name := range controlFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		addDirent(inodes, dirInode, inodeID, name, fuseutil.DT_File)
+		inodes[inodeID] = &inodeInfo{
+			attributes: fuseops.InodeAttributes{
+				Nlink:  1,
+				Mode:   0444,
+				Atime:  mounted,
+				Mtime:  mounted,
+				Ctime:  mounted,
+				Crtime: mounted,
+			},
+			Name:    name,
+			control: name,
+		}
+		inodeID++
+	}
+	return inodeID
+}
+
+// controlFile generates the content of a control file
+func (fs *Gen3Fuse) controlFile(name string) ([]byte, error) {
+	generate, ok := controlFiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown control file %v", name)
+	}
+	content, err := json.MarshalIndent(generate(fs), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(content, '\n'), nil
+}
+
+// tokenExpiry reads the expiry of a JWT access token, without checking its
+// signature
+func tokenExpiry(token string) *time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Exp == 0 {
+		return nil
+	}
+	expires := time.Unix(claims.Exp, 0).UTC()
+	return &expires
+}
+
+func (fs *Gen3Fuse) controlStatus() interface{} {
+	fs.inodesMu.RLock()
+	totals := fs.totals
+	fs.inodesMu.RUnlock()
+
+	fs.status.mu.Lock()
+	unresolved := len(fs.status.unresolved)
+	fs.status.mu.Unlock()
+
+	fs.tokenMu.Lock()
+	tokenExpires := tokenExpiry(fs.accessToken)
+	externalTokensExpire := make(map[string]*time.Time)
+	for IDP, token := range fs.ExternalIDPTokens {
+		externalTokensExpire[IDP] = tokenExpiry(token)
+	}
+	fs.tokenMu.Unlock()
+
+	fs.manifestMu.RLock()
+	manifestDIDs := len(fs.DIDs)
+	fs.manifestMu.RUnlock()
+
+	hostname, _ := os.Hostname()
+	return struct {
+		Manifest             string                `json:"manifest"`
+		Mounted              time.Time             `json:"mounted"`
+		Host                 string                `json:"host"`
+		Commons              string                `json:"commons"`
+		ManifestDIDs         int                   `json:"manifest_dids"`
+		Files                int                   `json:"files"`
+		Bytes                uint64                `json:"bytes"`
+		Inodes               int                   `json:"inodes"`
+		Unresolved           int                   `json:"unresolved_dids"`
+		OpenFiles            int                   `json:"open_files"`
+		AccessTokenExpires   *time.Time            `json:"access_token_expires"`
+		ExternalTokensExpire map[string]*time.Time `json:"external_tokens_expire"`
+	}{
+		Manifest:             fs.status.manifestFilePath,
+		Mounted:              fs.status.mounted,
+		Host:                 hostname,
+		Commons:              fs.gen3FuseConfig.Hostname,
+		ManifestDIDs:         manifestDIDs,
+		Files:                totals.files,
+		Bytes:                totals.bytes,
+		Inodes:               totals.inodes,
+		Unresolved:           unresolved,
+		OpenFiles:            fs.handles.Len(),
+		AccessTokenExpires:   tokenExpires,
+		ExternalTokensExpire: externalTokensExpire,
+	}
+}
+
+type unresolvedDID struct {
+	DID    string `json:"did"`
+	Reason string `json:"reason"`
+}
+
+func (fs *Gen3Fuse) controlErrors() interface{} {
+	fs.status.mu.Lock()
+	defer fs.status.mu.Unlock()
+	errors := make([]unresolvedDID, 0, len(fs.status.unresolved))
+	for did, reason := range fs.status.unresolved {
+		errors = append(errors, unresolvedDID{DID: did, Reason: reason})
+	}
+	sort.Slice(errors, func(i, j int) bool { return errors[i].DID < errors[j].DID })
+	return errors
+}
+
+func (fs *Gen3Fuse) controlStats() interface{} {
+	stats := &fs.stats
+	var cacheMaxBytes, cacheBytes, cacheFreeBytes int64
+	if fs.blockCache != nil {
+		cacheMaxBytes = fs.blockCache.MaxBytes()
+		cacheBytes = fs.blockCache.Size()
+		cacheFreeBytes = fs.blockCache.FreeBytes()
+	}
+	return struct {
+		Opens              int64 `json:"opens"`
+		OpenFiles          int   `json:"open_files"`
+		Reads              int64 `json:"reads"`
+		BytesRead          int64 `json:"bytes_read"`
+		BytesDownloaded    int64 `json:"bytes_downloaded"`
+		ReadAheadBytes     int64 `json:"read_ahead_bytes"`
+		CacheHits          int64 `json:"cache_hits"`
+		CacheMisses        int64 `json:"cache_misses"`
+		CacheMaxBytes      int64 `json:"cache_max_bytes"`
+		CacheBytes         int64 `json:"cache_bytes"`
+		CacheFreeBytes     int64 `json:"cache_free_bytes"`
+		Retries            int64 `json:"retries"`
+		ChecksumMismatches int64 `json:"checksum_mismatches"`
+	}{
+		Opens:              atomic.LoadInt64(&stats.opens),
+		OpenFiles:          fs.handles.Len(),
+		Reads:              atomic.LoadInt64(&stats.reads),
+		BytesRead:          atomic.LoadInt64(&stats.bytesRead),
+		BytesDownloaded:    atomic.LoadInt64(&stats.bytesDownloaded),
+		ReadAheadBytes:     atomic.LoadInt64(&stats.readAheadBytes),
+		CacheHits:          atomic.LoadInt64(&stats.cacheHits),
+		CacheMisses:        atomic.LoadInt64(&stats.cacheMisses),
+		CacheMaxBytes:      cacheMaxBytes,
+		CacheBytes:         cacheBytes,
+		CacheFreeBytes:     cacheFreeBytes,
+		Retries:            atomic.LoadInt64(&stats.retries),
+		ChecksumMismatches: atomic.LoadInt64(&stats.checksumMismatches),
+	}
+}
+
+// controlManifest lists the manifest records that were loaded, in order
+func (fs *Gen3Fuse) controlManifest() interface{} {
+	fs.manifestMu.RLock()
+	defer fs.manifestMu.RUnlock()
+	records := make([]ManifestRecord, 0, len(fs.DIDs))
+	for _, did := range fs.DIDs {
+		records = append(records, fs.DIDsToManifestRecords[did])
+	}
+	return records
+}
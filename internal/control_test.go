@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+)
+
+func readControlFile(t *testing.T, fs *Gen3Fuse, name string, v interface{}) {
+	open := &fuseops.OpenFileOp{Inode: lookUpPath(t, fs, ".gen3fuse/"+name)}
+	assert.Nil(t, fs.OpenFile(context.Background(), open))
+	assert.True(t, open.UseDirectIO)
+	defer fs.ReleaseFileHandle(context.Background(), &fuseops.ReleaseFileHandleOp{Handle: open.Handle})
+
+	// Read in small pieces, as the kernel may
+	var content []byte
+	for {
+		op := &fuseops.ReadFileOp{Inode: open.Inode, Handle: open.Handle, Offset: int64(len(content)), Dst: make([]byte, 16)}
+		assert.Nil(t, fs.ReadFile(context.Background(), op))
+		if op.BytesRead == 0 {
+			break
+		}
+		content = append(content, op.Dst[:op.BytesRead]...)
+	}
+	assert.Nil(t, json.Unmarshal(content, v), string(content))
+}
+
+func TestControlDirectory(t *testing.T) {
+	config := &Gen3FuseConfig{Hostname: "https://data.example.org/"}
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"exp": 2000000000}`))
+	didToFileInfo := map[string]*FileInfo{
+		"dg.TEST/1": &FileInfo{DID: "dg.TEST/1", Filesize: 10, URLs: []string{"s3://bucket/one.bam"}},
+		"dg.TEST/2": &FileInfo{DID: "dg.TEST/2", Filesize: 20, URLs: []string{"s3://bucket/two.bam"}},
+		"dg.TEST/3": &FileInfo{DID: "dg.TEST/3"},
+	}
+	fs := newTestFs(config, 0, withFiles(didToFileInfo))
+	fs.accessToken = "header." + claims + ".signature"
+	fs.DIDs = []string{"dg.TEST/2", "dg.TEST/1", "dg.TEST/3", "dg.TEST/4"}
+	fs.DIDsToManifestRecords = map[string]ManifestRecord{
+		"dg.TEST/1": {ObjectId: "dg.TEST/1", SubjectId: "10"},
+		"dg.TEST/2": {ObjectId: "dg.TEST/2"},
+		"dg.TEST/3": {ObjectId: "dg.TEST/3"},
+		"dg.TEST/4": {ObjectId: "dg.TEST/4", CommonsHostname: "other.example.org"},
+	}
+	fs.status.manifestFilePath = "/data/manifest.json"
+	fs.status.setUnresolved("dg.TEST/4", "https://other.example.org/ga4gh/drs/v1/objects/dg.TEST/4 answered with status code 404")
+	fs.status.findUnresolved(fs.DIDs, didToFileInfo)
+	atomic.AddInt64(&fs.stats.bytesRead, 42)
+	atomic.AddInt64(&fs.stats.cacheHits, 3)
+
+	var status struct {
+		Manifest           string     `json:"manifest"`
+		Commons            string     `json:"commons"`
+		ManifestDIDs       int        `json:"manifest_dids"`
+		Files              int        `json:"files"`
+		Bytes              uint64     `json:"bytes"`
+		Unresolved         int        `json:"unresolved_dids"`
+		AccessTokenExpires *time.Time `json:"access_token_expires"`
+	}
+	readControlFile(t, fs, "status.json", &status)
+	assert.Equal(t, "/data/manifest.json", status.Manifest)
+	assert.Equal(t, "https://data.example.org/", status.Commons)
+	assert.Equal(t, 4, status.ManifestDIDs)
+	assert.Equal(t, 2, status.Files)
+	assert.Equal(t, uint64(30), status.Bytes)
+	assert.Equal(t, 2, status.Unresolved)
+	assert.Equal(t, time.Unix(2000000000, 0).UTC(), *status.AccessTokenExpires)
+
+	var errors []unresolvedDID
+	readControlFile(t, fs, "errors.json", &errors)
+	assert.Equal(t, []unresolvedDID{
+		{DID: "dg.TEST/3", Reason: "the record has no URLs"},
+		{DID: "dg.TEST/4", Reason: "https://other.example.org/ga4gh/drs/v1/objects/dg.TEST/4 answered with status code 404"},
+	}, errors)
+
+	var stats map[string]int64
+	readControlFile(t, fs, "stats.json", &stats)
+	assert.Equal(t, int64(42), stats["bytes_read"])
+	assert.Equal(t, int64(3), stats["cache_hits"])
+	// Reading the control files does not count
+	assert.Equal(t, int64(0), stats["reads"])
+	assert.Equal(t, int64(0), stats["cache_max_bytes"])
+
+	// With a block cache, its capacity and room left are reported
+	cache, err := NewBlockCache(t.TempDir(), 5*4096, 4096)
+	assert.Nil(t, err)
+	assert.Nil(t, cache.Put("dg.TEST/1", 0, make([]byte, 4096)))
+	fs.blockCache = cache
+	readControlFile(t, fs, "stats.json", &stats)
+	assert.Equal(t, int64(5*4096), stats["cache_max_bytes"])
+	assert.Equal(t, int64(4096), stats["cache_bytes"])
+	assert.Equal(t, int64(4*4096), stats["cache_free_bytes"])
+
+	var manifest []ManifestRecord
+	readControlFile(t, fs, "manifest.json", &manifest)
+	assert.Len(t, manifest, 4)
+	assert.Equal(t, "dg.TEST/2", manifest[0].ObjectId)
+	assert.Equal(t, "10", manifest[1].SubjectId)
+
+	// The control directory is left out of the totals of the root
+	count, size := fs.directoryTotals(fs.inodes[fuseops.RootInodeID])
+	assert.Equal(t, 2, count)
+	assert.Equal(t, uint64(30), size)
+}
+
+func TestTokenExpiry(t *testing.T) {
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"exp": 1700000000, "sub": "1"}`))
+	assert.Equal(t, time.Unix(1700000000, 0).UTC(), *tokenExpiry("a." + claims + ".b"))
+	assert.Nil(t, tokenExpiry(""))
+	assert.Nil(t, tokenExpiry("not-a-jwt"))
+	assert.Nil(t, tokenExpiry("a."+base64.RawURLEncoding.EncodeToString([]byte(`{}`))+".b"))
+}
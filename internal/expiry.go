@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"encoding/xml"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ExpiryDetector recognizes how one storage provider answers requests made
+// with a presigned URL that has expired. A read whose URL is found to have
+// expired gets a fresh URL and is tried again.
+type ExpiryDetector interface {
+	// Name identifies the provider in logs
+	Name() string
+
+	// Handles reports whether the URL points at the provider's storage
+	Handles(presignedUrl *url.URL) bool
+
+	// Expired reports whether the failed response says the URL has expired
+	Expired(apiErr *APIError) bool
+}
+
+var (
+	expiryDetectorsMu sync.RWMutex
+	expiryDetectors   = []ExpiryDetector{
+		s3ExpiryDetector{},
+		gcsExpiryDetector{},
+		azureExpiryDetector{},
+	}
+)
+
+// RegisterExpiryDetector adds a detector for another storage provider. It is
+// consulted before the built-in ones.
+func RegisterExpiryDetector(detector ExpiryDetector) {
+	expiryDetectorsMu.Lock()
+	defer expiryDetectorsMu.Unlock()
+	expiryDetectors = append([]ExpiryDetector{detector}, expiryDetectors...)
+}
+
+// detectorForURL returns the detector of the provider serving presignedUrl,
+// falling back to one for generic signed HTTPS endpoints
+func detectorForURL(presignedUrl string) ExpiryDetector {
+	parsed, err := url.Parse(presignedUrl)
+	if err != nil {
+		return genericExpiryDetector{}
+	}
+
+	expiryDetectorsMu.RLock()
+	defer expiryDetectorsMu.RUnlock()
+	for _, detector := range expiryDetectors {
+		if detector.Handles(parsed) {
+			return detector
+		}
+	}
+	return genericExpiryDetector{}
+}
+
+// isExpiredURLError reports whether err means that presignedUrl has expired,
+// along with the provider that said so
+func isExpiredURLError(presignedUrl string, err error) (expired bool, provider string) {
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		return false, ""
+	}
+	detector := detectorForURL(presignedUrl)
+	return detector.Expired(apiErr), detector.Name()
+}
+
+// storageErrorCode returns the Code of the XML error documents sent by S3,
+// GCS and Azure, or "" if the body is not one
+func storageErrorCode(body string) string {
+	var storageError struct {
+		Code string `xml:"Code"`
+	}
+	if xml.Unmarshal([]byte(body), &storageError) != nil {
+		return ""
+	}
+	return storageError.Code
+}
+
+func hasQueryParam(presignedUrl *url.URL, names ...string) bool {
+	query := presignedUrl.Query()
+	for _, name := range names {
+		if _, ok := query[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// S3 answers expired URLs with 403 AccessDenied, "Request has expired", and
+// expired session credentials with 400 ExpiredToken. Any 403 is taken to mean
+// an expired URL, since a fresh one costs little and fixes it if it does.
+type s3ExpiryDetector struct{}
+
+func (s3ExpiryDetector) Name() string { return "s3" }
+
+func (s3ExpiryDetector) Handles(presignedUrl *url.URL) bool {
+	return strings.HasSuffix(presignedUrl.Hostname(), ".amazonaws.com") ||
+		hasQueryParam(presignedUrl, "X-Amz-Signature", "AWSAccessKeyId")
+}
+
+func (s3ExpiryDetector) Expired(apiErr *APIError) bool {
+	switch apiErr.StatusCode {
+	case 403:
+		return true
+	case 400:
+		return storageErrorCode(apiErr.Body) == "ExpiredToken"
+	}
+	return false
+}
+
+// GCS answers expired URLs with 400 ExpiredToken
+type gcsExpiryDetector struct{}
+
+func (gcsExpiryDetector) Name() string { return "gcs" }
+
+func (gcsExpiryDetector) Handles(presignedUrl *url.URL) bool {
+	return presignedUrl.Hostname() == "storage.googleapis.com" ||
+		strings.HasSuffix(presignedUrl.Hostname(), ".storage.googleapis.com") ||
+		hasQueryParam(presignedUrl, "X-Goog-Signature", "GoogleAccessId")
+}
+
+func (gcsExpiryDetector) Expired(apiErr *APIError) bool {
+	switch apiErr.StatusCode {
+	case 400, 401, 403:
+		return storageErrorCode(apiErr.Body) == "ExpiredToken"
+	}
+	return false
+}
+
+// Azure answers requests with an expired SAS token with 403 AuthenticationFailed
+type azureExpiryDetector struct{}
+
+func (azureExpiryDetector) Name() string { return "azure" }
+
+func (azureExpiryDetector) Handles(presignedUrl *url.URL) bool {
+	return strings.HasSuffix(presignedUrl.Hostname(), ".blob.core.windows.net") ||
+		(hasQueryParam(presignedUrl, "sig") && hasQueryParam(presignedUrl, "se"))
+}
+
+func (azureExpiryDetector) Expired(apiErr *APIError) bool {
+	return apiErr.StatusCode == 403 && storageErrorCode(apiErr.Body) == "AuthenticationFailed"
+}
+
+// Other signed HTTPS endpoints answer with 401 or 403 once their signature
+// or token has expired
+type genericExpiryDetector struct{}
+
+func (genericExpiryDetector) Name() string { return "https" }
+
+func (genericExpiryDetector) Handles(presignedUrl *url.URL) bool { return true }
+
+func (genericExpiryDetector) Expired(apiErr *APIError) bool {
+	return apiErr.StatusCode == 401 || apiErr.StatusCode == 403
+}
@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+)
+
+// Query strings that make a URL look like one signed by each provider
+var providerQueries = map[string]string{
+	"s3":    "X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Signature=abc",
+	"gcs":   "X-Goog-Algorithm=GOOG4-RSA-SHA256&X-Goog-Signature=abc",
+	"azure": "sv=2022-11-02&se=2024-01-02T03%3A19%3A05Z&sr=b&sp=r&sig=abc",
+	"https": "token=abc",
+}
+
+// Error responses captured from each provider, in testdata/expiry
+var expiryFixtures = []struct {
+	provider   string
+	statusCode int
+	fixture    string
+	expired    bool
+}{
+	{"s3", 403, "s3-expired.xml", true},
+	{"s3", 400, "s3-expired-token.xml", true},
+	{"s3", 404, "s3-no-such-key.xml", false},
+	{"gcs", 400, "gcs-expired.xml", true},
+	{"gcs", 400, "gcs-invalid-argument.xml", false},
+	{"azure", 403, "azure-expired.xml", true},
+	{"azure", 403, "azure-permission-mismatch.xml", false},
+	{"https", 401, "https-expired.json", true},
+	{"https", 404, "s3-no-such-key.xml", false},
+}
+
+func readExpiryFixture(t *testing.T, name string) []byte {
+	body, err := os.ReadFile(filepath.Join("testdata", "expiry", name))
+	assert.Nil(t, err)
+	return body
+}
+
+func TestDetectorForURL(t *testing.T) {
+	for provider, query := range providerQueries {
+		assert.Equal(t, provider, detectorForURL("https://example.com/key?"+query).Name())
+	}
+	assert.Equal(t, "s3", detectorForURL("https://bucket.s3.us-east-1.amazonaws.com/key").Name())
+	assert.Equal(t, "gcs", detectorForURL("https://storage.googleapis.com/bucket/key").Name())
+	assert.Equal(t, "azure", detectorForURL("https://account.blob.core.windows.net/container/key").Name())
+	assert.Equal(t, "https", detectorForURL("%zz").Name())
+}
+
+func TestExpiryDetectorsRecognizeFixtures(t *testing.T) {
+	for _, c := range expiryFixtures {
+		presignedUrl := "https://example.com/key?" + providerQueries[c.provider]
+		apiErr := &APIError{StatusCode: c.statusCode, URL: presignedUrl, Body: string(readExpiryFixture(t, c.fixture))}
+
+		expired, provider := isExpiredURLError(presignedUrl, apiErr)
+		assert.Equal(t, c.expired, expired, c.fixture)
+		assert.Equal(t, c.provider, provider, c.fixture)
+	}
+
+	expired, _ := isExpiredURLError("https://example.com/key", ErrShortBody)
+	assert.False(t, expired)
+}
+
+// teapotExpiryDetector is a custom provider that signals expiry with 418
+type teapotExpiryDetector struct{}
+
+func (teapotExpiryDetector) Name() string { return "teapot" }
+
+func (teapotExpiryDetector) Handles(presignedUrl *url.URL) bool {
+	return presignedUrl.Query().Get("teapot") != ""
+}
+
+func (teapotExpiryDetector) Expired(apiErr *APIError) bool { return apiErr.StatusCode == 418 }
+
+func TestRegisterExpiryDetector(t *testing.T) {
+	expiryDetectorsMu.RLock()
+	saved := expiryDetectors
+	expiryDetectorsMu.RUnlock()
+	defer func() {
+		expiryDetectorsMu.Lock()
+		expiryDetectors = saved
+		expiryDetectorsMu.Unlock()
+	}()
+
+	RegisterExpiryDetector(teapotExpiryDetector{})
+	expired, provider := isExpiredURLError("https://example.com/key?teapot=1", &APIError{StatusCode: 418})
+	assert.True(t, expired)
+	assert.Equal(t, "teapot", provider)
+
+	// the built-in detectors still apply to other URLs
+	_, provider = isExpiredURLError("https://example.com/key?X-Amz-Signature=abc", &APIError{StatusCode: 403})
+	assert.Equal(t, "s3", provider)
+}
+
+func TestReadFileRefreshesExpiredURLs(t *testing.T) {
+	content := []byte("content behind an expired URL")
+	for _, c := range expiryFixtures {
+		body := readExpiryFixture(t, c.fixture)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/expired" {
+				w.WriteHeader(c.statusCode)
+				w.Write(body)
+				return
+			}
+			http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(content))
+		}))
+
+		fs := newTestFs(&Gen3FuseConfig{RetryMaxAttempts: 1}, len(content))
+		var refreshes int32
+		fs.urls = newURLManager(func(info *inodeInfo) (string, error) {
+			atomic.AddInt32(&refreshes, 1)
+			return server.URL + "/fresh?" + providerQueries[c.provider], nil
+		}, time.Hour)
+		handle := openTestFile(fs, server.URL+"/expired?"+providerQueries[c.provider])
+
+		op := &fuseops.ReadFileOp{Inode: testInode, Handle: handle, Dst: make([]byte, 100)}
+		err := fs.ReadFile(context.Background(), op)
+		if c.expired {
+			assert.Nil(t, err, c.fixture)
+			assert.Equal(t, content, op.Dst[:op.BytesRead], c.fixture)
+			assert.Equal(t, int32(1), atomic.LoadInt32(&refreshes), c.fixture)
+		} else {
+			assert.NotNil(t, err, c.fixture)
+			assert.Equal(t, int32(0), atomic.LoadInt32(&refreshes), c.fixture)
+		}
+		fs.releaseHandle(handle)
+		server.Close()
+	}
+}
@@ -13,8 +13,12 @@ import (
 	"bytes"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
@@ -24,17 +28,59 @@ import (
 type Gen3Fuse struct {
 	fuseutil.NotImplementedFileSystem
 
+	// Guards accessToken and ExternalIDPTokens, which are refreshed while
+	// other operations are using them
+	tokenMu     sync.Mutex
 	accessToken string
 
+	// Guards the manifest fields below, which a reload replaces while the
+	// control directory reads them. They are only replaced while reloadMu is
+	// held, so holders of reloadMu can read them without this lock.
+	manifestMu sync.RWMutex
+
 	DIDs []string
 
 	DIDsToCommonsHostnames map[string]string
 
-	inodes map[fuseops.InodeID]*inodeInfo
+	DIDsToSubjectIds map[string]string
+
+	DIDsToManifestRecords map[string]ManifestRecord
+
+	// Serializes manifest reloads, see reload.go
+	reloadMu sync.Mutex
+	// The records of the mounted files by DID, and the highest inode ID
+	// handed out so far. Only used while reloadMu is held.
+	fileInfos   map[string]*FileInfo
+	lastInodeID fuseops.InodeID
+
+	// Guards inodes. The inodeInfo entries are never modified once the table
+	// has been built, so they can be used without holding the lock.
+	inodesMu sync.RWMutex
+	inodes   map[fuseops.InodeID]*inodeInfo
+	totals   inodeTotals
 
 	gen3FuseConfig *Gen3FuseConfig
 
 	ExternalIDPTokens map[string]string
+
+	// Optional on-disk cache of file contents
+	blockCache *BlockCache
+
+	// Prefetches data for sequential readers, nil when read-ahead is disabled
+	readAhead *readAheadTracker
+
+	// Presigned URLs by DID, see urls.go
+	urls *urlManager
+
+	// Open files, see handles.go
+	handles *handleTable
+
+	// Closed when the file system is unmounted, to stop background work
+	stop chan struct{}
+
+	// What the mount is doing, served from the control directory, see control.go
+	status mountStatus
+	stats  mountStats
 }
 
 type ManifestRecord struct {
@@ -42,6 +88,11 @@ type ManifestRecord struct {
 	ObjectId        string `json:"object_id"`
 	SubjectId       string `json:"subject_id"`
 	Uuid            string `json:"uuid"`
+	DataFormat      string `json:"data_format"`
+	DataType        string `json:"data_type"`
+	ProjectId       string `json:"project_id"`
+	SubmitterId     string `json:"submitter_id"`
+	FileName        string `json:"file_name"`
 }
 
 type FileInfo struct {
@@ -50,21 +101,65 @@ type FileInfo struct {
 	DID              string   `json:"did"`
 	URLs             []string `json:"urls"`
 	FromExternalHost bool
+
+	// Digests of the content by algorithm, such as "md5" or "sha256"
+	Hashes map[string]string `json:"hashes"`
+
+	// The authorization resources protecting the file
+	Authz []string `json:"authz"`
+
+	// When the record was created and last updated
+	CreatedDate string `json:"created_date"`
+	UpdatedDate string `json:"updated_date"`
+
+	// From the manifest
+	CommonsHostname string         `json:"-"`
+	SubjectId       string         `json:"-"`
+	Manifest        ManifestRecord `json:"-"`
 }
 
 // APIError carries a failure to get a 2XX response
 type APIError struct {
 	StatusCode int
 	URL        string
+
+	// How long the server asked us to wait before trying again, if it did
+	RetryAfter time.Duration
+
+	// The start of the response body, which storage backends fill with the
+	// reason for the failure
+	Body string
 }
 
 func (e *APIError) Error() string {
-	return fmt.Sprintf("Fail to fetch %v, status code: %v", e.URL, e.StatusCode)
+	return fmt.Sprintf("Fail to fetch %v, status code: %v", stripQuery(e.URL), e.StatusCode)
+}
+
+// Error responses are read up to this size
+const apiErrorBodyLimit = 64 * 1024
+
+// apiErrorFromResponse logs the body of a failed response and wraps it in an APIError
+func apiErrorFromResponse(resp *http.Response, requestUrl string) *APIError {
+	bodyBytes, _ := ioutil.ReadAll(io.LimitReader(resp.Body, apiErrorBodyLimit))
+	bodyString := string(bodyBytes)
+	FuseLog(bodyString)
+	return &APIError{
+		StatusCode: resp.StatusCode,
+		URL:        requestUrl,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		Body:       bodyString,
+	}
 }
 
 var LogFilePath string = "fuse_log.txt"
 
 func NewGen3Fuse(ctx context.Context, gen3FuseConfig *Gen3FuseConfig, manifestFilePath string) (fs *Gen3Fuse, err error) {
+	return newGen3Fuse(ctx, gen3FuseConfig, manifestFilePath, nil)
+}
+
+// newGen3Fuse mounts the manifest, reading through blockCache if it is not
+// nil instead of opening the cache of the config
+func newGen3Fuse(ctx context.Context, gen3FuseConfig *Gen3FuseConfig, manifestFilePath string, blockCache *BlockCache) (fs *Gen3Fuse, err error) {
 	LogFilePath = gen3FuseConfig.LogFilePath
 
 	accessToken, err := GetAccessToken(gen3FuseConfig)
@@ -75,13 +170,44 @@ func NewGen3Fuse(ctx context.Context, gen3FuseConfig *Gen3FuseConfig, manifestFi
 	fs = &Gen3Fuse{
 		accessToken:    accessToken,
 		gen3FuseConfig: gen3FuseConfig,
+		handles:        newHandleTable(),
+		stop:           make(chan struct{}),
 	}
+	fs.urls = newURLManager(fs.GetPresignedURL, presignedURLExpiresIn(gen3FuseConfig))
+	fs.status.manifestFilePath = manifestFilePath
+	fs.status.mounted = time.Now()
 
 	err = fs.LoadDIDsFromManifest(manifestFilePath)
 	if err != nil {
 		return nil, err
 	}
 
+	if blockCache != nil {
+		fs.blockCache = blockCache
+	} else if gen3FuseConfig.CacheDir != "" {
+		fs.blockCache, err = NewBlockCache(gen3FuseConfig.CacheDir, gen3FuseConfig.CacheMaxBytes, gen3FuseConfig.CacheBlockSize)
+		if err != nil {
+			FuseLog(fmt.Sprintf("Error initializing the block cache at %v: %v", gen3FuseConfig.CacheDir, err))
+			return nil, err
+		}
+	}
+
+	if gen3FuseConfig.ChecksumPolicy != "" && !validChecksumPolicy(gen3FuseConfig.ChecksumPolicy) {
+		return nil, fmt.Errorf("Invalid ChecksumPolicy %q, expected one of off, warn or enforce", gen3FuseConfig.ChecksumPolicy)
+	}
+
+	if gen3FuseConfig.FilenameCollisionPolicy != "" && !validFilenameCollisionPolicy(gen3FuseConfig.FilenameCollisionPolicy) {
+		return nil, fmt.Errorf("Invalid FilenameCollisionPolicy %q, expected one of suffix, nest or error", gen3FuseConfig.FilenameCollisionPolicy)
+	}
+
+	if _, err := parseViews(gen3FuseConfig.Views); err != nil {
+		return nil, err
+	}
+
+	if !gen3FuseConfig.DisableReadAhead {
+		fs.readAhead = newReadAheadTracker(fs, gen3FuseConfig)
+	}
+
 	var didToFileInfo map[string]*FileInfo
 
 	if len(fs.DIDs) == 0 {
@@ -92,20 +218,24 @@ func NewGen3Fuse(ctx context.Context, gen3FuseConfig *Gen3FuseConfig, manifestFi
 			return nil, err
 		}
 	}
+	fs.status.findUnresolved(fs.DIDs, didToFileInfo)
+	fs.fetchExternalIDPTokens()
+	fs.currentManifest().annotateFileInfos(didToFileInfo)
 
-	for IDP, _ := range fs.ExternalIDPTokens {
-		token, err := GetAccessTokenFromWTSForExternalHost(fs.gen3FuseConfig, IDP)
-		if err != nil {
-			FuseLog(fmt.Sprintf("Failed to retrieve access token from WTS for External Host IDP %v.", IDP))
-			continue
-		}
-		fs.ExternalIDPTokens[IDP] = token
-
-		FuseLog(fmt.Sprintf("\nGot a token for %v - %v", IDP, token))
+	if !validSecondaryViews(gen3FuseConfig.SecondaryViews) {
+		return nil, fmt.Errorf("Invalid SecondaryViews %q, expected one of copies, symlinks or hardlinks", gen3FuseConfig.SecondaryViews)
 	}
-
-	fs.inodes = InitializeInodes(didToFileInfo)
+	inodes, err := InitializeInodes(didToFileInfo, gen3FuseConfig)
+	if err != nil {
+		return nil, err
+	}
+	fs.setInodes(inodes)
+	fs.fileInfos = didToFileInfo
 	FuseLog("Initialized inodes")
+
+	go fs.handles.reapIdleStreams(fs.stop)
+	go fs.keepURLsFresh(fs.stop)
+	go fs.watchManifest(fs.stop)
 	return fs, nil
 }
 
@@ -124,14 +254,20 @@ type inodeInfo struct {
 	// For files, the DID
 	DID string
 
-	// For files, the presigned URL
-	presignedUrl string
-
 	// Indicates whether the object info is from a source other than Indexd
 	FromExternalHost bool
 
 	// For DRS files -- the access URL(s) that yields a presigned URL for the file when given an auth token
 	ExternalAccessURLs []string
+
+	// For files, the record Indexd or the DRS server holds about the file
+	record *FileInfo
+
+	// For symlinks, the path they point to
+	symlink string
+
+	// For the control directory and its files, their name
+	control string
 }
 
 func getFilePathFromURL(urls []string) (result []string, ok bool) {
@@ -158,7 +294,25 @@ func getFilePathFromURL(urls []string) (result []string, ok bool) {
 	return filePaths[1:len(filePaths)], true
 }
 
-func InitializeInodes(didToFileInfo map[string]*FileInfo) map[fuseops.InodeID]*inodeInfo {
+// How the by-filename and by-filepath views refer to files
+const (
+	// Each view has inodes of its own
+	SecondaryViewsCopies = "copies"
+	// The entries are symlinks to the files in by-guid
+	SecondaryViewsSymlinks = "symlinks"
+	// The entries are further names for the inodes in by-guid
+	SecondaryViewsHardlinks = "hardlinks"
+)
+
+func validSecondaryViews(secondaryViews string) bool {
+	switch secondaryViews {
+	case "", SecondaryViewsCopies, SecondaryViewsSymlinks, SecondaryViewsHardlinks:
+		return true
+	}
+	return false
+}
+
+func InitializeInodes(didToFileInfo map[string]*FileInfo, gen3FuseConfig *Gen3FuseConfig) (map[fuseops.InodeID]*inodeInfo, error) {
 	/*
 		Create a file system with a fixed structure described by the manifest
 		If you're trying to read this code and understand it, maybe check out the hello world FUSE sample first:
@@ -171,6 +325,7 @@ func InitializeInodes(didToFileInfo map[string]*FileInfo) map[fuseops.InodeID]*i
 		byIDDir
 		byFilenameDir
 		byFilepathDir
+		bySubjectDir
 	)
 
 	var inodes = map[fuseops.InodeID]*inodeInfo{
@@ -201,21 +356,29 @@ func InitializeInodes(didToFileInfo map[string]*FileInfo) map[fuseops.InodeID]*i
 					Name:   "by-filepath",
 					Type:   fuseutil.DT_Directory,
 				},
+				fuseutil.Dirent{
+					Offset: 4,
+					Inode:  bySubjectDir,
+					Name:   "by-subject",
+					Type:   fuseutil.DT_Directory,
+				},
 			},
 		},
 	}
 
 	// Create an inode for each imaginary file
-	var inodeID fuseops.InodeID = fuseops.RootInodeID + 4
+	var inodeID fuseops.InodeID = fuseops.RootInodeID + 5
 	inodeIDMap := make(map[string]fuseops.InodeID)
 	inodeIDMap["by-guid"] = byIDDir
 	inodeIDMap["by-filename"] = byFilenameDir
 	inodeIDMap["by-filepath"] = byFilepathDir
+	inodeIDMap["by-subject"] = bySubjectDir
 	// inode for top level dirs that contains the imaginary files described in the manifest
 	topDirs := map[string]fuseops.InodeID{
 		"by-id":       byIDDir,
 		"by-filename": byFilenameDir,
 		"by-filepath": byFilepathDir,
+		"by-subject":  bySubjectDir,
 	}
 	for name, inode := range topDirs {
 		inodes[inode] = &inodeInfo{
@@ -229,12 +392,86 @@ func InitializeInodes(didToFileInfo map[string]*FileInfo) map[fuseops.InodeID]*i
 		}
 	}
 
+	mountTime := time.Now()
+	inodeID = createControlDir(inodes, inodeID, rootInode, mountTime)
+
+	// Views laid out by path templates get a top-level directory each
+	templates, err := parseViews(gen3FuseConfig.Views)
+	if err != nil {
+		return nil, err
+	}
+	bySubject, _ := parsePathTemplate(bySubjectView)
+	templateViews := append([]ViewConfig{bySubjectView}, gen3FuseConfig.Views...)
+	templates = append([]*pathTemplate{bySubject}, templates...)
+	for _, view := range gen3FuseConfig.Views {
+		createInode(inodes, rootInode, inodeID, view.Name, "", 0, false, nil)
+		inodeIDMap[view.Name] = inodeID
+		inodeID++
+	}
+
+	// Work out where each file goes in every view but by-guid first, so that
+	// files wanting the same name can be told apart
+	dids := make([]string, 0, len(didToFileInfo))
+	viewNames := []string{"by-filename", "by-filepath"}
+	for _, view := range templateViews {
+		viewNames = append(viewNames, view.Name)
+	}
+	wanted := make(map[string]map[string][]string)
+	for _, view := range viewNames {
+		wanted[view] = make(map[string][]string)
+	}
 	for did, fileInfo := range didToFileInfo {
 		if len(fileInfo.URLs) == 0 {
 			FuseLog(fmt.Sprintf("Indexd record %s does not seem to have a file associated with it; ignoring it.", did))
 			continue
 		}
+		dids = append(dids, did)
+
+		// Try to get the filename from the first URL
+		paths, ok := getFilePathFromURL(fileInfo.URLs)
+		if fileInfo.FromExternalHost {
+			paths = []string{fileInfo.Filename}
+			ok = true
+		}
 
+		filename := did[strings.LastIndex(did, "/")+1:]
+		if ok {
+			filename = paths[len(paths)-1]
+			wanted["by-filepath"][did] = paths
+		}
+		if len(fileInfo.Filename) > 0 {
+			filename = fileInfo.Filename
+		}
+		if ok {
+			wanted["by-filename"][did] = []string{filename}
+		}
+		for i, view := range templateViews {
+			wanted[view.Name][did] = templates[i].Expand(fileInfo, filename)
+		}
+	}
+	sort.Strings(dids)
+
+	policy := filenameCollisionPolicy(gen3FuseConfig)
+	resolved := make(map[string]map[string][]string)
+	var renamed []RenamedEntry
+	for _, view := range viewNames {
+		paths, renamedInView, err := resolveNames(view, wanted[view], policy)
+		if err != nil {
+			return nil, err
+		}
+		resolved[view] = paths
+		renamed = append(renamed, renamedInView...)
+	}
+	if len(renamed) > 0 {
+		report := make([]string, len(renamed))
+		for i, entry := range renamed {
+			report[i] = entry.String()
+		}
+		FuseLog(fmt.Sprintf("%v files are not under the name the manifest gives them:\n%v", len(renamed), strings.Join(report, "\n")))
+	}
+
+	for _, did := range dids {
+		fileInfo := didToFileInfo[did]
 		externalURLs := []string{}
 		if fileInfo.FromExternalHost {
 			externalURLs = fileInfo.URLs
@@ -244,30 +481,43 @@ func InitializeInodes(didToFileInfo map[string]*FileInfo) map[fuseops.InodeID]*i
 		// GUIDs can have prefix as folders
 		guidPaths := append([]string{"by-guid"}, strings.Split(did, "/")...)
 		inodeID = createInodeForDirs(inodes, inodeID, guidPaths, inodeIDMap, did, fileInfo.Filesize, fileInfo.FromExternalHost, externalURLs)
-
-		inodeID++
-
-		// Try to get the filename from the first URL
-		paths, ok := getFilePathFromURL(fileInfo.URLs)
-		if fileInfo.FromExternalHost {
-			paths = []string{fileInfo.Filename}
-			ok = true
-		}
-
+		guidInode, ok := inodeIDMap[strings.Join(guidPaths, "/")]
 		if !ok {
 			continue
 		}
-		filename := paths[len(paths)-1]
-		if len(fileInfo.Filename) > 0 {
-			filename = fileInfo.Filename
+
+		var views [][]string
+		for _, view := range viewNames {
+			if paths, ok := resolved[view][did]; ok {
+				views = append(views, append([]string{view}, paths...))
+			}
 		}
+		for _, paths := range views {
+			if gen3FuseConfig.SecondaryViews == "" || gen3FuseConfig.SecondaryViews == SecondaryViewsCopies {
+				inodeID = createInodeForDirs(inodes, inodeID, paths, inodeIDMap, did, fileInfo.Filesize, fileInfo.FromExternalHost, externalURLs)
+				continue
+			}
 
-		createInode(inodes, byFilenameDir, inodeID, filename, did, fileInfo.Filesize, fileInfo.FromExternalHost, externalURLs)
-		inodeID++
-		paths = append([]string{"by-filepath"}, paths...)
-		inodeID = createInodeForDirs(inodes, inodeID, paths, inodeIDMap, did, fileInfo.Filesize, fileInfo.FromExternalHost, externalURLs)
+			dirs := paths[:len(paths)-1]
+			inodeID = createInodeForDirs(inodes, inodeID, dirs, inodeIDMap, "", 0, false, nil)
+			parentNode, ok := inodeIDMap[strings.Join(dirs, "/")]
+			if !ok {
+				continue
+			}
+			inodeIDMap[strings.Join(paths, "/")], inodeID = linkInode(inodes, inodeID, parentNode, len(dirs), paths[len(paths)-1], guidInode, guidPaths, gen3FuseConfig.SecondaryViews)
+		}
+	}
+
+	// Files get the times of their records, which do not change from one
+	// mount to the next, and directories those of their latest file
+	for _, info := range inodes {
+		if fileInfo, ok := didToFileInfo[info.DID]; ok && !info.dir {
+			info.record = fileInfo
+			setFileTimes(&info.attributes, fileInfo, mountTime)
+		}
 	}
-	return inodes
+	setDirectoryTimes(inodes, rootInode, mountTime)
+	return inodes, nil
 }
 
 func createInodeForDirs(inodes map[fuseops.InodeID]*inodeInfo, inodeID fuseops.InodeID, paths []string, inodeIDMap map[string]fuseops.InodeID, did string, filesize uint64, fromExternalHost bool, externalURLs []string) fuseops.InodeID {
@@ -298,28 +548,56 @@ func createInodeForDirs(inodes map[fuseops.InodeID]*inodeInfo, inodeID fuseops.I
 	return inodeID
 }
 
-func createInode(inodes map[fuseops.InodeID]*inodeInfo, parentID fuseops.InodeID, inodeID fuseops.InodeID, filename string, did string, filesize uint64, fromExternalHost bool, externalURLs []string) {
-	parent, ok := inodes[parentID]
-	if !ok {
-		panic(fmt.Sprintf("Something went wrong, can't find parent folder for %v, guid %v", filename, did))
+// linkInode adds an entry named name to the directory parentID, depth levels
+// below the root, for the file at targetPath in by-guid. The entry is either
+// a symlink to targetPath or another name for the target inode. It returns
+// the inode of the entry and the next free inode ID.
+func linkInode(inodes map[fuseops.InodeID]*inodeInfo, inodeID fuseops.InodeID, parentID fuseops.InodeID, depth int, name string, target fuseops.InodeID, targetPath []string, secondaryViews string) (fuseops.InodeID, fuseops.InodeID) {
+	if secondaryViews == SecondaryViewsHardlinks {
+		addDirent(inodes, parentID, target, name, fuseutil.DT_File)
+		inodes[target].attributes.Nlink++
+		return target, inodeID
 	}
-	curIDSlice := parent.Children
+
+	symlink := strings.Repeat("../", depth) + strings.Join(targetPath, "/")
+	addDirent(inodes, parentID, inodeID, name, fuseutil.DT_Link)
+	inodes[inodeID] = &inodeInfo{
+		attributes: fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0444 | os.ModeSymlink,
+			Size:  uint64(len(symlink)),
+		},
+		Name:    name,
+		DID:     inodes[target].DID,
+		symlink: symlink,
+	}
+	return inodeID, inodeID + 1
+}
+
+// addDirent adds an entry for inodeID to the children of the directory parentID
+func addDirent(inodes map[fuseops.InodeID]*inodeInfo, parentID fuseops.InodeID, inodeID fuseops.InodeID, name string, direntType fuseutil.DirentType) {
+	parent := inodes[parentID]
 	offset := fuseops.DirOffset(1)
-	if len(curIDSlice) > 0 {
-		offset = curIDSlice[len(curIDSlice)-1].Offset + 1
+	if len(parent.Children) > 0 {
+		offset = parent.Children[len(parent.Children)-1].Offset + 1
+	}
+	parent.Children = append(parent.Children, fuseutil.Dirent{
+		Offset: offset,
+		Inode:  inodeID,
+		Name:   name,
+		Type:   direntType,
+	})
+}
+
+func createInode(inodes map[fuseops.InodeID]*inodeInfo, parentID fuseops.InodeID, inodeID fuseops.InodeID, filename string, did string, filesize uint64, fromExternalHost bool, externalURLs []string) {
+	if _, ok := inodes[parentID]; !ok {
+		panic(fmt.Sprintf("Something went wrong, can't find parent folder for %v, guid %v", filename, did))
 	}
 	inodeType := fuseutil.DT_File
 	if did == "" {
 		inodeType = fuseutil.DT_Directory
 	}
-	var dirEntry = fuseutil.Dirent{
-		Offset: fuseops.DirOffset(offset),
-		Inode:  inodeID,
-		Name:   filename,
-		Type:   inodeType,
-	}
-	curIDSlice = append(curIDSlice, dirEntry)
-	inodes[parentID].Children = curIDSlice
+	addDirent(inodes, parentID, inodeID, filename, inodeType)
 	if did == "" {
 		inodes[inodeID] = &inodeInfo{
 			attributes: fuseops.InodeAttributes{
@@ -371,58 +649,179 @@ func GetIDPForURL(URL string) (IDP string) {
 
 func (fs *Gen3Fuse) LoadDIDsFromManifest(manifestFilePath string) (err error) {
 	FuseLog(fmt.Sprintf("Inside LoadDIDsFromManifest, loading manifest from %v", manifestFilePath))
-	b, err := ioutil.ReadFile(manifestFilePath)
+	manifestJSON, report, err := parseManifest(manifestFilePath, fs.gen3FuseConfig)
 	if err != nil {
+		FuseLog(fmt.Sprintf("Error: could not read the manifest %v: %v", manifestFilePath, err))
 		return err
 	}
+	logManifestWarnings(manifestFilePath, report)
+	fs.applyManifest(newManifestState(manifestJSON))
+	return nil
+}
 
-	s := string(b)
-	sReplaceNone := strings.Replace(s, "None", "\"\"", -1)
-	sReplaceNoneAsBytes := []byte(sReplaceNone)
+func logManifestWarnings(manifestFilePath string, report *ManifestReport) {
+	for _, warning := range report.Warnings {
+		FuseLog(fmt.Sprintf("Warning: %v: %v", manifestFilePath, warning))
+	}
+}
 
-	manifestJSON := make([]ManifestRecord, 0)
-	json.Unmarshal(sReplaceNoneAsBytes, &manifestJSON)
+// manifestState is what the file system keeps of a manifest
+type manifestState struct {
+	DIDs                   []string
+	DIDsToCommonsHostnames map[string]string
+	DIDsToSubjectIds       map[string]string
+	DIDsToManifestRecords  map[string]ManifestRecord
+	// The hosts other than the commons that the manifest refers to, as a set
+	externalHostnames map[string]string
+}
 
-	fs.DIDsToCommonsHostnames = make(map[string]string)
-	fs.ExternalIDPTokens = make(map[string]string)
-	externalHostnames := make(map[string]string)
+func newManifestState(manifestJSON []ManifestRecord) *manifestState {
+	manifest := &manifestState{
+		DIDs:                   make([]string, 0, len(manifestJSON)),
+		DIDsToCommonsHostnames: make(map[string]string),
+		DIDsToSubjectIds:       make(map[string]string),
+		DIDsToManifestRecords:  make(map[string]ManifestRecord),
+		externalHostnames:      make(map[string]string),
+	}
 	for i := 0; i < len(manifestJSON); i++ {
-		fs.DIDs = append(fs.DIDs, manifestJSON[i].ObjectId)
+		manifest.DIDs = append(manifest.DIDs, manifestJSON[i].ObjectId)
+		manifest.DIDsToManifestRecords[manifestJSON[i].ObjectId] = manifestJSON[i]
+		if len(manifestJSON[i].SubjectId) > 0 {
+			manifest.DIDsToSubjectIds[manifestJSON[i].ObjectId] = manifestJSON[i].SubjectId
+		}
 		if len(manifestJSON[i].CommonsHostname) > 0 {
-			fs.DIDsToCommonsHostnames[manifestJSON[i].ObjectId] = manifestJSON[i].CommonsHostname
-			// Using a map as a set
-			externalHostnames[manifestJSON[i].CommonsHostname] = ""
+			manifest.DIDsToCommonsHostnames[manifestJSON[i].ObjectId] = manifestJSON[i].CommonsHostname
+			manifest.externalHostnames[manifestJSON[i].CommonsHostname] = ""
 		}
 	}
+	return manifest
+}
 
-	for k, _ := range externalHostnames {
+// currentManifest returns the manifest of the file system
+func (fs *Gen3Fuse) currentManifest() *manifestState {
+	fs.manifestMu.RLock()
+	defer fs.manifestMu.RUnlock()
+	return &manifestState{
+		DIDs:                   fs.DIDs,
+		DIDsToCommonsHostnames: fs.DIDsToCommonsHostnames,
+		DIDsToSubjectIds:       fs.DIDsToSubjectIds,
+		DIDsToManifestRecords:  fs.DIDsToManifestRecords,
+	}
+}
+
+// applyManifest makes the manifest the one of the file system, keeping the
+// tokens of the external hosts it still refers to
+func (fs *Gen3Fuse) applyManifest(manifest *manifestState) {
+	fs.manifestMu.Lock()
+	fs.DIDs = manifest.DIDs
+	fs.DIDsToCommonsHostnames = manifest.DIDsToCommonsHostnames
+	fs.DIDsToSubjectIds = manifest.DIDsToSubjectIds
+	fs.DIDsToManifestRecords = manifest.DIDsToManifestRecords
+	fs.manifestMu.Unlock()
+
+	fs.tokenMu.Lock()
+	defer fs.tokenMu.Unlock()
+	externalIDPTokens := make(map[string]string)
+	for k, _ := range manifest.externalHostnames {
 		IDP := GetIDPForURL(k)
 		if len(IDP) > 0 {
 			// Initializing the keys of the IDP->Token map
-			fs.ExternalIDPTokens[IDP] = ""
+			externalIDPTokens[IDP] = fs.ExternalIDPTokens[IDP]
+		}
+	}
+	fs.ExternalIDPTokens = externalIDPTokens
+}
+
+// fetchExternalIDPTokens gets tokens for the external hosts that have none yet
+func (fs *Gen3Fuse) fetchExternalIDPTokens() {
+	fs.tokenMu.Lock()
+	var IDPs []string
+	for IDP, token := range fs.ExternalIDPTokens {
+		if token == "" {
+			IDPs = append(IDPs, IDP)
 		}
 	}
+	fs.tokenMu.Unlock()
 
-	return
+	for _, IDP := range IDPs {
+		token, err := GetAccessTokenFromWTSForExternalHost(fs.gen3FuseConfig, IDP)
+		if err != nil {
+			FuseLog(fmt.Sprintf("Failed to retrieve access token from WTS for External Host IDP %v.", IDP))
+			continue
+		}
+		fs.setExternalIDPToken(IDP, token)
+
+		FuseLog(fmt.Sprintf("\nGot a token for %v", IDP))
+	}
 }
 
-func (fs *Gen3Fuse) patchAttributes(attr *fuseops.InodeAttributes) {
-	now := time.Now()
-	attr.Atime = now
-	attr.Mtime = now
-	attr.Crtime = now
+// annotateFileInfos adds what the manifest says about each file to its record
+func (manifest *manifestState) annotateFileInfos(didToFileInfo map[string]*FileInfo) {
+	for did, fileInfo := range didToFileInfo {
+		fileInfo.CommonsHostname = manifest.DIDsToCommonsHostnames[did]
+		fileInfo.SubjectId = manifest.DIDsToSubjectIds[did]
+		fileInfo.Manifest = manifest.DIDsToManifestRecords[did]
+		// Indexd names files better than manifests do
+		if fileInfo.Filename == "" {
+			fileInfo.Filename = fileInfo.Manifest.FileName
+		}
+	}
 }
-func (fs *Gen3Fuse) StatFS(
-	ctx context.Context,
-	op *fuseops.StatFSOp) (err error) {
+
+func (fs *Gen3Fuse) getInode(inode fuseops.InodeID) (info *inodeInfo, ok bool) {
+	fs.inodesMu.RLock()
+	defer fs.inodesMu.RUnlock()
+	info, ok = fs.inodes[inode]
 	return
 }
 
+func (fs *Gen3Fuse) setInodes(inodes map[fuseops.InodeID]*inodeInfo) {
+	totals := countInodes(inodes)
+	fs.inodesMu.Lock()
+	defer fs.inodesMu.Unlock()
+	fs.inodes = inodes
+	fs.totals = totals
+}
+
+func (fs *Gen3Fuse) getAccessToken() string {
+	fs.tokenMu.Lock()
+	defer fs.tokenMu.Unlock()
+	return fs.accessToken
+}
+
+// refreshAccessToken replaces an access token that was rejected. Operations
+// that were rejected at the same time share a single refresh.
+func (fs *Gen3Fuse) refreshAccessToken(rejected string) (accessToken string, err error) {
+	fs.tokenMu.Lock()
+	defer fs.tokenMu.Unlock()
+	if fs.accessToken != rejected {
+		return fs.accessToken, nil
+	}
+	accessToken, err = GetAccessToken(fs.gen3FuseConfig)
+	if err != nil {
+		return "", err
+	}
+	fs.accessToken = accessToken
+	return accessToken, nil
+}
+
+func (fs *Gen3Fuse) getExternalIDPToken(IDP string) string {
+	fs.tokenMu.Lock()
+	defer fs.tokenMu.Unlock()
+	return fs.ExternalIDPTokens[IDP]
+}
+
+func (fs *Gen3Fuse) setExternalIDPToken(IDP string, token string) {
+	fs.tokenMu.Lock()
+	defer fs.tokenMu.Unlock()
+	fs.ExternalIDPTokens[IDP] = token
+}
+
 func (fs *Gen3Fuse) LookUpInode(
 	ctx context.Context,
 	op *fuseops.LookUpInodeOp) (err error) {
 	// Find the info for the parent.
-	parentInfo, ok := fs.inodes[op.Parent]
+	parentInfo, ok := fs.getInode(op.Parent)
 	if !ok {
 		err = fuse.ENOENT
 		return
@@ -433,13 +832,15 @@ func (fs *Gen3Fuse) LookUpInode(
 	if err != nil {
 		return
 	}
+	childInfo, ok := fs.getInode(childInode)
+	if !ok {
+		err = fuse.ENOENT
+		return
+	}
 
 	// Copy over information.
 	op.Entry.Child = childInode
-	op.Entry.Attributes = fs.inodes[childInode].attributes
-
-	// Patch attributes.
-	fs.patchAttributes(&op.Entry.Attributes)
+	op.Entry.Attributes = childInfo.attributes
 
 	return
 }
@@ -448,7 +849,7 @@ func (fs *Gen3Fuse) GetInodeAttributes(
 	ctx context.Context,
 	op *fuseops.GetInodeAttributesOp) (err error) {
 	// Find the info for this inode.
-	info, ok := fs.inodes[op.Inode]
+	info, ok := fs.getInode(op.Inode)
 	if !ok {
 		err = fuse.ENOENT
 		return
@@ -456,9 +857,6 @@ func (fs *Gen3Fuse) GetInodeAttributes(
 
 	// Copy over its attributes.
 	op.Attributes = info.attributes
-
-	// Patch attributes.
-	fs.patchAttributes(&op.Attributes)
 	return
 }
 
@@ -473,7 +871,7 @@ func (fs *Gen3Fuse) ReadDir(
 	ctx context.Context,
 	op *fuseops.ReadDirOp) (err error) {
 	// Find the info for this inode.
-	info, ok := fs.inodes[op.Inode]
+	info, ok := fs.getInode(op.Inode)
 	if !ok {
 		FuseLog("Error: fs.inodes[op.Inode] returned not ok")
 		err = fuse.ENOENT
@@ -488,8 +886,11 @@ func (fs *Gen3Fuse) ReadDir(
 		return
 	}
 
-	entries := info.Children
+	return writeDirents(op, info.Children)
+}
 
+// writeDirents fills op with the entries of a directory, starting at its offset
+func writeDirents(op *fuseops.ReadDirOp, entries []fuseutil.Dirent) (err error) {
 	// Grab the range of interest.
 	if op.Offset > fuseops.DirOffset(len(entries)) {
 		FuseLog("Error: (op.Offset > fuseops.DirOffset(len(entries)) was false")
@@ -511,90 +912,299 @@ func (fs *Gen3Fuse) ReadDir(
 	return
 }
 
+func (fs *Gen3Fuse) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) (err error) {
+	info, ok := fs.getInode(op.Inode)
+	if !ok {
+		err = fuse.ENOENT
+		return
+	}
+	if info.symlink == "" {
+		err = fuse.EINVAL
+		return
+	}
+	op.Target = info.symlink
+	return
+}
+
 func (fs *Gen3Fuse) OpenFile(
 	ctx context.Context,
 	op *fuseops.OpenFileOp) (err error) {
 
 	// FuseLog("inside OpenFile")
 
-	info, ok := fs.inodes[op.Inode]
+	info, ok := fs.getInode(op.Inode)
 	if !ok {
 		err = fuse.ENOENT
 		return
 	}
 
-	if info.presignedUrl == "" || len(info.presignedUrl) < 3 {
-		presignedUrl, err := fs.GetPresignedURL(info)
+	if info.control != "" {
+		content, err := fs.controlFile(info.control)
 		if err != nil {
-			return err
+			FuseLog(fmt.Sprintf("Error: could not generate %v: %v", info.control, err))
+			return fuse.EIO
 		}
-		info.presignedUrl = presignedUrl
+		// The size of the file is only known once it is generated
+		op.UseDirectIO = true
+		op.Handle = fs.handles.Add(&fileHandle{inode: op.Inode, info: info, control: content, stream: &contentStream{}, opened: time.Now()})
+		return nil
+	}
+
+	// Every open gets its own handle, holding the presigned URL and the
+	// download state for this open
+	url, err := fs.urls.Get(info)
+	if err != nil {
+		FuseLog(fmt.Sprintf("Error: could not obtain a presigned URL for %v: %v", info.DID, err))
+		return fuse.EIO
 	}
 
-	fs.inodes[op.Inode] = info
+	op.Handle = fs.openHandle(op.Inode, info, url)
+	atomic.AddInt64(&fs.stats.opens, 1)
+	return
+}
+
+func (fs *Gen3Fuse) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) (err error) {
+	// The file system is read-only, so there is never anything to flush.
+	// Resources are released once the last reference goes away, in ReleaseFileHandle.
+	return
+}
 
+func (fs *Gen3Fuse) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) (err error) {
+	fs.releaseHandle(op.Handle)
 	return
 }
 
+func (fs *Gen3Fuse) Destroy() {
+	close(fs.stop)
+	if fs.readAhead != nil {
+		fs.readAhead.Close()
+	}
+}
+
 func (fs *Gen3Fuse) ReadFile(
 	ctx context.Context,
 	op *fuseops.ReadFileOp) (err error) {
 	FuseLog("Inside ReadFile")
-	info, ok := fs.inodes[op.Inode]
+	handle, ok := fs.handles.Get(op.Handle)
 	if !ok {
-		err = fuse.ENOENT
+		FuseLog(fmt.Sprintf("Error: read from unknown file handle %v", op.Handle))
+		err = syscall.EBADF
 		return
 	}
+	if handle.info.control != "" {
+		if op.Offset < int64(len(handle.control)) {
+			op.BytesRead = copy(op.Dst, handle.control[op.Offset:])
+		}
+		return nil
+	}
 	size := int64(len(op.Dst))
-	fullsize := int64(info.attributes.Size)
-	FuseLog(fmt.Sprintf("get %v with offset %v size %v", info.DID, op.Offset, size))
-	fileBody, err := FetchContentsAtURL(info.presignedUrl, op.Offset, size, fullsize)
-	if apiErr, ok := err.(*APIError); ok {
-		// aws returns 403 when URL is expired
-		if apiErr.StatusCode == 403 {
-			FuseLog(fmt.Sprintf("Get a fresh url for %v", info.DID))
-			presignedURL, urlErr := fs.GetPresignedURL(info)
-			if urlErr != nil {
-				FuseLog("Error fetching file contents: " + urlErr.Error())
-				err = fuse.ENOENT
-				return err
-			}
-			info.presignedUrl = presignedURL
-			fileBody, err = FetchContentsAtURL(info.presignedUrl, op.Offset, size, fullsize)
-			if err != nil {
-				FuseLog("Error re-fetching file contents: " + err.Error())
-				err = fuse.ENOENT
-				return err
+	FuseLog(fmt.Sprintf("get %v with offset %v size %v", handle.info.DID, op.Offset, size))
+
+	enforceChecksum := handle.checksum != nil && fs.checksumPolicy() == ChecksumPolicyEnforce
+	if enforceChecksum && handle.checksum.Err() != nil {
+		return fuse.EIO
+	}
+
+	// op.Offset: The offset within the file at which to read.
+	// op.Dst: The destination buffer, whose length gives the size of the read.
+
+	if handle.readAhead != nil {
+		op.BytesRead = fs.readAhead.Read(handle.readAhead, handle, op.Dst, op.Offset)
+		atomic.AddInt64(&fs.stats.readAheadBytes, int64(op.BytesRead))
+	}
+	defer func() {
+		handle.recordRead(op.BytesRead)
+		atomic.AddInt64(&fs.stats.reads, 1)
+		atomic.AddInt64(&fs.stats.bytesRead, int64(op.BytesRead))
+	}()
+
+	if op.BytesRead < len(op.Dst) {
+		var bytesRead int
+		bytesRead, err = fs.readRange(ctx, handle, handle.stream, op.Dst[op.BytesRead:], op.Offset+int64(op.BytesRead))
+		op.BytesRead += bytesRead
+		if err != nil {
+			FuseLog("Error fetching file contents: " + err.Error())
+			err = fuse.EIO
+			return err
+		}
+	}
+
+	if handle.checksum != nil {
+		checksumErr := handle.checksum.Update(op.Offset, op.Dst[:op.BytesRead])
+		if checksumErr != nil {
+			FuseLog("Error: " + checksumErr.Error())
+			atomic.AddInt64(&fs.stats.checksumMismatches, 1)
+			if enforceChecksum {
+				return fuse.EIO
 			}
 		}
 	}
+
+	FuseLog("Read " + strconv.Itoa(op.BytesRead) + " bytes")
+	return nil
+}
+
+// readRange fills dst with the file contents starting at offset, going through
+// the block cache if there is one. Data is downloaded over the given stream, or
+// with a one-off ranged request if stream is nil. Reads past the end of the file
+// are cut short.
+func (fs *Gen3Fuse) readRange(ctx context.Context, handle *fileHandle, stream *contentStream, dst []byte, offset int64) (bytesRead int, err error) {
+	if offset >= int64(handle.info.attributes.Size) {
+		return 0, nil
+	}
+
+	if fs.blockCache != nil {
+		return fs.readFromCache(ctx, handle, stream, dst, offset)
+	}
+
+	fileBody, err := fs.fetchRange(ctx, handle, stream, offset, int64(len(dst)))
 	if err != nil {
-		FuseLog("Error fetching file contents: " + err.Error())
-		err = fuse.ENOENT
-		return err
+		return 0, err
 	}
+	return copy(dst, fileBody), nil
+}
 
-	reader := strings.NewReader(string(fileBody))
+// fetchRange downloads part of a file, retrying transient failures with
+// exponential backoff until the retry policy's attempts or deadline run out,
+// or ctx is done
+func (fs *Gen3Fuse) fetchRange(ctx context.Context, handle *fileHandle, stream *contentStream, offset int64, size int64) (fileBody []byte, err error) {
+	info := handle.info
+	policy := NewRetryPolicy(fs.gen3FuseConfig)
+	deadline := time.Now().Add(policy.Deadline)
+
+	for attempt := 1; ; attempt++ {
+		fileBody, err = fs.fetchRangeOnce(ctx, handle, stream, offset, size)
+		if err == nil {
+			atomic.AddInt64(&fs.stats.bytesDownloaded, int64(len(fileBody)))
+			return fileBody, nil
+		}
 
-	// op.Offset: The offset within the file at which to read.
-	// op.Dst: The destination buffer, whose length gives the size of the read.
+		retryable, retryAfter := IsRetryableError(err)
+		if !retryable {
+			return nil, err
+		}
+		if attempt >= policy.MaxAttempts {
+			FuseLog(fmt.Sprintf("Giving up on %v at offset %v after %v attempts: %v", info.DID, offset, attempt, err))
+			return nil, err
+		}
+		wait := policy.Backoff(attempt, retryAfter)
+		if time.Now().Add(wait).After(deadline) {
+			FuseLog(fmt.Sprintf("Giving up on %v at offset %v, the read deadline of %v has passed: %v", info.DID, offset, policy.Deadline, err))
+			return nil, err
+		}
 
-	op.BytesRead, err = reader.ReadAt(op.Dst, 0)
-	FuseLog("Read " + strconv.Itoa(op.BytesRead) + " bytes")
-	if op.BytesRead > 0 {
-		return nil
+		FuseLog(fmt.Sprintf("Retrying %v at offset %v in %v (attempt %v of %v): %v", info.DID, offset, wait, attempt+1, policy.MaxAttempts, err))
+		atomic.AddInt64(&fs.stats.retries, 1)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			FuseLog(fmt.Sprintf("Giving up on %v at offset %v, the read was interrupted: %v", info.DID, offset, err))
+			return nil, ctx.Err()
+		}
 	}
+}
 
+// fetchRangeOnce downloads part of a file, getting a fresh presigned URL if the current one has expired
+func (fs *Gen3Fuse) fetchRangeOnce(ctx context.Context, handle *fileHandle, stream *contentStream, offset int64, size int64) (fileBody []byte, err error) {
+	info := handle.info
+	fullsize := int64(info.attributes.Size)
+	fetch := func(presignedUrl string) ([]byte, error) {
+		// Large ranges are split over several connections
+		connections, chunkSize := fs.downloadConcurrency()
+		if connections > 1 && size >= 2*chunkSize {
+			return fetchContentsAtURLParallel(ctx, presignedUrl, offset, size, fullsize, connections, chunkSize)
+		}
+		if stream != nil {
+			return stream.ReadAt(presignedUrl, offset, size, fullsize)
+		}
+		return fetchContentsAtURL(ctx, presignedUrl, offset, size, fullsize)
+	}
+
+	presignedUrl, err := fs.handleURL(handle)
 	if err != nil {
-		FuseLog("Error reading file: " + err.Error())
+		return nil, err
 	}
+	fileBody, err = fetch(presignedUrl)
+	// Each storage provider has its own way of saying that a URL has expired
+	if expired, provider := isExpiredURLError(presignedUrl, err); expired {
+		FuseLog(fmt.Sprintf("The %v URL of %v has expired, getting a fresh one", provider, info.DID))
+		fresh, urlErr := fs.urls.Refresh(info, presignedUrl)
+		if urlErr != nil {
+			return nil, urlErr
+		}
+		handle.SetURL(fresh)
+		fileBody, err = fetch(fresh.URL)
+		if err != nil {
+			FuseLog("Error re-fetching file contents: " + err.Error())
+		}
+	}
+	return fileBody, err
+}
 
-	// Special case: FUSE doesn't expect us to return io.EOF.
-	if err == io.EOF {
-		err = nil
+func (fs *Gen3Fuse) downloadConcurrency() (connections int, chunkSize int64) {
+	connections = fs.gen3FuseConfig.DownloadConnections
+	if connections <= 0 {
+		connections = DefaultDownloadConnections
+	}
+	chunkSize = fs.gen3FuseConfig.DownloadChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultDownloadChunkSize
 	}
+	return connections, chunkSize
+}
 
-	return
+// readFromCache serves a read block by block from the block cache, downloading
+// and caching any block that is not there yet
+func (fs *Gen3Fuse) readFromCache(ctx context.Context, handle *fileHandle, stream *contentStream, dst []byte, offset int64) (bytesRead int, err error) {
+	info := handle.info
+	fullsize := int64(info.attributes.Size)
+	blockSize := fs.blockCache.BlockSize()
+
+	for bytesRead < len(dst) {
+		position := offset + int64(bytesRead)
+		if position >= fullsize {
+			break
+		}
+
+		index := position / blockSize
+		blockStart := index * blockSize
+		blockLength := blockSize
+		if blockStart+blockLength > fullsize {
+			blockLength = fullsize - blockStart
+		}
+
+		block, ok := fs.blockCache.Get(info.DID, index, blockLength)
+		if ok {
+			atomic.AddInt64(&fs.stats.cacheHits, 1)
+		} else {
+			atomic.AddInt64(&fs.stats.cacheMisses, 1)
+			block, err = fs.fetchRange(ctx, handle, stream, blockStart, blockLength)
+			if err != nil {
+				return bytesRead, err
+			}
+			if int64(len(block)) < blockLength {
+				return bytesRead, fmt.Errorf("short read of block %v of %v: got %v of %v bytes", index, info.DID, len(block), blockLength)
+			}
+			block = block[:blockLength]
+
+			err = fs.blockCache.Put(info.DID, index, block)
+			if err != nil {
+				// The read itself can still be served
+				FuseLog(fmt.Sprintf("Failed to cache block %v of %v: %v", index, info.DID, err))
+			}
+		}
+
+		bytesRead += copy(dst[bytesRead:], block[position-blockStart:])
+	}
+	return bytesRead, nil
 }
 
 type presignedURLResponse struct {
@@ -614,14 +1224,14 @@ func (fs *Gen3Fuse) GetPresignedURLFromExternalHost(info *inodeInfo) (presignedU
 
 	req, err := http.NewRequest("GET", drsRequestURL, nil)
 
-	accessToken := fs.accessToken
+	accessToken := fs.getAccessToken()
 	IDP := GetIDPForURL(drsRequestURL)
 	if len(IDP) < 1 {
 		FuseLog(fmt.Sprintf("Failed to determine IDP for URL %v", drsRequestURL))
 	} else {
-		accessToken = fs.ExternalIDPTokens[IDP]
+		accessToken = fs.getExternalIDPToken(IDP)
 
-		FuseLog(fmt.Sprintf("Got an access token for IDP %v: %v", IDP, accessToken))
+		FuseLog(fmt.Sprintf("Got an access token for IDP %v", IDP))
 	}
 
 	req.Header.Add("Authorization", "Bearer "+accessToken)
@@ -649,6 +1259,7 @@ func (fs *Gen3Fuse) GetPresignedURLFromExternalHost(info *inodeInfo) (presignedU
 		if err != nil {
 			return "", err
 		}
+		fs.setExternalIDPToken(IDP, accessToken)
 
 		FuseLog("GET " + drsRequestURL)
 		req, err := http.NewRequest("GET", drsRequestURL, nil)
@@ -685,7 +1296,8 @@ func (fs *Gen3Fuse) GetPresignedURLFromFence(info *inodeInfo) (presignedUrl stri
 	FuseLog(fmt.Sprintf("Inside GetPresignedURLFromFence with %s", info.DID))
 	DID := info.DID
 	// The below code talks to the Fence microservice (case where info.FromExternalHost == false)
-	resp, err := fs.FetchURLResponseFromFence(DID)
+	accessToken := fs.getAccessToken()
+	resp, err := fs.FetchURLResponseFromFence(DID, accessToken)
 	if err != nil {
 		return "", err
 	}
@@ -697,16 +1309,16 @@ func (fs *Gen3Fuse) GetPresignedURLFromFence(info *inodeInfo) (presignedUrl stri
 	} else if resp.StatusCode == 401 {
 		// refresh the access token and try again just one more time
 		FuseLog("Got 401, retrying...")
-		fs.accessToken, err = GetAccessToken(fs.gen3FuseConfig)
+		accessToken, err = fs.refreshAccessToken(accessToken)
 		if err != nil {
 			return "", err
 		}
-		respRetry, err := fs.FetchURLResponseFromFence(DID)
+		resp, err = fs.FetchURLResponseFromFence(DID, accessToken)
 		if err != nil {
 			return "", err
 		}
 
-		defer respRetry.Body.Close()
+		defer resp.Body.Close()
 
 		if resp.StatusCode == 200 {
 			return fs.URLFromSuccessResponse(resp), nil
@@ -753,18 +1365,19 @@ func (fs *Gen3Fuse) HandleIndexdError(resp *http.Response) (err error) {
 	return fuse.EIO
 }
 
-func (fs *Gen3Fuse) FetchURLResponseFromFence(DID string) (response *http.Response, err error) {
-	requestUrl := fmt.Sprintf(fs.gen3FuseConfig.Hostname+fs.gen3FuseConfig.FencePresignedURLPath, DID+"?expires_in=900")
+func (fs *Gen3Fuse) FetchURLResponseFromFence(DID string, accessToken string) (response *http.Response, err error) {
+	expiresIn := int64(presignedURLExpiresIn(fs.gen3FuseConfig) / time.Second)
+	requestUrl := fmt.Sprintf(fs.gen3FuseConfig.Hostname+fs.gen3FuseConfig.FencePresignedURLPath, DID+"?expires_in="+strconv.FormatInt(expiresIn, 10))
 	FuseLog("GET " + requestUrl)
 
 	req, err := http.NewRequest("GET", requestUrl, nil)
-	req.Header.Add("Authorization", "Bearer "+fs.accessToken)
-	req.Header.Add("Accept", "application/json")
-
 	if err != nil {
 		FuseLog(err.Error() + " (" + DID + ") ")
 		return nil, err
 	}
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	req.Header.Add("Accept", "application/json")
+
 	resp, err := myClient.Do(req)
 
 	if err != nil {
@@ -785,13 +1398,19 @@ func (fs *Gen3Fuse) URLFromSuccessResponse(resp *http.Response) (presignedUrl st
 }
 
 func (fs *Gen3Fuse) GetExternalHostFileInfos(didsWithExternalInfo []string, didToFileInfo map[string]*FileInfo) (didToFileInfoModified map[string]*FileInfo, err error) {
+	return fs.getExternalHostFileInfos(didsWithExternalInfo, didToFileInfo, fs.DIDsToCommonsHostnames, &fs.status)
+}
+
+// getExternalHostFileInfos looks up DIDs in the commons of commonsHostnames,
+// recording the failed lookups in status
+func (fs *Gen3Fuse) getExternalHostFileInfos(didsWithExternalInfo []string, didToFileInfo map[string]*FileInfo, commonsHostnames map[string]string, status *mountStatus) (didToFileInfoModified map[string]*FileInfo, err error) {
 	// Manifest entries with a commons_url field filled out have FileInfo metadata
 	// in a location other than Indexd. This function retrieves that metadata.
 	// Currently supporting DRS objects with metadata in the JCOIN commons.
 
 	for i := 0; i < len(didsWithExternalInfo); i += 1 {
 		did := didsWithExternalInfo[i]
-		commonsHostname := fs.DIDsToCommonsHostnames[did]
+		commonsHostname := commonsHostnames[did]
 		// For now, we assume that all entries with a commons_url support the DRS API.
 		if commonsHostname[len(commonsHostname)-1:] != "/" {
 			commonsHostname = commonsHostname + "/"
@@ -813,17 +1432,20 @@ func (fs *Gen3Fuse) GetExternalHostFileInfos(didsWithExternalInfo []string, didT
 		req.Header.Set("Content-Type", "application/json")
 		if err != nil {
 			FuseLog(err.Error())
+			status.setUnresolved(did, err.Error())
 			continue
 		}
 		resp, err := client.Do(req)
 
 		if err != nil {
 			FuseLog(err.Error())
+			status.setUnresolved(did, err.Error())
 			continue
 		}
 
 		if resp.StatusCode != 200 {
 			FuseLog(fmt.Sprintf("Error: Failed to retrieve file info from %s with status code %d", drsRequestURL, resp.StatusCode))
+			status.setUnresolved(did, fmt.Sprintf("%s answered with status code %d", drsRequestURL, resp.StatusCode))
 			continue
 		}
 
@@ -852,6 +1474,33 @@ func (fs *Gen3Fuse) GetExternalHostFileInfos(didsWithExternalInfo []string, didT
 			fileInfo.Filesize = uint64(size)
 		}
 
+		createdTime, ok := jsonMap["created_time"].(string)
+		if ok {
+			fileInfo.CreatedDate = createdTime
+		}
+
+		updatedTime, ok := jsonMap["updated_time"].(string)
+		if ok {
+			fileInfo.UpdatedDate = updatedTime
+		}
+
+		checksums, ok := jsonMap["checksums"].([]interface{})
+		if ok {
+			fileInfo.Hashes = make(map[string]string)
+			for _, checksumTest := range checksums {
+				checksum, ok := checksumTest.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				checksumType, typeOk := checksum["type"].(string)
+				value, valueOk := checksum["checksum"].(string)
+				if typeOk && valueOk {
+					// DRS names sha256 "sha-256"
+					fileInfo.Hashes[strings.ReplaceAll(strings.ToLower(checksumType), "-", "")] = value
+				}
+			}
+		}
+
 		// The below code indexes deeper into the DRS API response to obtain access information.
 		// Because we unmarshalled the JSON without specifying a fixed structure, we test
 		// the type of each nested value before indexing deeper into the value.
@@ -898,20 +1547,27 @@ func (fs *Gen3Fuse) GetExternalHostFileInfos(didsWithExternalInfo []string, didT
 }
 
 func (fs *Gen3Fuse) GetFileNamesAndSizes() (didToFileInfo map[string]*FileInfo, err error) {
+	return fs.resolveDIDs(fs.DIDs, fs.DIDsToCommonsHostnames, &fs.status)
+}
+
+// resolveDIDs gets the records of the given DIDs of the manifest from Indexd,
+// or from the DRS server of their commons in commonsHostnames. Failed
+// lookups are recorded in status.
+func (fs *Gen3Fuse) resolveDIDs(DIDs []string, commonsHostnames map[string]string, status *mountStatus) (didToFileInfo map[string]*FileInfo, err error) {
 	indexdRequestURL := fs.gen3FuseConfig.Hostname + fs.gen3FuseConfig.IndexdBulkFileInfoPath
 	var DIDsWithIndexdInfo []string
 	var DIDsWithFileInfoFromExternalHosts []string
 	didToFileInfo = make(map[string]*FileInfo, 0)
-	FuseLog(fmt.Sprintf("Getting %v records", len(fs.DIDs)))
-	for i := 0; i < len(fs.DIDs); i += 1000 {
+	FuseLog(fmt.Sprintf("Getting %v records", len(DIDs)))
+	for i := 0; i < len(DIDs); i += 1000 {
 		last := i + 1000
-		if len(fs.DIDs) < last {
-			last = len(fs.DIDs)
+		if len(DIDs) < last {
+			last = len(DIDs)
 		}
 		DIDsWithIndexdInfo = []string{}
 
-		for _, x := range fs.DIDs[i:last] {
-			if _, ok := fs.DIDsToCommonsHostnames[x]; ok {
+		for _, x := range DIDs[i:last] {
+			if _, ok := commonsHostnames[x]; ok {
 				FuseLog(fmt.Sprintf("Added %#v to externals\n", x))
 				DIDsWithFileInfoFromExternalHosts = append(DIDsWithFileInfoFromExternalHosts, x)
 			} else {
@@ -964,7 +1620,7 @@ func (fs *Gen3Fuse) GetFileNamesAndSizes() (didToFileInfo map[string]*FileInfo,
 
 		if len(DIDsWithFileInfoFromExternalHosts) > 0 {
 			// Now get the DRS file infos
-			didToFileInfo, err = fs.GetExternalHostFileInfos(DIDsWithFileInfoFromExternalHosts, didToFileInfo)
+			didToFileInfo, err = fs.getExternalHostFileInfos(DIDsWithFileInfoFromExternalHosts, didToFileInfo, commonsHostnames, status)
 
 			if err != nil {
 				FuseLog(fmt.Sprintf("Error: failed to retrieve external host file infos. %v ", err))
@@ -975,52 +1631,68 @@ func (fs *Gen3Fuse) GetFileNamesAndSizes() (didToFileInfo map[string]*FileInfo,
 	return didToFileInfo, nil
 }
 
+// FetchContentsAtURL downloads the size bytes starting at offset, stopping
+// early at the end of the file. HTTP ranges include their last byte, so the
+// request asks for bytes offset through offset+size-1.
 func FetchContentsAtURL(presignedUrl string, offset int64, size int64, fullsize int64) (byteContents []byte, err error) {
+	return fetchContentsAtURL(context.Background(), presignedUrl, offset, size, fullsize)
+}
 
-	// Huge timeout because we're about to download a file
-	timeout := time.Duration(500 * time.Second)
-	client := http.Client{
-		Timeout: timeout,
-	}
-	req, _ := http.NewRequest("GET", presignedUrl, nil)
+// fetchContentsAtURL is FetchContentsAtURL, giving up when ctx is done
+func fetchContentsAtURL(ctx context.Context, presignedUrl string, offset int64, size int64, fullsize int64) (byteContents []byte, err error) {
 	last := offset + size
 	if last > fullsize {
 		last = fullsize
 	}
-	if last == offset {
+	if last <= offset {
 		return []byte{}, nil
 	}
-	if !(offset == 0 && size == 0) {
-		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, last))
-	}
-	resp, err := client.Do(req)
-	if resp.StatusCode >= 400 {
-		defer resp.Body.Close()
-		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		bodyString := string(bodyBytes)
-		FuseLog(bodyString)
-		return nil, &APIError{resp.StatusCode, presignedUrl}
+
+	// Huge timeout because we're about to download a file
+	ctx, cancel := context.WithTimeout(ctx, 500*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", presignedUrl, nil)
+	if err != nil {
+		return nil, err
 	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, last-1))
 
+	resp, err := dataClient.Do(req)
 	if err != nil {
+		err = stripURLErrorQuery(err)
 		FuseLog(err.Error())
-		return byteContents, err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
-	//var structStr string = fmt.Sprintf("%#v", resp.Header["Content-Length"])
-	//FuseLog("\n Get size: " + structStr + "\n")
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		FuseLog(fmt.Sprintf("Offset %v is past the end of %v", offset, stripQuery(presignedUrl)))
+		return []byte{}, nil
+	}
+	if resp.StatusCode >= 400 {
+		return nil, apiErrorFromResponse(resp, presignedUrl)
+	}
 
-	byteContents, err = ioutil.ReadAll(resp.Body)
+	body, total, err := rangeResponseBody(resp, presignedUrl, offset)
 	if err != nil {
-		FuseLog("Error reading file at " + presignedUrl)
-		return byteContents, err
+		FuseLog(err.Error())
+		return nil, err
 	}
 
-	return byteContents, err
+	byteContents, err = readRangeBody(body, offset, last-offset, total)
+	if err != nil {
+		FuseLog(fmt.Sprintf("Error reading file at %v: %v", stripQuery(presignedUrl), err))
+		return nil, err
+	}
+	return byteContents, nil
 }
 
+// Serializes writes to the log, which come from concurrent operations
+var logMu sync.Mutex
+
 func FuseLog(message string) {
+	logMu.Lock()
+	defer logMu.Unlock()
 
 	// Log messages to stdout too
 	fmt.Println(message)
@@ -1031,5 +1703,5 @@ func FuseLog(message string) {
 	}
 	defer file.Close()
 
-	fmt.Fprintf(file, message+"\n")
+	fmt.Fprintln(file, message)
 }
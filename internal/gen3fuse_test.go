@@ -0,0 +1,292 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+)
+
+const testInode fuseops.InodeID = 10
+
+// testFsOption sets up a part of the file system built by newTestFs
+type testFsOption func(fs *Gen3Fuse)
+
+// newTestFs returns a file system holding a single file of the given size,
+// unless the options give it other files
+func newTestFs(config *Gen3FuseConfig, size int, options ...testFsOption) *Gen3Fuse {
+	fs := &Gen3Fuse{
+		gen3FuseConfig:    config,
+		handles:           newHandleTable(),
+		stop:              make(chan struct{}),
+		ExternalIDPTokens: map[string]string{},
+		inodes: map[fuseops.InodeID]*inodeInfo{
+			testInode: &inodeInfo{
+				attributes: fuseops.InodeAttributes{Size: uint64(size)},
+				Name:       "object",
+				DID:        "did",
+			},
+		},
+	}
+	fs.urls = newURLManager(fs.GetPresignedURL, presignedURLExpiresIn(config))
+	for _, option := range options {
+		option(fs)
+	}
+	return fs
+}
+
+// withFiles mounts the given files in place of the single test file
+func withFiles(didToFileInfo map[string]*FileInfo) testFsOption {
+	return func(fs *Gen3Fuse) {
+		fs.setInodes(mustInitializeInodes(didToFileInfo, fs.gen3FuseConfig))
+	}
+}
+
+// withManifest mounts the files of a manifest written to a temporary file,
+// looking them up in the Indexd of the config
+func withManifest(t *testing.T, manifest string) testFsOption {
+	return func(fs *Gen3Fuse) {
+		fs.status.manifestFilePath = writeManifestFile(t, "manifest.json", manifest)
+		assert.Nil(t, fs.ReloadManifest())
+	}
+}
+
+// withURLs hands out the URLs of fetch rather than asking Fence for them
+func withURLs(fetch func(info *inodeInfo) (string, error)) testFsOption {
+	return func(fs *Gen3Fuse) {
+		fs.urls = newURLManager(fetch, time.Hour)
+	}
+}
+
+// withReadAhead turns on read-ahead, following the config
+func withReadAhead() testFsOption {
+	return func(fs *Gen3Fuse) {
+		fs.readAhead = newReadAheadTracker(fs, fs.gen3FuseConfig)
+	}
+}
+
+func mustInitializeInodes(didToFileInfo map[string]*FileInfo, config *Gen3FuseConfig) map[fuseops.InodeID]*inodeInfo {
+	inodes, err := InitializeInodes(didToFileInfo, config)
+	if err != nil {
+		panic(err)
+	}
+	return inodes
+}
+
+// openTestFile opens the test file as if Fence had handed out presignedUrl for it
+func openTestFile(fs *Gen3Fuse, presignedUrl string) fuseops.HandleID {
+	return fs.openHandle(testInode, fs.inodes[testInode], newPresignedURL(presignedUrl, time.Now(), DefaultPresignedURLExpiresIn))
+}
+
+// fakeCommons stands in for Fence and the storage backend. Fence only accepts
+// the access token it last handed out, and signs URLs that point back at the
+// storage side of the same server. The storage side rejects expired URLs.
+type fakeCommons struct {
+	*httptest.Server
+	contents map[string][]byte
+
+	mu            sync.Mutex
+	token         int
+	tokenRequests int
+	urlRequests   int
+	expiresIn     []string
+	rejected      int
+}
+
+func newFakeCommons(t *testing.T, contents map[string][]byte) *fakeCommons {
+	commons := &fakeCommons{contents: contents}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user/credentials/api/access_token", func(w http.ResponseWriter, r *http.Request) {
+		commons.mu.Lock()
+		commons.token++
+		commons.tokenRequests++
+		token := fmt.Sprint("token-", commons.token)
+		commons.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"access_token": token})
+	})
+	mux.HandleFunc("/user/data/download/", func(w http.ResponseWriter, r *http.Request) {
+		commons.mu.Lock()
+		valid := r.Header.Get("Authorization") == fmt.Sprint("Bearer token-", commons.token)
+		commons.mu.Unlock()
+		if !valid {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		expiresIn := r.URL.Query().Get("expires_in")
+		commons.mu.Lock()
+		commons.urlRequests++
+		commons.expiresIn = append(commons.expiresIn, expiresIn)
+		commons.mu.Unlock()
+
+		did := strings.TrimPrefix(r.URL.Path, "/user/data/download/")
+		signed := fmt.Sprintf("%v/data/%v?X-Amz-Date=%v&X-Amz-Expires=%v",
+			commons.URL, did, time.Now().UTC().Format("20060102T150405Z"), expiresIn)
+		json.NewEncoder(w).Encode(map[string]string{"url": signed})
+	})
+	mux.HandleFunc("/index/bulk/documents", func(w http.ResponseWriter, r *http.Request) {
+		var dids []string
+		json.NewDecoder(r.Body).Decode(&dids)
+		records := make([]*FileInfo, 0, len(dids))
+		for _, did := range dids {
+			if content, ok := commons.contents[did]; ok {
+				records = append(records, &FileInfo{DID: did, Filesize: uint64(len(content)), URLs: []string{"s3://bucket/" + did}})
+			}
+		}
+		json.NewEncoder(w).Encode(records)
+	})
+	mux.HandleFunc("/data/", func(w http.ResponseWriter, r *http.Request) {
+		if expires, ok := signedURLExpiry(r.URL.String()); !ok || time.Now().After(expires) {
+			commons.mu.Lock()
+			commons.rejected++
+			commons.mu.Unlock()
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		content, ok := commons.contents[strings.TrimPrefix(r.URL.Path, "/data/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(content))
+	})
+	commons.Server = httptest.NewServer(mux)
+	t.Cleanup(commons.Close)
+	return commons
+}
+
+func (commons *fakeCommons) config() *Gen3FuseConfig {
+	return &Gen3FuseConfig{
+		Hostname:               commons.URL,
+		IndexdBulkFileInfoPath: "/index/bulk/documents",
+		FencePresignedURLPath:  "/user/data/download/%s",
+		FenceAccessTokenPath:   "/user/credentials/api/access_token",
+		ApiKey:                 "key",
+		ReadAheadMinWindow:     16 * 1024,
+		ReadAheadMaxWindow:     64 * 1024,
+		ReadAheadMaxMemory:     1024 * 1024,
+		RetryInitialBackoff:    time.Millisecond,
+	}
+}
+
+func TestConcurrentOperations(t *testing.T) {
+	contents := map[string][]byte{}
+	didToFileInfo := map[string]*FileInfo{}
+	for i := 0; i < 20; i++ {
+		did := fmt.Sprintf("dg.TEST-%02d", i)
+		contents[did] = make([]byte, 64*1024+i)
+		rand.Read(contents[did])
+		didToFileInfo[did] = &FileInfo{
+			Filesize: uint64(len(contents[did])),
+			DID:      did,
+			URLs:     []string{fmt.Sprintf("s3://bucket/dir/file-%02d.bin", i)},
+		}
+	}
+	commons := newFakeCommons(t, contents)
+	config := commons.config()
+
+	fs := newTestFs(config, 0, withReadAhead(), withFiles(didToFileInfo))
+	// Fence rejects this token, so the first opens all race to refresh it
+	fs.accessToken = "expired"
+	defer fs.Destroy()
+
+	// the by-guid directory
+	byGUID := fuseops.InodeID(fuseops.RootInodeID + 1)
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for worker := 0; worker < 200; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			did := fmt.Sprintf("dg.TEST-%02d", worker%20)
+			content := contents[did]
+
+			lookUp := &fuseops.LookUpInodeOp{Parent: byGUID, Name: did}
+			if !assert.Nil(t, fs.LookUpInode(ctx, lookUp)) {
+				return
+			}
+			assert.Equal(t, uint64(len(content)), lookUp.Entry.Attributes.Size)
+			assert.Nil(t, fs.GetInodeAttributes(ctx, &fuseops.GetInodeAttributesOp{Inode: lookUp.Entry.Child}))
+			assert.Nil(t, fs.ReadDir(ctx, &fuseops.ReadDirOp{Inode: byGUID, Dst: make([]byte, 4096)}))
+
+			open := &fuseops.OpenFileOp{Inode: lookUp.Entry.Child}
+			if !assert.Nil(t, fs.OpenFile(ctx, open)) {
+				return
+			}
+			defer fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: open.Handle})
+
+			// half of the workers read sequentially, the others at random
+			for i := 0; i < 16; i++ {
+				offset := int64(i * 4096)
+				if worker%2 == 1 {
+					offset = rand.Int63n(int64(len(content)))
+				}
+				read := &fuseops.ReadFileOp{Inode: lookUp.Entry.Child, Handle: open.Handle, Offset: offset, Dst: make([]byte, 4096)}
+				if !assert.Nil(t, fs.ReadFile(ctx, read)) {
+					return
+				}
+				assert.Equal(t, expectedRange(content, offset, 4096), read.Dst[:read.BytesRead])
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 0, fs.handles.Len())
+	// the rejected token was only replaced once
+	commons.mu.Lock()
+	defer commons.mu.Unlock()
+	assert.Equal(t, 1, commons.tokenRequests)
+}
+
+func TestOpenFileRefreshesURLsBeforeTheyExpire(t *testing.T) {
+	content := []byte("content behind a short-lived URL")
+	commons := newFakeCommons(t, map[string][]byte{"did": content})
+	config := commons.config()
+	config.PresignedURLExpiresIn = 2 * time.Second
+
+	fs := newTestFs(config, len(content))
+	fs.accessToken = "token-0"
+	ctx := context.Background()
+
+	open := func() fuseops.HandleID {
+		op := &fuseops.OpenFileOp{Inode: testInode}
+		assert.Nil(t, fs.OpenFile(ctx, op))
+		return op.Handle
+	}
+	read := func(handle fuseops.HandleID) {
+		op := &fuseops.ReadFileOp{Inode: testInode, Handle: handle, Dst: make([]byte, 100)}
+		assert.Nil(t, fs.ReadFile(ctx, op))
+		assert.Equal(t, content, op.Dst[:op.BytesRead])
+	}
+
+	// opens share the URL while it is fresh
+	first := open()
+	second := open()
+	read(first)
+	read(second)
+	commons.mu.Lock()
+	assert.Equal(t, 1, commons.urlRequests)
+	assert.Equal(t, []string{"2"}, commons.expiresIn)
+	commons.mu.Unlock()
+
+	// once the URL is about to expire, the next read gets a new one before
+	// the backend has a chance to reject the old one
+	handle, _ := fs.handles.Get(first)
+	time.Sleep(time.Until(handle.URL().refreshAt()) + 10*time.Millisecond)
+	read(first)
+	read(second)
+
+	commons.mu.Lock()
+	defer commons.mu.Unlock()
+	assert.Equal(t, 2, commons.urlRequests)
+	assert.Equal(t, 0, commons.rejected)
+}
@@ -0,0 +1,251 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Streams of open files that have not been read from in this long are closed,
+// so that idle handles do not hold on to connections
+const streamIdleTimeout = 2 * time.Minute
+
+// fileHandle holds the state of one open file. Everything a read needs is
+// reached through the handle, so it keeps working for as long as the file is
+// open.
+type fileHandle struct {
+	inode fuseops.InodeID
+	info  *inodeInfo
+
+	// The presigned URL this handle reads from, see urls.go
+	mu  sync.Mutex
+	url *presignedURL
+
+	// The streaming download serving this handle's reads
+	stream *contentStream
+
+	// Access pattern and prefetched data, nil when read-ahead is disabled
+	readAhead *readAhead
+
+	// Hashes the content as it is read, nil when there is nothing to check
+	checksum *checksumVerifier
+
+	// For the files of the control directory, their content when opened
+	control []byte
+
+	opened    time.Time
+	bytesRead int64
+	reads     int64
+}
+
+func (handle *fileHandle) URL() *presignedURL {
+	handle.mu.Lock()
+	defer handle.mu.Unlock()
+	return handle.url
+}
+
+func (handle *fileHandle) SetURL(url *presignedURL) {
+	handle.mu.Lock()
+	defer handle.mu.Unlock()
+	handle.url = url
+}
+
+func (handle *fileHandle) recordRead(bytesRead int) {
+	atomic.AddInt64(&handle.reads, 1)
+	atomic.AddInt64(&handle.bytesRead, int64(bytesRead))
+}
+
+// handleTable hands out file handle IDs and keeps track of open files
+type handleTable struct {
+	mu      sync.Mutex
+	next    fuseops.HandleID
+	handles map[fuseops.HandleID]*fileHandle
+}
+
+func newHandleTable() *handleTable {
+	return &handleTable{
+		handles: make(map[fuseops.HandleID]*fileHandle),
+	}
+}
+
+func (table *handleTable) Add(handle *fileHandle) fuseops.HandleID {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	table.next++
+	table.handles[table.next] = handle
+	return table.next
+}
+
+func (table *handleTable) Get(id fuseops.HandleID) (handle *fileHandle, ok bool) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	handle, ok = table.handles[id]
+	return
+}
+
+func (table *handleTable) Remove(id fuseops.HandleID) (handle *fileHandle, ok bool) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	handle, ok = table.handles[id]
+	delete(table.handles, id)
+	return
+}
+
+func (table *handleTable) Len() int {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	return len(table.handles)
+}
+
+// OpenInodes returns the inodes that have a handle open on them
+func (table *handleTable) OpenInodes() map[fuseops.InodeID]*inodeInfo {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	inodes := make(map[fuseops.InodeID]*inodeInfo)
+	for _, handle := range table.handles {
+		inodes[handle.inode] = handle.info
+	}
+	return inodes
+}
+
+// openDIDs returns the DIDs of the files that have a handle open on them
+func (table *handleTable) openDIDs() map[string]bool {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	DIDs := make(map[string]bool)
+	for _, handle := range table.handles {
+		DIDs[handle.info.DID] = true
+	}
+	return DIDs
+}
+
+// all returns the open handles, which the caller goes through without
+// holding the table's lock
+func (table *handleTable) all() []*fileHandle {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	handles := make([]*fileHandle, 0, len(table.handles))
+	for _, handle := range table.handles {
+		handles = append(handles, handle)
+	}
+	return handles
+}
+
+// closeIdleStreams closes the streams of handles that have not been read from
+// since idleSince. They are reopened if the handle is read again.
+func (table *handleTable) closeIdleStreams(idleSince time.Time) {
+	for _, handle := range table.all() {
+		handle.stream.CloseIfIdle(idleSince)
+	}
+}
+
+// reapIdleStreams periodically closes the streams of idle handles until stop is closed
+func (table *handleTable) reapIdleStreams(stop <-chan struct{}) {
+	ticker := time.NewTicker(streamIdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			table.closeIdleStreams(time.Now().Add(-streamIdleTimeout))
+		case <-stop:
+			return
+		}
+	}
+}
+
+// openHandle sets up the state for a new open of a file
+func (fs *Gen3Fuse) openHandle(inode fuseops.InodeID, info *inodeInfo, url *presignedURL) fuseops.HandleID {
+	handle := &fileHandle{
+		inode:  inode,
+		info:   info,
+		url:    url,
+		stream: &contentStream{},
+		opened: time.Now(),
+	}
+	if fs.readAhead != nil {
+		handle.readAhead = fs.readAhead.Register()
+	}
+	if fs.checksumPolicy() != ChecksumPolicyOff && info.record != nil {
+		handle.checksum = newChecksumVerifier(info.DID, info.record.Hashes, int64(info.attributes.Size))
+	}
+	return fs.handles.Add(handle)
+}
+
+// handleURL returns the URL to read the handle's file from, swapping in a new
+// one from the URL manager when the current one is about to expire
+func (fs *Gen3Fuse) handleURL(handle *fileHandle) (string, error) {
+	current := handle.URL()
+	if current.Fresh(time.Now()) {
+		return current.URL, nil
+	}
+	fresh, err := fs.urls.Get(handle.info)
+	if err != nil {
+		// The old URL still works for a little while
+		if time.Now().Before(current.Expires) {
+			FuseLog(fmt.Sprintf("Failed to refresh the URL of %v, using the current one until it expires: %v", handle.info.DID, err))
+			return current.URL, nil
+		}
+		return "", err
+	}
+	handle.SetURL(fresh)
+	return fresh.URL, nil
+}
+
+// refreshURLs replaces the URLs of open files that would be due for a refresh
+// by the next check, so that the first read of a handle that has been idle
+// for a long time does not find its URL expired
+func (fs *Gen3Fuse) refreshURLs(now time.Time, interval time.Duration) {
+	for _, handle := range fs.handles.all() {
+		current := handle.URL()
+		if current == nil || current.Fresh(now.Add(interval)) {
+			continue
+		}
+		fresh, err := fs.urls.Renew(handle.info, now.Add(interval))
+		if err != nil {
+			FuseLog(fmt.Sprintf("Failed to refresh the URL of %v ahead of time: %v", handle.info.DID, err))
+			continue
+		}
+		handle.SetURL(fresh)
+	}
+	fs.urls.Prune(fs.handles.openDIDs(), now)
+}
+
+// keepURLsFresh periodically refreshes the URLs of open files until stop is closed
+func (fs *Gen3Fuse) keepURLsFresh(stop <-chan struct{}) {
+	interval := urlRefreshInterval(fs.urls.expiresIn)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fs.refreshURLs(time.Now(), interval)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// releaseHandle frees everything held by an open file
+func (fs *Gen3Fuse) releaseHandle(id fuseops.HandleID) {
+	handle, ok := fs.handles.Remove(id)
+	if !ok {
+		return
+	}
+
+	handle.stream.Close()
+	if handle.readAhead != nil {
+		fs.readAhead.Unregister(handle.readAhead)
+	}
+	if handle.URL() != nil && !fs.handles.openDIDs()[handle.info.DID] {
+		fs.urls.Forget(handle.info.DID)
+	}
+
+	FuseLog(fmt.Sprintf("Closed %v after reading %v bytes in %v reads over %v",
+		handle.info.DID, atomic.LoadInt64(&handle.bytesRead), atomic.LoadInt64(&handle.reads), time.Since(handle.opened).Round(time.Millisecond)))
+}
@@ -0,0 +1,472 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Manifests come as a JSON list of records, as newline-delimited JSON with a
+// record per line, as a TSV or CSV table with a record per row, or as a PFB
+// file (see pfb.go). The columns of tables and the keys of NDJSON records
+// are mapped to manifest fields by name, through ManifestColumns.
+
+const (
+	ManifestFormatJSON   = "json"
+	ManifestFormatNDJSON = "ndjson"
+	ManifestFormatTSV    = "tsv"
+	ManifestFormatCSV    = "csv"
+	ManifestFormatPFB    = "pfb"
+)
+
+// What to do with records whose object ID is already in the manifest
+const (
+	DuplicateObjectIDPolicyDedupe = "dedupe"
+	DuplicateObjectIDPolicyError  = "error"
+
+	DefaultDuplicateObjectIDPolicy = DuplicateObjectIDPolicyDedupe
+)
+
+func validDuplicateObjectIDPolicy(policy string) bool {
+	switch policy {
+	case DuplicateObjectIDPolicyDedupe, DuplicateObjectIDPolicyError:
+		return true
+	}
+	return false
+}
+
+func duplicateObjectIDPolicy(gen3FuseConfig *Gen3FuseConfig) string {
+	if gen3FuseConfig.DuplicateObjectIDPolicy == "" {
+		return DefaultDuplicateObjectIDPolicy
+	}
+	return gen3FuseConfig.DuplicateObjectIDPolicy
+}
+
+var manifestFormatsByExtension = map[string]string{
+	".json":   ManifestFormatJSON,
+	".ndjson": ManifestFormatNDJSON,
+	".jsonl":  ManifestFormatNDJSON,
+	".tsv":    ManifestFormatTSV,
+	".csv":    ManifestFormatCSV,
+	".avro":   ManifestFormatPFB,
+	".pfb":    ManifestFormatPFB,
+}
+
+// manifestFields sets the fields of a record from the columns mapped to them
+var manifestFields = map[string]func(record *ManifestRecord, value string){
+	"object_id":    func(record *ManifestRecord, value string) { record.ObjectId = value },
+	"commons_url":  func(record *ManifestRecord, value string) { record.CommonsHostname = value },
+	"subject_id":   func(record *ManifestRecord, value string) { record.SubjectId = value },
+	"file_name":    func(record *ManifestRecord, value string) { record.FileName = value },
+	"uuid":         func(record *ManifestRecord, value string) { record.Uuid = value },
+	"data_format":  func(record *ManifestRecord, value string) { record.DataFormat = value },
+	"data_type":    func(record *ManifestRecord, value string) { record.DataType = value },
+	"project_id":   func(record *ManifestRecord, value string) { record.ProjectId = value },
+	"submitter_id": func(record *ManifestRecord, value string) { record.SubmitterId = value },
+}
+
+// Columns named after a manifest field map to it, and so do these. Column
+// names are compared as normalized by normalizeColumn.
+var defaultManifestColumns = map[string]string{
+	"guid":     "object_id",
+	"did":      "object_id",
+	"filename": "file_name",
+	"commons":  "commons_url",
+}
+
+// normalizeColumn makes "File Name", "file-name" and "file_name" the same
+// column
+func normalizeColumn(name string) string {
+	name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+	return strings.NewReplacer(" ", "_", "-", "_").Replace(name)
+}
+
+// manifestColumns returns the field each column maps to, with the columns of
+// the config added to the defaults
+func manifestColumns(configColumns map[string]string) (map[string]string, error) {
+	columns := make(map[string]string)
+	for field := range manifestFields {
+		columns[field] = field
+	}
+	for column, field := range defaultManifestColumns {
+		columns[column] = field
+	}
+	for column, field := range configColumns {
+		if _, ok := manifestFields[field]; !ok {
+			fields := make([]string, 0, len(manifestFields))
+			for field := range manifestFields {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+			return nil, fmt.Errorf("Invalid ManifestColumns field %q for the column %q, expected one of %v", field, column, strings.Join(fields, ", "))
+		}
+		columns[normalizeColumn(column)] = field
+	}
+	return columns, nil
+}
+
+// detectManifestFormat tells the format of a manifest from its extension, or
+// else from how it starts
+func detectManifestFormat(manifestFilePath string, start []byte) string {
+	if bytes.HasPrefix(start, avroMagic) {
+		return ManifestFormatPFB
+	}
+	if format, ok := manifestFormatsByExtension[strings.ToLower(filepath.Ext(manifestFilePath))]; ok {
+		return format
+	}
+	content := bytes.TrimLeft(bytes.TrimPrefix(start, []byte("\ufeff")), " \t\r\n")
+	switch {
+	case bytes.HasPrefix(content, []byte("[")):
+		return ManifestFormatJSON
+	case bytes.HasPrefix(content, []byte("{")):
+		return ManifestFormatNDJSON
+	}
+	header := content
+	if i := bytes.IndexByte(header, '\n'); i >= 0 {
+		header = header[:i]
+	}
+	if bytes.IndexByte(header, '\t') >= 0 {
+		return ManifestFormatTSV
+	}
+	return ManifestFormatCSV
+}
+
+// ManifestReport is what reading a manifest found
+type ManifestReport struct {
+	Format string
+	// How many records the manifest has, and how many distinct object IDs
+	Records   int
+	ObjectIDs int
+	// Records that were skipped, and why
+	Warnings []string
+}
+
+// manifestReader collects the records of a manifest along with where they
+// are, to point at the records that are skipped
+type manifestReader struct {
+	records  []ManifestRecord
+	lines    []int
+	warnings []string
+}
+
+func (reader *manifestReader) add(record ManifestRecord, line int) {
+	reader.records = append(reader.records, record)
+	reader.lines = append(reader.lines, line)
+}
+
+func (reader *manifestReader) warn(format string, a ...interface{}) {
+	reader.warnings = append(reader.warnings, fmt.Sprintf(format, a...))
+}
+
+// where tells where the ith record is, by line if the format has lines
+func (reader *manifestReader) where(i int) string {
+	if reader.lines[i] > 0 {
+		return fmt.Sprintf("line %v", reader.lines[i])
+	}
+	return fmt.Sprintf("record %v", i+1)
+}
+
+// ValidateManifest reads a manifest as NewGen3Fuse does, without mounting it
+func ValidateManifest(gen3FuseConfig *Gen3FuseConfig, manifestFilePath string) (*ManifestReport, error) {
+	_, report, err := parseManifest(manifestFilePath, gen3FuseConfig)
+	return report, err
+}
+
+// parseManifest reads the records of a manifest file. Records that cannot
+// be read, that have no object ID, or whose object ID is already in the
+// manifest are skipped and reported as warnings, unless
+// DuplicateObjectIDPolicy makes duplicates an error.
+func parseManifest(manifestFilePath string, gen3FuseConfig *Gen3FuseConfig) (manifestJSON []ManifestRecord, report *ManifestReport, err error) {
+	columns, err := manifestColumns(gen3FuseConfig.ManifestColumns)
+	if err != nil {
+		return nil, nil, err
+	}
+	policy := duplicateObjectIDPolicy(gen3FuseConfig)
+	if !validDuplicateObjectIDPolicy(policy) {
+		return nil, nil, fmt.Errorf("Invalid DuplicateObjectIDPolicy %q, expected one of dedupe or error", policy)
+	}
+	file, err := os.Open(manifestFilePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	// Peek fails on files shorter than this, and returns what there is
+	start, _ := r.Peek(4096)
+
+	reader := &manifestReader{}
+	report = &ManifestReport{Format: detectManifestFormat(manifestFilePath, start)}
+	switch report.Format {
+	case ManifestFormatPFB:
+		var records []ManifestRecord
+		if records, err = parsePFB(r); err == nil {
+			for _, record := range records {
+				reader.add(record, 0)
+			}
+		}
+	case ManifestFormatNDJSON:
+		err = reader.readNDJSON(r, columns)
+	case ManifestFormatTSV:
+		err = reader.readTable(r, '\t', columns)
+	case ManifestFormatCSV:
+		err = reader.readTable(r, ',', columns)
+	default:
+		var b []byte
+		if b, err = ioutil.ReadAll(r); err == nil {
+			err = reader.readJSON(b)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifestJSON, err = reader.check(policy)
+	if err != nil {
+		return nil, nil, err
+	}
+	report.Records = len(reader.records)
+	report.ObjectIDs = len(manifestJSON)
+	report.Warnings = reader.warnings
+	return manifestJSON, report, nil
+}
+
+// check skips the records without object ID, and the records whose object
+// ID is already in the manifest
+func (reader *manifestReader) check(policy string) (manifestJSON []ManifestRecord, err error) {
+	manifestJSON = make([]ManifestRecord, 0, len(reader.records))
+	first := make(map[string]int)
+	var duplicates []string
+	for i, record := range reader.records {
+		if record.ObjectId == "" {
+			reader.warn("%v: no object ID, skipping the record", reader.where(i))
+			continue
+		}
+		if j, ok := first[record.ObjectId]; ok {
+			duplicate := fmt.Sprintf("%v: the object ID %v is already at %v", reader.where(i), record.ObjectId, reader.where(j))
+			if policy == DuplicateObjectIDPolicyError {
+				duplicates = append(duplicates, duplicate)
+			} else {
+				reader.warn("%v, skipping the record", duplicate)
+			}
+			continue
+		}
+		first[record.ObjectId] = i
+		manifestJSON = append(manifestJSON, record)
+	}
+
+	if len(duplicates) > 0 {
+		return nil, fmt.Errorf("duplicate object IDs:\n%v", strings.Join(duplicates, "\n"))
+	}
+	return manifestJSON, nil
+}
+
+// position finds the line and column of an offset in b, counting from 1
+func position(b []byte, offset int64) (line int, column int) {
+	if offset > int64(len(b)) {
+		offset = int64(len(b))
+	}
+	before := b[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	column = len(before) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// jsonErrorOffset returns where in the input a JSON error is, if it tells.
+// Errors are found once the byte at fault has been read.
+func jsonErrorOffset(err error) (int64, bool) {
+	var offset int64
+	switch err := err.(type) {
+	case *json.SyntaxError:
+		offset = err.Offset
+	case *json.UnmarshalTypeError:
+		offset = err.Offset
+	default:
+		return 0, false
+	}
+	if offset > 0 {
+		offset--
+	}
+	return offset, true
+}
+
+// jsonError points at where a JSON error is. offset is where the JSON that
+// was decoded starts in b.
+func jsonError(b []byte, offset int64, err error) error {
+	if errOffset, ok := jsonErrorOffset(err); ok {
+		offset += errOffset
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		offset = int64(len(b))
+		err = errors.New("unexpected end of JSON input")
+	}
+	line, column := position(b, offset)
+	return fmt.Errorf("line %v, column %v: %v", line, column, err)
+}
+
+// replacePythonNone turns the None that Python writes for missing values
+// into null, where it stands for a value and not inside strings. Both are 4
+// bytes long, so that errors still point at the right place.
+func replacePythonNone(b []byte) []byte {
+	isWord := func(c byte) bool {
+		return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+	}
+	replaced := append([]byte{}, b...)
+	inString := false
+	for i := 0; i < len(replaced); i++ {
+		switch {
+		case inString && replaced[i] == '\\':
+			i++
+		case replaced[i] == '"':
+			inString = !inString
+		case !inString && bytes.HasPrefix(replaced[i:], []byte("None")) &&
+			(i == 0 || !isWord(replaced[i-1])) && (i+4 == len(replaced) || !isWord(replaced[i+4])):
+			copy(replaced[i:], "null")
+			i += 3
+		}
+	}
+	return replaced
+}
+
+// readJSON reads a JSON list of records. Records that are not objects with
+// string fields are skipped.
+func (reader *manifestReader) readJSON(b []byte) error {
+	b = replacePythonNone(b)
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	if token, err := decoder.Token(); err != nil {
+		return jsonError(b, decoder.InputOffset(), err)
+	} else if token != json.Delim('[') {
+		return jsonError(b, 0, errors.New("expected a list of records"))
+	}
+	for decoder.More() {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return jsonError(b, 0, err)
+		}
+		// Where the record starts, past the comma before it
+		start := decoder.InputOffset() - int64(len(raw))
+		line, _ := position(b, start)
+
+		var record ManifestRecord
+		if err := json.Unmarshal(raw, &record); err != nil {
+			reader.warn("%v, skipping the record", jsonError(b, start, err))
+			continue
+		}
+		reader.add(record, line)
+	}
+	if _, err := decoder.Token(); err != nil {
+		return jsonError(b, decoder.InputOffset(), err)
+	}
+	end := decoder.InputOffset()
+	if _, err := decoder.Token(); err != io.EOF {
+		rest := b[end:]
+		end += int64(len(rest) - len(bytes.TrimLeft(rest, " \t\r\n")))
+		return jsonError(b, end, errors.New("unexpected data after the list of records"))
+	}
+	return nil
+}
+
+// readNDJSON reads a record per line, skipping blank lines and the lines
+// that are not JSON objects
+func (reader *manifestReader) readNDJSON(r *bufio.Reader, columns map[string]string) error {
+	for line := 1; ; line++ {
+		b, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(bytes.TrimSpace(b)) > 0 {
+			b = replacePythonNone(bytes.TrimRight(b, "\r\n"))
+			var values map[string]interface{}
+			if jsonErr := unmarshalKeepingNumbers(b, &values); jsonErr != nil {
+				offset, _ := jsonErrorOffset(jsonErr)
+				_, column := position(b, offset)
+				reader.warn("line %v, column %v: %v, skipping the record", line, column, jsonErr)
+			} else {
+				var record ManifestRecord
+				for key, value := range values {
+					if field, ok := columns[normalizeColumn(key)]; ok && value != nil {
+						manifestFields[field](&record, strings.TrimSpace(fmt.Sprint(value)))
+					}
+				}
+				reader.add(record, line)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// unmarshalKeepingNumbers is json.Unmarshal, except that numbers are decoded
+// as the json.Number they are written as rather than as float64, which would
+// turn an object ID of 1000000 into "1e+06"
+func unmarshalKeepingNumbers(b []byte, v interface{}) error {
+	if !json.Valid(b) {
+		// for the same error json.Unmarshal reports
+		return json.Unmarshal(b, v)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// readTable reads a record per row of a table whose first row names the
+// columns. Columns that map to no field are ignored.
+func (reader *manifestReader) readTable(r io.Reader, separator rune, columns map[string]string) error {
+	table := csv.NewReader(r)
+	table.Comma = separator
+	table.FieldsPerRecord = -1
+	table.LazyQuotes = true
+	// Leading tabs would be taken for empty fields otherwise
+	table.TrimLeadingSpace = separator != '\t'
+
+	header, err := table.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	fields := make([]string, len(header))
+	hasObjectId := false
+	for i, column := range header {
+		fields[i] = columns[normalizeColumn(column)]
+		hasObjectId = hasObjectId || fields[i] == "object_id"
+	}
+	if !hasObjectId {
+		return fmt.Errorf("no object ID column in %q, expected object_id, guid, did or a column mapped to object_id in ManifestColumns", header)
+	}
+
+	for {
+		row, err := table.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); !ok {
+				return err
+			}
+			reader.warn("%v, skipping the record", err)
+			continue
+		}
+		if len(row) == 1 && strings.TrimSpace(row[0]) == "" {
+			continue
+		}
+		var record ManifestRecord
+		for i, value := range row {
+			if i < len(fields) && fields[i] != "" {
+				manifestFields[fields[i]](&record, strings.TrimSpace(value))
+			}
+		}
+		line, _ := table.FieldPos(0)
+		reader.add(record, line)
+	}
+}
@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeManifestFile(t *testing.T, name string, manifest string) string {
+	manifestFilePath := filepath.Join(t.TempDir(), name)
+	assert.Nil(t, ioutil.WriteFile(manifestFilePath, []byte(manifest), 0644))
+	return manifestFilePath
+}
+
+func TestDetectManifestFormat(t *testing.T) {
+	for _, test := range []struct {
+		path    string
+		content string
+		format  string
+	}{
+		{"manifest.json", `[{"object_id": "dg.TEST/1"}]`, ManifestFormatJSON},
+		{"manifest.JSONL", `{"object_id": "dg.TEST/1"}`, ManifestFormatNDJSON},
+		{"manifest.tsv", "guid\n", ManifestFormatTSV},
+		{"export.csv", "guid\n", ManifestFormatCSV},
+		{"cohort.avro", "", ManifestFormatPFB},
+		// PFB files are recognized whatever their name
+		{"manifest.json", "Obj\x01", ManifestFormatPFB},
+		{"manifest", "\n  [{\"object_id\": \"dg.TEST/1\"}]", ManifestFormatJSON},
+		{"manifest", `{"object_id": "dg.TEST/1"}`, ManifestFormatNDJSON},
+		{"manifest", "guid\tfile_name\ndg.TEST/1\ta.bam\n", ManifestFormatTSV},
+		{"manifest", "\ufeffguid,file_name\ndg.TEST/1,a.bam\n", ManifestFormatCSV},
+	} {
+		assert.Equal(t, test.format, detectManifestFormat(test.path, []byte(test.content)), test.path+" "+test.content)
+	}
+}
+
+func TestParseTabularManifests(t *testing.T) {
+	expected := []ManifestRecord{
+		{ObjectId: "dg.TEST/1", FileName: "a.bam", SubjectId: "subject-1"},
+		{ObjectId: "dg.TEST/2", FileName: "b, c.bam", CommonsHostname: "other.example.org"},
+	}
+	columns := map[string]string{"Case ID": "subject_id"}
+
+	for name, manifest := range map[string]string{
+		"gen3-client.tsv": "guid\tfile_name\tsubject_id\tcommons_url\tfile_size\n" +
+			"dg.TEST/1\ta.bam\tsubject-1\t\t10\n" +
+			"dg.TEST/2\tb, c.bam\t\tother.example.org\t20\n",
+		"portal.csv": "\ufeffFile Name,Object ID,Case ID,Commons\n" +
+			"a.bam,dg.TEST/1,subject-1,\n" +
+			"\"b, c.bam\",dg.TEST/2,,other.example.org\n" +
+			"\n",
+		"dump.ndjson": `{"did": "dg.TEST/1", "filename": "a.bam", "case_id": "subject-1", "size": 10}` + "\n\n" +
+			`{"object_id": "dg.TEST/2", "file_name": "b, c.bam", "commons_url": "other.example.org", "subject_id": null}`,
+	} {
+		manifestJSON, report, err := parseManifest(writeManifestFile(t, name, manifest), &Gen3FuseConfig{ManifestColumns: columns})
+		assert.Nil(t, err, name)
+		assert.Equal(t, expected, manifestJSON, name)
+		assert.Empty(t, report.Warnings, name)
+	}
+
+	// Lines that cannot be parsed are reported, and the others are kept
+	manifestJSON, report, err := parseManifest(writeManifestFile(t, "dump.ndjson", "{\"guid\": \"dg.TEST/1\"}\n{\"guid\": \n{\"guid\": \"dg.TEST/3\"}\n"), &Gen3FuseConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, []ManifestRecord{{ObjectId: "dg.TEST/1"}, {ObjectId: "dg.TEST/3"}}, manifestJSON)
+	assert.Equal(t, []string{"line 2, column 9: unexpected end of JSON input, skipping the record"}, report.Warnings)
+
+	// Numbers are kept as written, rather than in the notation of float64
+	manifestJSON, _, err = parseManifest(writeManifestFile(t, "dump.ndjson", `{"object_id": 1000000, "subject_id": 12345678901234567890}`), &Gen3FuseConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, []ManifestRecord{{ObjectId: "1000000", SubjectId: "12345678901234567890"}}, manifestJSON)
+
+	_, _, err = parseManifest(writeManifestFile(t, "manifest.csv", "file_name,size\na.bam,10\n"), &Gen3FuseConfig{})
+	assert.EqualError(t, err, `no object ID column in ["file_name" "size"], expected object_id, guid, did or a column mapped to object_id in ManifestColumns`)
+
+	_, _, err = parseManifest(writeManifestFile(t, "manifest.csv", "guid\n"), &Gen3FuseConfig{ManifestColumns: map[string]string{"Case ID": "case"}})
+	assert.EqualError(t, err, `Invalid ManifestColumns field "case" for the column "Case ID", expected one of commons_url, data_format, data_type, file_name, object_id, project_id, subject_id, submitter_id, uuid`)
+
+	manifestJSON, _, err = parseManifest(writeManifestFile(t, "manifest.tsv", ""), &Gen3FuseConfig{})
+	assert.Nil(t, err)
+	assert.Empty(t, manifestJSON)
+}
+
+func TestParseJSONManifest(t *testing.T) {
+	// None is only null where it stands for a value
+	manifestJSON, report, err := parseManifest(writeManifestFile(t, "manifest.json",
+		`[{"object_id": "dg.TEST/None", "subject_id": None, "file_name": "\"None\".bam", "data_type":None}]`), &Gen3FuseConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, []ManifestRecord{{ObjectId: "dg.TEST/None", FileName: `"None".bam`}}, manifestJSON)
+	assert.Equal(t, &ManifestReport{Format: ManifestFormatJSON, Records: 1, ObjectIDs: 1}, report)
+
+	for manifest, expected := range map[string]string{
+		"[\n  {\"object_id\": \"dg.TEST/1\"},\n  {\"object_id\": \"dg.TEST/2\" \"uuid\": \"2\"}\n]": "line 3, column 29: invalid character '\"' after object key:value pair",
+		`[{"object_id": "dg.TE`:                                     "line 1, column 22: unexpected end of JSON input",
+		`{"object_id": "dg.TEST/1"}`:                                "line 1, column 1: expected a list of records",
+		`[{"object_id": "dg.TEST/1"}] [{"object_id": "dg.TEST/2"}]`: "line 1, column 30: unexpected data after the list of records",
+		``: "line 1, column 1: unexpected end of JSON input",
+	} {
+		manifestJSON, _, err := parseManifest(writeManifestFile(t, "manifest.json", manifest), &Gen3FuseConfig{})
+		assert.EqualError(t, err, expected, manifest)
+		assert.Nil(t, manifestJSON)
+	}
+
+	// Records without object ID, with fields of the wrong type and with
+	// object IDs already in the manifest are skipped
+	manifest := writeManifestFile(t, "manifest.json", `[
+		{"object_id": "dg.TEST/1"},
+		{"object_id": ""},
+		{"object_id": 2},
+		{"object_id": "dg.TEST/1", "subject_id": "subject-1"},
+		{"object_id": "dg.TEST/3"}
+	]`)
+	manifestJSON, report, err = parseManifest(manifest, &Gen3FuseConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, []ManifestRecord{{ObjectId: "dg.TEST/1"}, {ObjectId: "dg.TEST/3"}}, manifestJSON)
+	assert.Equal(t, &ManifestReport{Format: ManifestFormatJSON, Records: 4, ObjectIDs: 2, Warnings: []string{
+		"line 4, column 17: json: cannot unmarshal number into Go struct field ManifestRecord.object_id of type string, skipping the record",
+		"line 3: no object ID, skipping the record",
+		"line 5: the object ID dg.TEST/1 is already at line 2, skipping the record",
+	}}, report)
+
+	_, _, err = parseManifest(manifest, &Gen3FuseConfig{DuplicateObjectIDPolicy: DuplicateObjectIDPolicyError})
+	assert.EqualError(t, err, "duplicate object IDs:\nline 5: the object ID dg.TEST/1 is already at line 2")
+	_, _, err = parseManifest(manifest, &Gen3FuseConfig{DuplicateObjectIDPolicy: "reject"})
+	assert.EqualError(t, err, `Invalid DuplicateObjectIDPolicy "reject", expected one of dedupe or error`)
+
+	// Tables point at lines, and PFB files at records
+	_, report, err = parseManifest(writeManifestFile(t, "manifest.tsv", "guid\tsubject_id\ndg.TEST/1\ts1\n\ndg.TEST/1\ts2\n"), &Gen3FuseConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"line 4: the object ID dg.TEST/1 is already at line 2, skipping the record"}, report.Warnings)
+	pfb := encodeTestPFB(t, "null", [][]interface{}{testPFBFile("a", "dg.TEST/1"), testPFBFile("b", "dg.TEST/1")})
+	_, report, err = parseManifest(writeManifestFile(t, "cohort.avro", string(pfb)), &Gen3FuseConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"record 2: the object ID dg.TEST/1 is already at record 1, skipping the record"}, report.Warnings)
+}
+
+func TestMountTabularManifest(t *testing.T) {
+	commons := newFakeCommons(t, map[string][]byte{"dg.TEST/1": []byte("one")})
+	config := commons.config()
+	config.ManifestColumns = map[string]string{"Participant": "subject_id"}
+	m, err := NewMultiFuse(&Gen3FuseConfig{})
+	assert.Nil(t, err)
+	defer m.Destroy()
+
+	manifestFilePath := writeManifestFile(t, "manifest", "GUID,File Name,Participant\ndg.TEST/1,sample.bam,P1\n")
+	assert.Nil(t, m.AddManifest(context.Background(), "example.org", "table", config, manifestFilePath))
+
+	// Files are named by the manifest when Indexd does not name them
+	assert.Equal(t, []string{"sample.bam"}, readMultiDir(t, m, lookUpMultiPath(t, m, "example.org/table/by-filename")))
+	lookUpMultiPath(t, m, "example.org/table/by-subject/P1/sample.bam")
+}
@@ -0,0 +1,541 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// The inode and handle IDs of each manifest are those of its Gen3Fuse, moved
+// into a range of their own by setting the high bits to the manifest's
+// slot. Slot 0 holds the root and the domain directories.
+const (
+	manifestSlotShift = 40
+	manifestLocalMask = 1<<manifestSlotShift - 1
+)
+
+// logInodeID is the inode of the log file, when it is shown at the root. It
+// is the last of slot 0, out of the way of the domain directories.
+const logInodeID = fuseops.InodeID(manifestLocalMask)
+
+// MultiFuse mounts several manifests below one mount point, each in a
+// directory <domain>/<name> laid out like a single-manifest mount. Every
+// manifest is served by a Gen3Fuse of its own, with its own commons and
+// credentials, and they all share the block cache. Manifests can be added
+// and removed while mounted.
+type MultiFuse struct {
+	fuseutil.NotImplementedFileSystem
+
+	gen3FuseConfig *Gen3FuseConfig
+	blockCache     *BlockCache
+	mounted        time.Time
+
+	// Guards the fields below
+	mu       sync.RWMutex
+	mounts   map[uint64]*manifestMount
+	nextSlot uint64
+	// The inodes of the domain directories. They are kept once a domain has
+	// no manifests left, so that it gets the same inode if it comes back.
+	domains map[string]fuseops.InodeID
+	// The name the log file is shown under at the root, if it is shown
+	logName string
+}
+
+// manifestMount is a manifest mounted in a MultiFuse
+type manifestMount struct {
+	domain string
+	name   string
+	fs     *Gen3Fuse
+
+	// Set once the manifest is removed. It stays until the files open in
+	// it are closed.
+	removed bool
+}
+
+// NewMultiFuse returns a file system holding no manifests yet. The cache
+// settings of gen3FuseConfig apply to all manifests.
+func NewMultiFuse(gen3FuseConfig *Gen3FuseConfig) (m *MultiFuse, err error) {
+	LogFilePath = gen3FuseConfig.LogFilePath
+	m = &MultiFuse{
+		gen3FuseConfig: gen3FuseConfig,
+		mounted:        time.Now(),
+		mounts:         make(map[uint64]*manifestMount),
+		nextSlot:       1,
+		domains:        make(map[string]fuseops.InodeID),
+	}
+	if gen3FuseConfig.CacheDir != "" {
+		m.blockCache, err = NewBlockCache(gen3FuseConfig.CacheDir, gen3FuseConfig.CacheMaxBytes, gen3FuseConfig.CacheBlockSize)
+		if err != nil {
+			FuseLog(fmt.Sprintf("Error initializing the block cache at %v: %v", gen3FuseConfig.CacheDir, err))
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func globalID(slot uint64, local uint64) uint64 {
+	return slot<<manifestSlotShift | local
+}
+
+func splitID(id uint64) (slot uint64, local uint64) {
+	return id >> manifestSlotShift, id & manifestLocalMask
+}
+
+// findLocked returns the slot of the manifest mounted at domain/name
+func (m *MultiFuse) findLocked(domain string, name string) (slot uint64, ok bool) {
+	for slot, mount := range m.mounts {
+		if !mount.removed && mount.domain == domain && mount.name == name {
+			return slot, true
+		}
+	}
+	return 0, false
+}
+
+// AddManifest mounts the manifest at domain/name, reading it with
+// gen3FuseConfig, which gives its commons and credentials
+func (m *MultiFuse) AddManifest(ctx context.Context, domain string, name string, gen3FuseConfig *Gen3FuseConfig, manifestFilePath string) error {
+	for _, component := range []string{domain, name} {
+		if component == "" || sanitizeName(component) != component {
+			return fmt.Errorf("Invalid manifest directory %q", domain+"/"+name)
+		}
+	}
+	m.mu.RLock()
+	_, exists := m.findLocked(domain, name)
+	m.mu.RUnlock()
+	if exists {
+		return fmt.Errorf("A manifest is already mounted at %v/%v", domain, name)
+	}
+
+	// Looking the manifest up takes a while, so it is done without the lock
+	fs, err := newGen3Fuse(ctx, gen3FuseConfig, manifestFilePath, m.blockCache)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.findLocked(domain, name); exists {
+		fs.Destroy()
+		return fmt.Errorf("A manifest is already mounted at %v/%v", domain, name)
+	}
+	if _, ok := m.domains[domain]; !ok {
+		m.domains[domain] = fuseops.RootInodeID + fuseops.InodeID(len(m.domains)) + 1
+	}
+	m.mounts[m.nextSlot] = &manifestMount{domain: domain, name: name, fs: fs}
+	m.nextSlot++
+	FuseLog(fmt.Sprintf("Mounted the manifest %v at %v/%v", manifestFilePath, domain, name))
+	return nil
+}
+
+// RemoveManifest unmounts the manifest at domain/name. Its files disappear
+// right away, but those already open can be read until they are closed.
+func (m *MultiFuse) RemoveManifest(domain string, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	slot, ok := m.findLocked(domain, name)
+	if !ok {
+		return fmt.Errorf("No manifest is mounted at %v/%v", domain, name)
+	}
+	m.mounts[slot].removed = true
+	m.dropIfClosedLocked(slot)
+	FuseLog(fmt.Sprintf("Removed the manifest at %v/%v", domain, name))
+	return nil
+}
+
+// dropIfClosedLocked forgets a removed manifest once it has no open files
+func (m *MultiFuse) dropIfClosedLocked(slot uint64) {
+	mount, ok := m.mounts[slot]
+	if ok && mount.removed && mount.fs.handles.Len() == 0 {
+		mount.fs.Destroy()
+		delete(m.mounts, slot)
+	}
+}
+
+// Manifests lists the manifests mounted, as domain/name
+func (m *MultiFuse) Manifests() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var manifests []string
+	for _, mount := range m.mounts {
+		if !mount.removed {
+			manifests = append(manifests, mount.domain+"/"+mount.name)
+		}
+	}
+	sort.Strings(manifests)
+	return manifests
+}
+
+// ShowLog lists the log file at the root as name, so that users of the
+// mount can read it
+func (m *MultiFuse) ShowLog(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.logName = name
+}
+
+// showsLog tells whether inode is the log file shown at the root
+func (m *MultiFuse) showsLog(inode fuseops.InodeID) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return inode == logInodeID && m.logName != ""
+}
+
+// logAttributes returns the attributes of the log file as it is on disk
+func (m *MultiFuse) logAttributes() fuseops.InodeAttributes {
+	attributes := fuseops.InodeAttributes{
+		Nlink:  1,
+		Mode:   0444,
+		Atime:  m.mounted,
+		Mtime:  m.mounted,
+		Ctime:  m.mounted,
+		Crtime: m.mounted,
+	}
+	if info, err := os.Stat(LogFilePath); err == nil {
+		attributes.Size = uint64(info.Size())
+		attributes.Mtime = info.ModTime()
+		attributes.Ctime = info.ModTime()
+	}
+	return attributes
+}
+
+// manifest returns the Gen3Fuse serving an inode or handle ID, and the ID it
+// has there
+func (m *MultiFuse) manifest(id uint64) (fs *Gen3Fuse, slot uint64, local uint64, ok bool) {
+	slot, local = splitID(id)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	mount, ok := m.mounts[slot]
+	if !ok {
+		return nil, slot, local, false
+	}
+	return mount.fs, slot, local, true
+}
+
+// children lists the root or a domain directory. ok is false for inodes of
+// slot 0 that are neither.
+func (m *MultiFuse) children(inode fuseops.InodeID) (children []fuseutil.Dirent, ok bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var names []string
+	inodes := make(map[string]fuseops.InodeID)
+	for slot, mount := range m.mounts {
+		if mount.removed {
+			continue
+		}
+		if inode == fuseops.RootInodeID {
+			if _, listed := inodes[mount.domain]; !listed {
+				names = append(names, mount.domain)
+				inodes[mount.domain] = m.domains[mount.domain]
+			}
+		} else if m.domains[mount.domain] == inode {
+			names = append(names, mount.name)
+			inodes[mount.name] = fuseops.InodeID(globalID(slot, uint64(fuseops.RootInodeID)))
+		}
+	}
+	if inode == fuseops.RootInodeID && m.logName != "" {
+		names = append(names, m.logName)
+		inodes[m.logName] = logInodeID
+	}
+	if inode != fuseops.RootInodeID && len(names) == 0 {
+		for _, domainInode := range m.domains {
+			if domainInode == inode {
+				return []fuseutil.Dirent{}, true
+			}
+		}
+		return nil, false
+	}
+
+	sort.Strings(names)
+	children = make([]fuseutil.Dirent, len(names))
+	for i, name := range names {
+		children[i] = fuseutil.Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  inodes[name],
+			Name:   name,
+			Type:   fuseutil.DT_Directory,
+		}
+		if inodes[name] == logInodeID {
+			children[i].Type = fuseutil.DT_File
+		}
+	}
+	return children, true
+}
+
+func (m *MultiFuse) dirAttributes() fuseops.InodeAttributes {
+	return fuseops.InodeAttributes{
+		Nlink:  1,
+		Mode:   0555 | os.ModeDir,
+		Atime:  m.mounted,
+		Mtime:  m.mounted,
+		Ctime:  m.mounted,
+		Crtime: m.mounted,
+	}
+}
+
+func (m *MultiFuse) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) (err error) {
+	var totals inodeTotals
+	m.mu.RLock()
+	for _, mount := range m.mounts {
+		mount.fs.inodesMu.RLock()
+		totals.files += mount.fs.totals.files
+		totals.bytes += mount.fs.totals.bytes
+		totals.inodes += mount.fs.totals.inodes
+		mount.fs.inodesMu.RUnlock()
+	}
+	totals.inodes += len(m.domains) + 1
+	m.mu.RUnlock()
+
+	fillStatFS(op, totals)
+	return
+}
+
+func (m *MultiFuse) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	fs, slot, local, ok := m.manifest(uint64(op.Parent))
+	if slot == 0 {
+		children, ok := m.children(op.Parent)
+		if !ok {
+			return fuse.ENOENT
+		}
+		child, err := findChildInode(op.Name, children)
+		if err != nil {
+			return err
+		}
+		attributes := &fuseops.GetInodeAttributesOp{Inode: child}
+		if err := m.GetInodeAttributes(ctx, attributes); err != nil {
+			return err
+		}
+		op.Entry.Child = child
+		op.Entry.Attributes = attributes.Attributes
+		return nil
+	}
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	parent := op.Parent
+	op.Parent = fuseops.InodeID(local)
+	err = fs.LookUpInode(ctx, op)
+	op.Parent = parent
+	op.Entry.Child = fuseops.InodeID(globalID(slot, uint64(op.Entry.Child)))
+	return
+}
+
+func (m *MultiFuse) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	fs, slot, local, ok := m.manifest(uint64(op.Inode))
+	if m.showsLog(op.Inode) {
+		op.Attributes = m.logAttributes()
+		return
+	}
+	if slot == 0 {
+		if _, ok := m.children(op.Inode); !ok {
+			return fuse.ENOENT
+		}
+		op.Attributes = m.dirAttributes()
+		return
+	}
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	inode := op.Inode
+	op.Inode = fuseops.InodeID(local)
+	err = fs.GetInodeAttributes(ctx, op)
+	op.Inode = inode
+	return
+}
+
+func (m *MultiFuse) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) (err error) {
+	// Allow opening any directory.
+	return
+}
+
+func (m *MultiFuse) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) (err error) {
+	fs, slot, local, ok := m.manifest(uint64(op.Inode))
+	if slot == 0 {
+		children, ok := m.children(op.Inode)
+		if !ok {
+			return fuse.ENOENT
+		}
+		return writeDirents(op, children)
+	}
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	info, ok := fs.getInode(fuseops.InodeID(local))
+	if !ok {
+		return fuse.ENOENT
+	}
+	if !info.dir {
+		return fuse.EIO
+	}
+	children := make([]fuseutil.Dirent, len(info.Children))
+	for i, child := range info.Children {
+		child.Inode = fuseops.InodeID(globalID(slot, uint64(child.Inode)))
+		children[i] = child
+	}
+	return writeDirents(op, children)
+}
+
+func (m *MultiFuse) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) (err error) {
+	fs, slot, local, ok := m.manifest(uint64(op.Inode))
+	if slot == 0 {
+		return fuse.EINVAL
+	}
+	if !ok {
+		return fuse.ENOENT
+	}
+	inode := op.Inode
+	op.Inode = fuseops.InodeID(local)
+	err = fs.ReadSymlink(ctx, op)
+	op.Inode = inode
+	return
+}
+
+func (m *MultiFuse) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	if m.showsLog(op.Inode) {
+		// The log grows while it is open, so it is always read from disk.
+		// Its handle is 0, which no manifest uses.
+		op.Handle = 0
+		op.UseDirectIO = true
+		return
+	}
+	fs, slot, local, ok := m.manifest(uint64(op.Inode))
+	if !ok {
+		return fuse.ENOENT
+	}
+	inode := op.Inode
+	op.Inode = fuseops.InodeID(local)
+	err = fs.OpenFile(ctx, op)
+	op.Inode = inode
+	op.Handle = fuseops.HandleID(globalID(slot, uint64(op.Handle)))
+	return
+}
+
+func (m *MultiFuse) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	if op.Handle == 0 {
+		return m.readLog(op)
+	}
+	fs, _, local, ok := m.manifest(uint64(op.Handle))
+	if !ok {
+		return syscall.EBADF
+	}
+	inode, handle := op.Inode, op.Handle
+	_, inodeLocal := splitID(uint64(op.Inode))
+	op.Inode, op.Handle = fuseops.InodeID(inodeLocal), fuseops.HandleID(local)
+	err = fs.ReadFile(ctx, op)
+	op.Inode, op.Handle = inode, handle
+	return
+}
+
+func (m *MultiFuse) readLog(op *fuseops.ReadFileOp) error {
+	file, err := os.Open(LogFilePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fuse.EIO
+	}
+	defer file.Close()
+	op.BytesRead, err = file.ReadAt(op.Dst, op.Offset)
+	if err != nil && err != io.EOF {
+		return fuse.EIO
+	}
+	return nil
+}
+
+func (m *MultiFuse) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) (err error) {
+	// The file system is read-only, so there is never anything to flush.
+	return
+}
+
+func (m *MultiFuse) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) (err error) {
+	if op.Handle == 0 {
+		return
+	}
+	fs, slot, local, ok := m.manifest(uint64(op.Handle))
+	if !ok {
+		return syscall.EBADF
+	}
+	fs.releaseHandle(fuseops.HandleID(local))
+
+	m.mu.Lock()
+	m.dropIfClosedLocked(slot)
+	m.mu.Unlock()
+	return
+}
+
+func (m *MultiFuse) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) (err error) {
+	fs, slot, local, ok := m.manifest(uint64(op.Inode))
+	if slot == 0 {
+		return fuse.ENOATTR
+	}
+	if !ok {
+		return fuse.ENOENT
+	}
+	inode := op.Inode
+	op.Inode = fuseops.InodeID(local)
+	err = fs.GetXattr(ctx, op)
+	op.Inode = inode
+	return
+}
+
+func (m *MultiFuse) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) (err error) {
+	fs, slot, local, ok := m.manifest(uint64(op.Inode))
+	if slot == 0 {
+		// The root and domain directories have no attributes
+		op.BytesRead, err = writeXattr(op.Dst, nil)
+		return
+	}
+	if !ok {
+		return fuse.ENOENT
+	}
+	inode := op.Inode
+	op.Inode = fuseops.InodeID(local)
+	err = fs.ListXattr(ctx, op)
+	op.Inode = inode
+	return
+}
+
+func (m *MultiFuse) Destroy() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for slot, mount := range m.mounts {
+		mount.fs.Destroy()
+		delete(m.mounts, slot)
+	}
+}
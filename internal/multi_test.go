@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"context"
+	"encoding/binary"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+)
+
+func lookUpMultiPath(t *testing.T, m *MultiFuse, path string) fuseops.InodeID {
+	inode := fuseops.InodeID(fuseops.RootInodeID)
+	for _, name := range strings.Split(path, "/") {
+		op := &fuseops.LookUpInodeOp{Parent: inode, Name: name}
+		assert.Nil(t, m.LookUpInode(context.Background(), op), path)
+		assert.NotZero(t, op.Entry.Attributes.Mode, path)
+		inode = op.Entry.Child
+	}
+	return inode
+}
+
+// readMultiDir lists a directory from the dirents ReadDir writes, which
+// start with the inode, offset, name length and type, and are padded to 8
+// bytes
+func readMultiDir(t *testing.T, m *MultiFuse, inode fuseops.InodeID) []string {
+	op := &fuseops.ReadDirOp{Inode: inode, Dst: make([]byte, 4096)}
+	assert.Nil(t, m.ReadDir(context.Background(), op))
+	var names []string
+	for dirents := op.Dst[:op.BytesRead]; len(dirents) > 0; {
+		length := int(binary.LittleEndian.Uint32(dirents[16:]))
+		names = append(names, string(dirents[24:24+length]))
+		dirents = dirents[(24+length+7)/8*8:]
+	}
+	return names
+}
+
+func TestMultiFuse(t *testing.T) {
+	one := newFakeCommons(t, map[string][]byte{"dg.ONE/1": []byte("first commons")})
+	two := newFakeCommons(t, map[string][]byte{"dg.TWO/1": []byte("second commons")})
+	m, err := NewMultiFuse(&Gen3FuseConfig{})
+	assert.Nil(t, err)
+	defer m.Destroy()
+
+	ctx := context.Background()
+	assert.Nil(t, m.AddManifest(ctx, "one.example.org", "manifest-a", one.config(), writeManifestFile(t, "manifest.json", `[{"object_id": "dg.ONE/1"}]`)))
+	assert.Nil(t, m.AddManifest(ctx, "two.example.org", "manifest-b", two.config(), writeManifestFile(t, "manifest.json", `[{"object_id": "dg.TWO/1"}]`)))
+	assert.NotNil(t, m.AddManifest(ctx, "two.example.org", "manifest-b", two.config(), writeManifestFile(t, "manifest.json", `[]`)))
+	assert.NotNil(t, m.AddManifest(ctx, "two.example.org", "..", two.config(), writeManifestFile(t, "manifest.json", `[]`)))
+	assert.Equal(t, []string{"one.example.org/manifest-a", "two.example.org/manifest-b"}, m.Manifests())
+
+	assert.Equal(t, []string{"one.example.org", "two.example.org"}, readMultiDir(t, m, fuseops.RootInodeID))
+	assert.Equal(t, []string{"manifest-a"}, readMultiDir(t, m, lookUpMultiPath(t, m, "one.example.org")))
+	assert.Equal(t, []string{"by-guid", "by-filename", "by-filepath", "by-subject", ".gen3fuse"},
+		readMultiDir(t, m, lookUpMultiPath(t, m, "one.example.org/manifest-a")))
+
+	// Each manifest reads from its own commons
+	for path, content := range map[string]string{
+		"one.example.org/manifest-a/by-guid/dg.ONE/1": "first commons",
+		"two.example.org/manifest-b/by-guid/dg.TWO/1": "second commons",
+	} {
+		inode := lookUpMultiPath(t, m, path)
+		attributes := &fuseops.GetInodeAttributesOp{Inode: inode}
+		assert.Nil(t, m.GetInodeAttributes(ctx, attributes))
+		assert.Equal(t, uint64(len(content)), attributes.Attributes.Size)
+
+		open := &fuseops.OpenFileOp{Inode: inode}
+		assert.Nil(t, m.OpenFile(ctx, open))
+		read := &fuseops.ReadFileOp{Inode: inode, Handle: open.Handle, Dst: make([]byte, 64)}
+		assert.Nil(t, m.ReadFile(ctx, read))
+		assert.Equal(t, content, string(read.Dst[:read.BytesRead]))
+		assert.Nil(t, m.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: open.Handle}))
+	}
+	assert.NotEqual(t, lookUpMultiPath(t, m, "one.example.org/manifest-a/by-guid"), lookUpMultiPath(t, m, "two.example.org/manifest-b/by-guid"))
+
+	statfs := &fuseops.StatFSOp{}
+	assert.Nil(t, m.StatFS(ctx, statfs))
+	assert.Equal(t, uint64(1), statfs.Blocks)
+}
+
+func TestMultiFuseRemoveManifest(t *testing.T) {
+	commons := newFakeCommons(t, map[string][]byte{"dg.ONE/1": []byte("content")})
+	m, err := NewMultiFuse(&Gen3FuseConfig{})
+	assert.Nil(t, err)
+	defer m.Destroy()
+
+	ctx := context.Background()
+	assert.Nil(t, m.AddManifest(ctx, "one.example.org", "manifest-a", commons.config(), writeManifestFile(t, "manifest.json", `[{"object_id": "dg.ONE/1"}]`)))
+	domain := lookUpMultiPath(t, m, "one.example.org")
+	inode := lookUpMultiPath(t, m, "one.example.org/manifest-a/by-guid/dg.ONE/1")
+	open := &fuseops.OpenFileOp{Inode: inode}
+	assert.Nil(t, m.OpenFile(ctx, open))
+
+	assert.Nil(t, m.RemoveManifest("one.example.org", "manifest-a"))
+	assert.NotNil(t, m.RemoveManifest("one.example.org", "manifest-a"))
+	assert.Empty(t, m.Manifests())
+	assert.Empty(t, readMultiDir(t, m, fuseops.RootInodeID))
+	assert.Empty(t, readMultiDir(t, m, domain))
+
+	// The open file can still be read until it is closed
+	read := &fuseops.ReadFileOp{Inode: inode, Handle: open.Handle, Dst: make([]byte, 64)}
+	assert.Nil(t, m.ReadFile(ctx, read))
+	assert.Equal(t, "content", string(read.Dst[:read.BytesRead]))
+	assert.Nil(t, m.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: open.Handle}))
+	assert.NotNil(t, m.GetInodeAttributes(ctx, &fuseops.GetInodeAttributesOp{Inode: inode}))
+
+	// Mounting it again brings the domain back with the same inode
+	assert.Nil(t, m.AddManifest(ctx, "one.example.org", "manifest-a", commons.config(), writeManifestFile(t, "manifest.json", `[{"object_id": "dg.ONE/1"}]`)))
+	assert.Equal(t, domain, lookUpMultiPath(t, m, "one.example.org"))
+}
+
+func TestMultiFuseShowLog(t *testing.T) {
+	logFilePath := LogFilePath
+	t.Cleanup(func() { LogFilePath = logFilePath })
+	m, err := NewMultiFuse(&Gen3FuseConfig{LogFilePath: filepath.Join(t.TempDir(), "sidecar.log")})
+	assert.Nil(t, err)
+	defer m.Destroy()
+
+	ctx := context.Background()
+	assert.Empty(t, readMultiDir(t, m, fuseops.RootInodeID))
+	m.ShowLog(SidecarLogName)
+	FuseLog("Mounted the manifest")
+	assert.Equal(t, []string{SidecarLogName}, readMultiDir(t, m, fuseops.RootInodeID))
+
+	inode := lookUpMultiPath(t, m, SidecarLogName)
+	open := &fuseops.OpenFileOp{Inode: inode}
+	assert.Nil(t, m.OpenFile(ctx, open))
+	FuseLog("Removed the manifest")
+
+	// What is logged while the file is open can be read too
+	attributes := &fuseops.GetInodeAttributesOp{Inode: inode}
+	assert.Nil(t, m.GetInodeAttributes(ctx, attributes))
+	expected := "Mounted the manifest\nRemoved the manifest\n"
+	assert.Equal(t, uint64(len(expected)), attributes.Attributes.Size)
+	read := &fuseops.ReadFileOp{Inode: inode, Handle: open.Handle, Offset: 8, Dst: make([]byte, 64)}
+	assert.Nil(t, m.ReadFile(ctx, read))
+	assert.Equal(t, expected[8:], string(read.Dst[:read.BytesRead]))
+	assert.Nil(t, m.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: open.Handle}))
+}
@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Filename collision policies, for files of the manifest that would get the
+// same path in by-filename or by-filepath. Whichever policy is used, the file
+// with the lowest DID keeps the name.
+const (
+	// The other files get the start of their GUID added before the extension,
+	// sample_1a2b3c4d.bam
+	FilenameCollisionSuffix = "suffix"
+	// The other files go in a directory named after the start of their GUID,
+	// 1a2b3c4d/sample.bam
+	FilenameCollisionNest = "nest"
+	// The manifest is refused
+	FilenameCollisionError = "error"
+
+	DefaultFilenameCollisionPolicy = FilenameCollisionSuffix
+
+	// Longest name, in bytes, that Linux file systems accept
+	maxNameLength = 255
+	// Number of characters of the GUID used to tell files apart
+	shortGUIDLength = 8
+)
+
+// RenamedEntry records a file that does not appear under the name the
+// manifest gives it
+type RenamedEntry struct {
+	DID    string
+	From   string
+	To     string
+	Reason string
+}
+
+func (entry RenamedEntry) String() string {
+	return fmt.Sprintf("%v (%v) is %v: %v", entry.From, entry.DID, entry.To, entry.Reason)
+}
+
+func validFilenameCollisionPolicy(policy string) bool {
+	switch policy {
+	case FilenameCollisionSuffix, FilenameCollisionNest, FilenameCollisionError:
+		return true
+	}
+	return false
+}
+
+func filenameCollisionPolicy(gen3FuseConfig *Gen3FuseConfig) string {
+	if gen3FuseConfig.FilenameCollisionPolicy == "" {
+		return DefaultFilenameCollisionPolicy
+	}
+	return gen3FuseConfig.FilenameCollisionPolicy
+}
+
+// sanitizeName turns a name from the manifest or a URL into one the kernel
+// accepts as a path component
+func sanitizeName(name string) string {
+	name = strings.NewReplacer("/", "_", "\x00", "_").Replace(name)
+	if name == "." || name == ".." {
+		name = strings.Repeat("_", len(name))
+	}
+	return truncateName(name, "")
+}
+
+// truncateName shortens stem so that stem+ext fits in maxNameLength bytes,
+// without cutting a character in two
+func truncateName(stem string, ext string) string {
+	if len(stem)+len(ext) <= maxNameLength {
+		return stem + ext
+	}
+	if len(ext) > maxNameLength/2 {
+		stem, ext = stem+ext, ""
+	}
+	cut := maxNameLength - len(ext)
+	for cut > 0 && !utf8.RuneStart(stem[cut]) {
+		cut--
+	}
+	return stem[:cut] + ext
+}
+
+// splitExtension splits a name before its first dot, so that sample.vcf.gz
+// keeps .vcf.gz. The dot of hidden files does not count.
+func splitExtension(name string) (stem string, ext string) {
+	if len(name) < 2 {
+		return name, ""
+	}
+	if i := strings.Index(name[1:], "."); i >= 0 {
+		return name[:i+1], name[i+1:]
+	}
+	return name, ""
+}
+
+// guidTags returns the names used, in order, to tell a DID's file apart from
+// others with the same name: the start of its GUID, then the whole DID
+func guidTags(did string) []string {
+	guid := did[strings.LastIndex(did, "/")+1:]
+	guid = strings.ReplaceAll(guid, "-", "")
+	if len(guid) > shortGUIDLength {
+		guid = guid[:shortGUIDLength]
+	}
+	return []string{sanitizeName(guid), sanitizeName(did)}
+}
+
+// resolveNames gives each DID a unique path below the directory view from the
+// path it asks for, sanitizing every component and settling collisions with
+// policy. A file asking for the path of a directory collides with it too.
+// DIDs are taken in order, so the same manifest always gives the same paths.
+func resolveNames(view string, wanted map[string][]string, policy string) (map[string][]string, []RenamedEntry, error) {
+	dids := make([]string, 0, len(wanted))
+	for did := range wanted {
+		dids = append(dids, did)
+	}
+	sort.Strings(dids)
+
+	var renamed []RenamedEntry
+	paths := make(map[string][]string, len(wanted))
+	owners := make(map[string]string)
+	leaves := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, did := range dids {
+		var components []string
+		for _, component := range wanted[did] {
+			if component != "" {
+				components = append(components, sanitizeName(component))
+			}
+		}
+		original := strings.Join(wanted[did], "/")
+		if len(components) == 0 {
+			components = []string{sanitizeName(did)}
+		}
+		if joined := strings.Join(components, "/"); joined != original {
+			renamed = append(renamed, RenamedEntry{DID: did, From: view + "/" + original, To: view + "/" + joined, Reason: "the name is not a valid path"})
+		}
+		paths[did] = components
+
+		full := strings.Join(components, "/")
+		if _, ok := owners[full]; !ok {
+			owners[full] = did
+		}
+		leaves[full] = true
+		for i := 1; i < len(components); i++ {
+			dirs[strings.Join(components[:i], "/")] = true
+		}
+	}
+
+	var collisions []string
+	for _, did := range dids {
+		components := paths[did]
+		full := strings.Join(components, "/")
+		var reason string
+		if dirs[full] {
+			reason = "the name is taken by a directory"
+		} else if owner := owners[full]; owner != did {
+			reason = fmt.Sprintf("the name is taken by %v", owner)
+		} else {
+			continue
+		}
+		if policy == FilenameCollisionError {
+			collisions = append(collisions, fmt.Sprintf("%v/%v (%v): %v", view, full, did, reason))
+			continue
+		}
+
+		resolved := uniquePath(components, did, policy, leaves, dirs)
+		renamed = append(renamed, RenamedEntry{DID: did, From: view + "/" + full, To: view + "/" + strings.Join(resolved, "/"), Reason: reason})
+		paths[did] = resolved
+	}
+
+	if len(collisions) > 0 {
+		return nil, nil, fmt.Errorf("%v files in %v have the same name as another file or directory:\n%v", len(collisions), view, strings.Join(collisions, "\n"))
+	}
+	return paths, renamed, nil
+}
+
+// uniquePath finds a path for a DID whose own one is taken, and records it as
+// taken in turn
+func uniquePath(components []string, did string, policy string, leaves map[string]bool, dirs map[string]bool) []string {
+	parents := components[:len(components)-1]
+	name := components[len(components)-1]
+	tags := guidTags(did)
+	for i := 2; ; i++ {
+		for _, tag := range tags {
+			var candidate []string
+			if policy == FilenameCollisionNest {
+				candidate = append(append(append([]string{}, parents...), tag), name)
+			} else {
+				stem, ext := splitExtension(name)
+				candidate = append(append([]string{}, parents...), truncateName(stem+"_"+tag, ext))
+			}
+
+			full := strings.Join(candidate, "/")
+			if leaves[full] || dirs[full] {
+				continue
+			}
+			if policy == FilenameCollisionNest && leaves[strings.Join(candidate[:len(candidate)-1], "/")] {
+				continue
+			}
+			leaves[full] = true
+			for j := 1; j < len(candidate); j++ {
+				dirs[strings.Join(candidate[:j], "/")] = true
+			}
+			return candidate
+		}
+		tags = []string{fmt.Sprintf("%v_%v", sanitizeName(did), i)}
+	}
+}
@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeName(t *testing.T) {
+	assert.Equal(t, "sample.bam", sanitizeName("sample.bam"))
+	assert.Equal(t, "a_b.bam", sanitizeName("a/b.bam"))
+	assert.Equal(t, "a_b.bam", sanitizeName("a\x00b.bam"))
+	assert.Equal(t, "_", sanitizeName("."))
+	assert.Equal(t, "__", sanitizeName(".."))
+
+	long := sanitizeName(strings.Repeat("é", 200))
+	assert.LessOrEqual(t, len(long), maxNameLength)
+	assert.Equal(t, strings.Repeat("é", 127), long)
+
+	assert.Equal(t, maxNameLength, len(truncateName(strings.Repeat("a", 300), ".bam")))
+	assert.True(t, strings.HasSuffix(truncateName(strings.Repeat("a", 300), ".bam"), ".bam"))
+}
+
+func TestResolveNamesSuffix(t *testing.T) {
+	wanted := map[string][]string{
+		"dg.TEST/1a2b3c4d-0000": {"sample.vcf.gz"},
+		"dg.TEST/0a2b3c4d-0000": {"sample.vcf.gz"},
+		"dg.TEST/2a2b3c4d-0000": {"sample.vcf.gz"},
+		"dg.TEST/3a2b3c4d-0000": {"other.bam"},
+	}
+	for i := 0; i < 10; i++ {
+		paths, renamed, err := resolveNames("by-filename", wanted, FilenameCollisionSuffix)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"sample.vcf.gz"}, paths["dg.TEST/0a2b3c4d-0000"])
+		assert.Equal(t, []string{"sample_1a2b3c4d.vcf.gz"}, paths["dg.TEST/1a2b3c4d-0000"])
+		assert.Equal(t, []string{"sample_2a2b3c4d.vcf.gz"}, paths["dg.TEST/2a2b3c4d-0000"])
+		assert.Equal(t, []string{"other.bam"}, paths["dg.TEST/3a2b3c4d-0000"])
+		assert.Equal(t, []RenamedEntry{
+			{DID: "dg.TEST/1a2b3c4d-0000", From: "by-filename/sample.vcf.gz", To: "by-filename/sample_1a2b3c4d.vcf.gz", Reason: "the name is taken by dg.TEST/0a2b3c4d-0000"},
+			{DID: "dg.TEST/2a2b3c4d-0000", From: "by-filename/sample.vcf.gz", To: "by-filename/sample_2a2b3c4d.vcf.gz", Reason: "the name is taken by dg.TEST/0a2b3c4d-0000"},
+		}, renamed)
+	}
+}
+
+func TestResolveNamesFallsBackToTheWholeDID(t *testing.T) {
+	paths, _, err := resolveNames("by-filename", map[string][]string{
+		"dg.TEST/1a2b3c4d-0000": {"sample.bam"},
+		"dg.TEST/1a2b3c4d-1111": {"sample.bam"},
+		"dg.TEST/1a2b3c4d-2222": {"sample.bam"},
+	}, FilenameCollisionSuffix)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sample.bam"}, paths["dg.TEST/1a2b3c4d-0000"])
+	assert.Equal(t, []string{"sample_1a2b3c4d.bam"}, paths["dg.TEST/1a2b3c4d-1111"])
+	assert.Equal(t, []string{"sample_dg.TEST_1a2b3c4d-2222.bam"}, paths["dg.TEST/1a2b3c4d-2222"])
+}
+
+func TestResolveNamesNest(t *testing.T) {
+	paths, _, err := resolveNames("by-filepath", map[string][]string{
+		"dg.TEST/1": {"dir", "sample.bam"},
+		"dg.TEST/2": {"dir", "sample.bam"},
+		"dg.TEST/3": {"dir"},
+	}, FilenameCollisionNest)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"dir", "sample.bam"}, paths["dg.TEST/1"])
+	assert.Equal(t, []string{"dir", "2", "sample.bam"}, paths["dg.TEST/2"])
+	// A file cannot share its path with a directory
+	assert.Equal(t, []string{"3", "dir"}, paths["dg.TEST/3"])
+}
+
+func TestResolveNamesError(t *testing.T) {
+	_, _, err := resolveNames("by-filename", map[string][]string{
+		"dg.TEST/1": {"sample.bam"},
+		"dg.TEST/2": {"sample.bam"},
+	}, FilenameCollisionError)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "by-filename/sample.bam (dg.TEST/2): the name is taken by dg.TEST/1")
+}
+
+func TestResolveNamesSanitizes(t *testing.T) {
+	paths, renamed, err := resolveNames("by-filepath", map[string][]string{
+		"dg.TEST/1": {"dir", "", "..", "a\x00b.bam"},
+		"dg.TEST/2": {""},
+	}, FilenameCollisionSuffix)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"dir", "__", "a_b.bam"}, paths["dg.TEST/1"])
+	assert.Equal(t, []string{"dg.TEST_2"}, paths["dg.TEST/2"])
+	assert.Len(t, renamed, 2)
+}
+
+func TestInitializeInodesReachesEveryFile(t *testing.T) {
+	for _, secondaryViews := range []string{SecondaryViewsCopies, SecondaryViewsSymlinks, SecondaryViewsHardlinks} {
+		config := &Gen3FuseConfig{SecondaryViews: secondaryViews}
+		fs := newTestFs(config, 0, withFiles(map[string]*FileInfo{
+			"dg.TEST/1": &FileInfo{DID: "dg.TEST/1", Filename: "sample.bam", URLs: []string{"s3://one/dir/sample.bam"}},
+			"dg.TEST/2": &FileInfo{DID: "dg.TEST/2", Filename: "sample.bam", URLs: []string{"s3://two/dir/sample.bam"}},
+		}))
+
+		lookUpPath(t, fs, "by-filename/sample.bam")
+		lookUpPath(t, fs, "by-filename/sample_2.bam")
+		lookUpPath(t, fs, "by-filepath/dir/sample.bam")
+		lookUpPath(t, fs, "by-filepath/dir/sample_2.bam")
+	}
+
+	_, err := InitializeInodes(map[string]*FileInfo{
+		"dg.TEST/1": &FileInfo{DID: "dg.TEST/1", Filename: "sample.bam", URLs: []string{"s3://one/sample.bam"}},
+		"dg.TEST/2": &FileInfo{DID: "dg.TEST/2", Filename: "sample.bam", URLs: []string{"s3://two/other.bam"}},
+	}, &Gen3FuseConfig{FilenameCollisionPolicy: FilenameCollisionError})
+	assert.NotNil(t, err)
+}
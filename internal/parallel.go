@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+const (
+	DefaultDownloadConnections       = 4
+	DefaultDownloadChunkSize   int64 = 8 * 1024 * 1024
+)
+
+// FetchContentsAtURLParallel downloads a range of a file by splitting it into
+// chunks that are fetched concurrently over several connections, and returns
+// the chunks reassembled in order
+func FetchContentsAtURLParallel(presignedUrl string, offset int64, size int64, fullsize int64, connections int, chunkSize int64) (byteContents []byte, err error) {
+	return fetchContentsAtURLParallel(context.Background(), presignedUrl, offset, size, fullsize, connections, chunkSize)
+}
+
+// fetchContentsAtURLParallel is FetchContentsAtURLParallel, giving up when
+// ctx is done
+func fetchContentsAtURLParallel(ctx context.Context, presignedUrl string, offset int64, size int64, fullsize int64, connections int, chunkSize int64) (byteContents []byte, err error) {
+	if offset+size > fullsize {
+		size = fullsize - offset
+	}
+	if size <= 0 {
+		return []byte{}, nil
+	}
+	if connections < 1 {
+		connections = 1
+	}
+
+	byteContents = make([]byte, size)
+	chunks := make(chan int64)
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	failed := make(chan struct{})
+
+	for i := 0; i < connections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunkStart := range chunks {
+				length := chunkSize
+				if chunkStart+length > offset+size {
+					length = offset + size - chunkStart
+				}
+				data, chunkErr := fetchContentsAtURL(ctx, presignedUrl, chunkStart, length, fullsize)
+				if chunkErr == nil && int64(len(data)) < length {
+					chunkErr = fmt.Errorf("short read of chunk at offset %v: got %v of %v bytes", chunkStart, len(data), length)
+				}
+				if chunkErr != nil {
+					errOnce.Do(func() {
+						err = chunkErr
+						close(failed)
+					})
+					continue
+				}
+				copy(byteContents[chunkStart-offset:chunkStart-offset+length], data)
+			}
+		}()
+	}
+
+	// Hand out chunks in order, stopping at the first failure
+dispatch:
+	for chunkStart := offset; chunkStart < offset+size; chunkStart += chunkSize {
+		select {
+		case chunks <- chunkStart:
+		case <-failed:
+			break dispatch
+		}
+	}
+	close(chunks)
+	wg.Wait()
+
+	if err != nil {
+		return nil, err
+	}
+	return byteContents, nil
+}
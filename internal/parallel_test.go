@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchContentsAtURLParallel(t *testing.T) {
+	content := make([]byte, 10*1024*1024+17)
+	rand.Read(content)
+
+	var requests, inFlight, maxInFlight int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			seen := atomic.LoadInt32(&maxInFlight)
+			if current <= seen || atomic.CompareAndSwapInt32(&maxInFlight, seen, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	fullsize := int64(len(content))
+	data, err := FetchContentsAtURLParallel(server.URL, 1000, fullsize, fullsize, 4, 1024*1024)
+	assert.Nil(t, err)
+	assert.Equal(t, content[1000:], data)
+
+	// just under 10 MiB from offset 1000 spans 10 chunks
+	assert.Equal(t, int32(10), atomic.LoadInt32(&requests))
+	assert.Greater(t, atomic.LoadInt32(&maxInFlight), int32(1))
+	assert.LessOrEqual(t, atomic.LoadInt32(&maxInFlight), int32(4))
+}
+
+func TestFetchContentsAtURLParallelFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	_, err := FetchContentsAtURLParallel(server.URL, 0, 4096, 4096, 4, 1024)
+	apiErr, ok := err.(*APIError)
+	assert.True(t, ok)
+	assert.Equal(t, 403, apiErr.StatusCode)
+}
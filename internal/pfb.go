@@ -0,0 +1,466 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strings"
+)
+
+// PFB (Portable Format for Bioinformatics) files hold the graph of entities
+// a commons exports for a cohort, in an Avro object container file. Every
+// entity is a record with its node name, its id, its properties as object,
+// and relations to its parents. Entities with an object_id are files, and
+// their parents lead to the subject they belong to.
+
+// Avro object container files start with these bytes
+var avroMagic = []byte("Obj\x01")
+
+// maxAvroLength bounds the length of the bytes, strings and blocks of a file
+// being read from a stream, where there is no telling how much is left. The
+// lengths come from the file, so a corrupt one could ask for anything.
+const maxAvroLength = 1 << 30
+
+// Longer values are read a chunk at a time, so that a truncated file
+// ends the read before all of the length is allocated
+const avroReadChunk = 64 * 1024
+
+// Nodes whose entities are the subjects of the files below them
+var pfbSubjectNodes = map[string]bool{"subject": true, "case": true}
+
+// The entity of a PFB describing the others, not part of the graph
+const pfbMetadataNode = "Metadata"
+
+// avroType is a parsed Avro schema
+type avroType struct {
+	// A primitive type name, or record, enum, array, map, union or fixed
+	kind string
+
+	fields   []avroField // record
+	symbols  []string    // enum
+	items    *avroType   // array items and map values
+	branches []*avroType // union
+	size     int         // fixed
+}
+
+type avroField struct {
+	name string
+	typ  *avroType
+}
+
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true,
+	"float": true, "double": true, "bytes": true, "string": true,
+}
+
+// parseAvroSchema parses the JSON schema of a container file. Named types
+// can be referred to by full name or by name alone.
+func parseAvroSchema(schemaJSON []byte) (*avroType, error) {
+	var schema interface{}
+	if err := json.Unmarshal(schemaJSON, &schema); err != nil {
+		return nil, fmt.Errorf("invalid Avro schema: %v", err)
+	}
+	return parseAvroType(schema, "", make(map[string]*avroType))
+}
+
+func parseAvroType(schema interface{}, namespace string, named map[string]*avroType) (*avroType, error) {
+	switch schema := schema.(type) {
+	case string:
+		if avroPrimitives[schema] {
+			return &avroType{kind: schema}, nil
+		}
+		for _, name := range []string{schema, namespace + "." + schema} {
+			if typ, ok := named[name]; ok {
+				return typ, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown Avro type %q", schema)
+
+	case []interface{}:
+		union := &avroType{kind: "union"}
+		for _, branch := range schema {
+			typ, err := parseAvroType(branch, namespace, named)
+			if err != nil {
+				return nil, err
+			}
+			union.branches = append(union.branches, typ)
+		}
+		return union, nil
+
+	case map[string]interface{}:
+		kind, _ := schema["type"].(string)
+		typ := &avroType{kind: kind}
+		switch kind {
+		case "record", "error", "enum", "fixed":
+			typ.kind = strings.Replace(kind, "error", "record", 1)
+			name, _ := schema["name"].(string)
+			if ns, ok := schema["namespace"].(string); ok {
+				namespace = ns
+			}
+			if i := strings.LastIndex(name, "."); i >= 0 {
+				namespace = name[:i]
+			}
+			shortName := name[strings.LastIndex(name, ".")+1:]
+			named[shortName] = typ
+			named[namespace+"."+shortName] = typ
+		}
+
+		switch typ.kind {
+		case "record":
+			fields, _ := schema["fields"].([]interface{})
+			for _, field := range fields {
+				field, _ := field.(map[string]interface{})
+				name, _ := field["name"].(string)
+				fieldType, err := parseAvroType(field["type"], namespace, named)
+				if err != nil {
+					return nil, err
+				}
+				typ.fields = append(typ.fields, avroField{name: name, typ: fieldType})
+			}
+		case "enum":
+			symbols, _ := schema["symbols"].([]interface{})
+			for _, symbol := range symbols {
+				name, _ := symbol.(string)
+				typ.symbols = append(typ.symbols, name)
+			}
+		case "fixed":
+			size, _ := schema["size"].(float64)
+			typ.size = int(size)
+		case "array", "map":
+			key := "items"
+			if typ.kind == "map" {
+				key = "values"
+			}
+			items, err := parseAvroType(schema[key], namespace, named)
+			if err != nil {
+				return nil, err
+			}
+			typ.items = items
+		default:
+			// Primitive types can be written as {"type": "string"}, with
+			// attributes such as logicalType that change nothing here
+			return parseAvroType(schema["type"], namespace, named)
+		}
+		return typ, nil
+	}
+	return nil, fmt.Errorf("invalid Avro schema %v", schema)
+}
+
+// avroDecoder reads Avro binary encoded values
+type avroDecoder struct {
+	r io.ByteReader
+	// Where the values come from, to read bytes and strings from
+	data io.Reader
+	// The longest bytes or string there is room for
+	maxLength int64
+}
+
+func newAvroDecoder(r *bufio.Reader, maxLength int64) *avroDecoder {
+	return &avroDecoder{r: r, data: r, maxLength: maxLength}
+}
+
+func (d *avroDecoder) readLong() (int64, error) {
+	value, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return 0, err
+	}
+	// Zigzag encoding
+	return int64(value>>1) ^ -int64(value&1), nil
+}
+
+func (d *avroDecoder) readFixed(size int64) ([]byte, error) {
+	if size < 0 {
+		return nil, errors.New("negative length")
+	}
+	if size > d.maxLength {
+		return nil, fmt.Errorf("length %v is more than the %v bytes there is room for", size, d.maxLength)
+	}
+	if size <= avroReadChunk {
+		value := make([]byte, size)
+		_, err := io.ReadFull(d.data, value)
+		return value, err
+	}
+	var value bytes.Buffer
+	if _, err := io.CopyN(&value, d.data, size); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return value.Bytes(), nil
+}
+
+func (d *avroDecoder) readBytes() ([]byte, error) {
+	size, err := d.readLong()
+	if err != nil {
+		return nil, err
+	}
+	return d.readFixed(size)
+}
+
+// readBlockCount reads the item count of the next block of an array or map,
+// skipping the size in bytes that may follow it
+func (d *avroDecoder) readBlockCount() (int64, error) {
+	count, err := d.readLong()
+	if err != nil || count >= 0 {
+		return count, err
+	}
+	_, err = d.readLong()
+	return -count, err
+}
+
+// read decodes a value of typ. Records and maps become
+// map[string]interface{}, arrays []interface{}, enums and strings string,
+// ints and longs int64.
+func (d *avroDecoder) read(typ *avroType) (interface{}, error) {
+	switch typ.kind {
+	case "null":
+		return nil, nil
+	case "boolean":
+		b, err := d.r.ReadByte()
+		return b != 0, err
+	case "int", "long":
+		return d.readLong()
+	case "float":
+		bits, err := d.readFixed(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(bits))), nil
+	case "double":
+		bits, err := d.readFixed(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(bits)), nil
+	case "bytes":
+		return d.readBytes()
+	case "string":
+		value, err := d.readBytes()
+		return string(value), err
+	case "fixed":
+		return d.readFixed(int64(typ.size))
+	case "enum":
+		index, err := d.readLong()
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 || index >= int64(len(typ.symbols)) {
+			return nil, fmt.Errorf("enum index %v out of range", index)
+		}
+		return typ.symbols[index], nil
+	case "union":
+		index, err := d.readLong()
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 || index >= int64(len(typ.branches)) {
+			return nil, fmt.Errorf("union index %v out of range", index)
+		}
+		return d.read(typ.branches[index])
+	case "record":
+		record := make(map[string]interface{}, len(typ.fields))
+		for _, field := range typ.fields {
+			value, err := d.read(field.typ)
+			if err != nil {
+				return nil, err
+			}
+			record[field.name] = value
+		}
+		return record, nil
+	case "array":
+		var items []interface{}
+		for {
+			count, err := d.readBlockCount()
+			if err != nil || count == 0 {
+				return items, err
+			}
+			for ; count > 0; count-- {
+				item, err := d.read(typ.items)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, item)
+			}
+		}
+	case "map":
+		values := make(map[string]interface{})
+		for {
+			count, err := d.readBlockCount()
+			if err != nil || count == 0 {
+				return values, err
+			}
+			for ; count > 0; count-- {
+				key, err := d.readBytes()
+				if err != nil {
+					return nil, err
+				}
+				if values[string(key)], err = d.read(typ.items); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("unknown Avro type %q", typ.kind)
+}
+
+// readAvroContainer calls record with every value of an Avro object
+// container file, in order
+func readAvroContainer(r io.Reader, record func(value interface{}) error) error {
+	header := newAvroDecoder(bufio.NewReader(r), maxAvroLength)
+	magic, err := header.readFixed(int64(len(avroMagic)))
+	if err != nil || !bytes.Equal(magic, avroMagic) {
+		return errors.New("not an Avro object container file")
+	}
+	metadata, err := header.read(&avroType{kind: "map", items: &avroType{kind: "bytes"}})
+	if err != nil {
+		return fmt.Errorf("invalid Avro header: %v", err)
+	}
+	sync, err := header.readFixed(16)
+	if err != nil {
+		return fmt.Errorf("invalid Avro header: %v", err)
+	}
+
+	schemaJSON, _ := metadata.(map[string]interface{})["avro.schema"].([]byte)
+	schema, err := parseAvroSchema(schemaJSON)
+	if err != nil {
+		return err
+	}
+	codec := "null"
+	if name, ok := metadata.(map[string]interface{})["avro.codec"].([]byte); ok && len(name) > 0 {
+		codec = string(name)
+	}
+	if codec != "null" && codec != "deflate" {
+		return fmt.Errorf("unsupported Avro codec %q, expected null or deflate", codec)
+	}
+
+	for block := 0; ; block++ {
+		count, err := header.readLong()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Avro block %v: %v", block, err)
+		}
+		data, err := header.readBytes()
+		if err != nil {
+			return fmt.Errorf("Avro block %v: %v", block, err)
+		}
+		if codec == "deflate" {
+			if data, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(data))); err != nil {
+				return fmt.Errorf("Avro block %v: %v", block, err)
+			}
+		}
+
+		values := newAvroDecoder(bufio.NewReader(bytes.NewReader(data)), int64(len(data)))
+		for ; count > 0; count-- {
+			value, err := values.read(schema)
+			if err != nil {
+				return fmt.Errorf("Avro block %v: %v", block, err)
+			}
+			if err := record(value); err != nil {
+				return err
+			}
+		}
+
+		marker, err := header.readFixed(16)
+		if err != nil || !bytes.Equal(marker, sync) {
+			return fmt.Errorf("Avro block %v is not followed by the sync marker", block)
+		}
+	}
+}
+
+// pfbEntity is what is kept of an entity to link files to subjects
+type pfbEntity struct {
+	submitterID string
+	parents     []pfbEntityKey
+}
+
+type pfbEntityKey struct {
+	name string
+	id   string
+}
+
+func pfbString(values map[string]interface{}, key string) string {
+	value, _ := values[key].(string)
+	return value
+}
+
+// parsePFB reads the manifest of a PFB file: a record for every file
+// entity, with its subject found through its parents
+func parsePFB(r io.Reader) (manifestJSON []ManifestRecord, err error) {
+	entities := make(map[pfbEntityKey]*pfbEntity)
+	var files []pfbEntityKey
+	err = readAvroContainer(r, func(value interface{}) error {
+		entity, _ := value.(map[string]interface{})
+		key := pfbEntityKey{name: pfbString(entity, "name"), id: pfbString(entity, "id")}
+		if key.name == pfbMetadataNode {
+			return nil
+		}
+		object, _ := entity["object"].(map[string]interface{})
+		info := &pfbEntity{submitterID: pfbString(object, "submitter_id")}
+		relations, _ := entity["relations"].([]interface{})
+		for _, relation := range relations {
+			relation, _ := relation.(map[string]interface{})
+			info.parents = append(info.parents, pfbEntityKey{name: pfbString(relation, "dst_name"), id: pfbString(relation, "dst_id")})
+		}
+		entities[key] = info
+
+		if objectID := pfbString(object, "object_id"); objectID != "" {
+			files = append(files, key)
+			manifestJSON = append(manifestJSON, ManifestRecord{
+				ObjectId:    objectID,
+				Uuid:        key.id,
+				SubmitterId: info.submitterID,
+				FileName:    pfbString(object, "file_name"),
+				DataFormat:  pfbString(object, "data_format"),
+				DataType:    pfbString(object, "data_type"),
+				ProjectId:   pfbString(object, "project_id"),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, file := range files {
+		manifestJSON[i].SubjectId = pfbSubject(entities, file)
+	}
+	return manifestJSON, nil
+}
+
+// pfbSubject finds the closest subject above an entity, and returns its
+// submitter_id, or its id if it has none
+func pfbSubject(entities map[pfbEntityKey]*pfbEntity, start pfbEntityKey) string {
+	seen := map[pfbEntityKey]bool{start: true}
+	pending := []pfbEntityKey{start}
+	for len(pending) > 0 {
+		key := pending[0]
+		pending = pending[1:]
+		if pfbSubjectNodes[key.name] {
+			if entity, ok := entities[key]; ok && entity.submitterID != "" {
+				return entity.submitterID
+			}
+			return key.id
+		}
+		entity, ok := entities[key]
+		if !ok {
+			continue
+		}
+		for _, parent := range entity.parents {
+			if !seen[parent] {
+				seen[parent] = true
+				pending = append(pending, parent)
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The schema of a small PFB: subjects, samples of subjects, and files of
+// samples or subjects
+const testPFBSchema = `{
+	"type": "record", "name": "Entity", "namespace": "pfb",
+	"fields": [
+		{"name": "id", "type": ["null", "string"]},
+		{"name": "name", "type": "string"},
+		{"name": "object", "type": [
+			{"type": "record", "name": "Metadata", "fields": [
+				{"name": "misc", "type": {"type": "map", "values": "string"}}
+			]},
+			{"type": "record", "name": "subject", "fields": [
+				{"name": "submitter_id", "type": ["null", "string"]},
+				{"name": "age", "type": ["null", "int", "double"]}
+			]},
+			{"type": "record", "name": "submitted_aligned_reads", "fields": [
+				{"name": "submitter_id", "type": "string"},
+				{"name": "object_id", "type": ["null", "string"]},
+				{"name": "file_name", "type": ["null", "string"]},
+				{"name": "data_format", "type": ["null", {"type": "enum", "name": "data_format", "symbols": ["BAM", "CRAM"]}]},
+				{"name": "data_type", "type": "string"},
+				{"name": "project_id", "type": "string"},
+				{"name": "file_size", "type": "long"},
+				{"name": "md5sum", "type": {"type": "fixed", "name": "md5", "size": 4}},
+				{"name": "is_paired", "type": "boolean"}
+			]}
+		]},
+		{"name": "relations", "type": {"type": "array", "items": {
+			"type": "record", "name": "Relation", "fields": [
+				{"name": "dst_id", "type": "string"},
+				{"name": "dst_name", "type": "string"}
+			]
+		}}}
+	]
+}`
+
+// avroUnion is a value of the branch of a union
+type avroUnion struct {
+	branch int
+	value  interface{}
+}
+
+// encodeAvro is the counterpart of avroDecoder.read. Records are
+// []interface{} of their fields in order.
+func encodeAvro(buf *bytes.Buffer, typ *avroType, value interface{}) {
+	long := func(n int64) {
+		var b [binary.MaxVarintLen64]byte
+		buf.Write(b[:binary.PutVarint(b[:], n)])
+	}
+	switch typ.kind {
+	case "null":
+	case "boolean":
+		if value.(bool) {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case "int", "long":
+		long(int64(value.(int)))
+	case "double":
+		binary.Write(buf, binary.LittleEndian, value.(float64))
+	case "string":
+		long(int64(len(value.(string))))
+		buf.WriteString(value.(string))
+	case "fixed":
+		buf.Write(value.([]byte))
+	case "enum":
+		for i, symbol := range typ.symbols {
+			if symbol == value.(string) {
+				long(int64(i))
+			}
+		}
+	case "union":
+		union := value.(avroUnion)
+		long(int64(union.branch))
+		encodeAvro(buf, typ.branches[union.branch], union.value)
+	case "record":
+		for i, field := range typ.fields {
+			encodeAvro(buf, field.typ, value.([]interface{})[i])
+		}
+	case "array":
+		if items := value.([]interface{}); len(items) > 0 {
+			// A block with its size in bytes, as writers may add
+			var block bytes.Buffer
+			for _, item := range items {
+				encodeAvro(&block, typ.items, item)
+			}
+			long(-int64(len(items)))
+			long(int64(block.Len()))
+			buf.Write(block.Bytes())
+		}
+		long(0)
+	case "map":
+		values := value.(map[string]interface{})
+		if len(values) > 0 {
+			long(int64(len(values)))
+			for key, value := range values {
+				encodeAvro(buf, &avroType{kind: "string"}, key)
+				encodeAvro(buf, typ.items, value)
+			}
+		}
+		long(0)
+	}
+}
+
+// encodeTestPFB writes entities to an Avro container file, in blocks of two
+func encodeTestPFB(t *testing.T, codec string, entities [][]interface{}) []byte {
+	schema, err := parseAvroSchema([]byte(testPFBSchema))
+	assert.Nil(t, err)
+	sync := []byte("0123456789abcdef")
+
+	var file bytes.Buffer
+	file.Write(avroMagic)
+	encodeAvro(&file, &avroType{kind: "map", items: &avroType{kind: "string"}},
+		map[string]interface{}{"avro.schema": testPFBSchema, "avro.codec": codec})
+	file.Write(sync)
+	for len(entities) > 0 {
+		count := 2
+		if len(entities) < count {
+			count = len(entities)
+		}
+		var block bytes.Buffer
+		for _, entity := range entities[:count] {
+			encodeAvro(&block, schema, entity)
+		}
+		entities = entities[count:]
+
+		data := block.Bytes()
+		if codec == "deflate" {
+			var compressed bytes.Buffer
+			w, _ := flate.NewWriter(&compressed, flate.BestCompression)
+			w.Write(data)
+			w.Close()
+			data = compressed.Bytes()
+		}
+		encodeAvro(&file, &avroType{kind: "long"}, count)
+		encodeAvro(&file, &avroType{kind: "string"}, string(data))
+		file.Write(sync)
+	}
+	return file.Bytes()
+}
+
+func testPFBRelations(parents ...string) []interface{} {
+	relations := []interface{}{}
+	for i := 0; i < len(parents); i += 2 {
+		relations = append(relations, []interface{}{parents[i], parents[i+1]})
+	}
+	return relations
+}
+
+func testPFBFile(id string, objectID string, parents ...string) []interface{} {
+	return []interface{}{
+		avroUnion{1, id}, "submitted_aligned_reads",
+		avroUnion{2, []interface{}{
+			"reads-" + id, avroUnion{1, objectID}, avroUnion{1, id + ".bam"}, avroUnion{1, "BAM"}, "Aligned Reads", "P-Q", 10, []byte("abcd"), true,
+		}},
+		testPFBRelations(parents...),
+	}
+}
+
+// testPFB holds two subjects with a file each, one of them below a sample,
+// and a sample file without an object ID
+func testPFB(t *testing.T, codec string) []byte {
+	return encodeTestPFB(t, codec, [][]interface{}{
+		{avroUnion{0, nil}, "Metadata", avroUnion{0, []interface{}{map[string]interface{}{"version": "1"}}}, testPFBRelations()},
+		{avroUnion{1, "subject-uuid-1"}, "subject", avroUnion{1, []interface{}{avroUnion{1, "subject-1"}, avroUnion{1, 42}}}, testPFBRelations()},
+		{avroUnion{1, "subject-uuid-2"}, "subject", avroUnion{1, []interface{}{avroUnion{0, nil}, avroUnion{2, 42.5}}}, testPFBRelations()},
+		{avroUnion{1, "sample-uuid-1"}, "sample", avroUnion{1, []interface{}{avroUnion{1, "sample-1"}, avroUnion{0, nil}}}, testPFBRelations("subject-uuid-1", "subject")},
+		testPFBFile("file-uuid-1", "dg.TEST/1", "sample-uuid-1", "sample"),
+		testPFBFile("file-uuid-2", "dg.TEST/2", "subject-uuid-2", "subject"),
+		{avroUnion{1, "file-uuid-3"}, "submitted_aligned_reads", avroUnion{2, []interface{}{
+			"reads-3", avroUnion{0, nil}, avroUnion{1, "file-uuid-3.bam"}, avroUnion{0, nil}, "Aligned Reads", "P-Q", 0, []byte("abcd"), false,
+		}}, testPFBRelations("subject-uuid-1", "subject")},
+	})
+}
+
+func TestParsePFB(t *testing.T) {
+	for _, codec := range []string{"null", "deflate"} {
+		manifestJSON, err := parsePFB(bytes.NewReader(testPFB(t, codec)))
+		assert.Nil(t, err, codec)
+		assert.Equal(t, []ManifestRecord{
+			{ObjectId: "dg.TEST/1", FileName: "file-uuid-1.bam", SubjectId: "subject-1", Uuid: "file-uuid-1", SubmitterId: "reads-file-uuid-1", DataFormat: "BAM", DataType: "Aligned Reads", ProjectId: "P-Q"},
+			// A subject without submitter ID is named after its ID
+			{ObjectId: "dg.TEST/2", FileName: "file-uuid-2.bam", SubjectId: "subject-uuid-2", Uuid: "file-uuid-2", SubmitterId: "reads-file-uuid-2", DataFormat: "BAM", DataType: "Aligned Reads", ProjectId: "P-Q"},
+		}, manifestJSON, codec)
+	}
+
+	_, err := parsePFB(bytes.NewReader([]byte(`[{"object_id": "dg.TEST/1"}]`)))
+	assert.NotNil(t, err)
+	pfb := testPFB(t, "null")
+	_, err = parsePFB(bytes.NewReader(pfb[:len(pfb)-20]))
+	assert.NotNil(t, err)
+	_, err = parsePFB(bytes.NewReader(encodeTestPFB(t, "snappy", nil)))
+	assert.EqualError(t, err, `unsupported Avro codec "snappy", expected null or deflate`)
+
+	// Corrupt lengths are errors, whatever they ask for
+	long := func(buf *bytes.Buffer, n int64) {
+		var b [binary.MaxVarintLen64]byte
+		buf.Write(b[:binary.PutVarint(b[:], n)])
+	}
+	for _, length := range []int64{1 << 62, 512 << 20} {
+		var header bytes.Buffer
+		header.Write(avroMagic)
+		long(&header, 1)
+		encodeAvro(&header, &avroType{kind: "string"}, "avro.schema")
+		long(&header, length)
+		_, err = parsePFB(bytes.NewReader(header.Bytes()))
+		assert.NotNil(t, err, length)
+	}
+	var block bytes.Buffer
+	long(&block, 1)
+	long(&block, 1<<40)
+	file := bytes.NewBuffer(encodeTestPFB(t, "null", nil))
+	encodeAvro(file, &avroType{kind: "long"}, 1)
+	encodeAvro(file, &avroType{kind: "string"}, block.String())
+	file.WriteString("0123456789abcdef")
+	_, err = parsePFB(file)
+	assert.EqualError(t, err, "Avro block 0: length 1099511627776 is more than the 7 bytes there is room for")
+}
+
+func TestMountPFB(t *testing.T) {
+	commons := newFakeCommons(t, map[string][]byte{"dg.TEST/1": []byte("one"), "dg.TEST/2": []byte("two")})
+	m, err := NewMultiFuse(&Gen3FuseConfig{})
+	assert.Nil(t, err)
+	defer m.Destroy()
+
+	manifestFilePath := writeManifestFile(t, "cohort.avro", string(testPFB(t, "deflate")))
+	assert.Nil(t, m.AddManifest(context.Background(), "example.org", "cohort", commons.config(), manifestFilePath))
+
+	assert.ElementsMatch(t, []string{"subject-1", "subject-uuid-2"}, readMultiDir(t, m, lookUpMultiPath(t, m, "example.org/cohort/by-subject")))
+	lookUpMultiPath(t, m, "example.org/cohort/by-guid/dg.TEST/1")
+	// Files are named by the PFB when Indexd does not name them
+	lookUpMultiPath(t, m, "example.org/cohort/by-filename/file-uuid-1.bam")
+}
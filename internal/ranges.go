@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Servers that ignore the Range header send the whole object. Up to this many
+// bytes are discarded to reach the requested offset before giving up.
+const ignoredRangeSkipLimit int64 = 16 * 1024 * 1024
+
+// ErrShortBody is returned when a response ends before delivering the bytes
+// that were asked for, and the object is known to be longer than that
+var ErrShortBody = errors.New("response body ended before the requested range")
+
+// RangeError reports a response whose content does not match the requested range
+type RangeError struct {
+	URL    string
+	Offset int64
+	Reason string
+}
+
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("Invalid response for range starting at %v of %v: %v", e.Offset, stripQuery(e.URL), e.Reason)
+}
+
+// rangeResponseBody checks that resp answers a request for the bytes starting
+// at offset, and returns a reader positioned at offset along with the size of
+// the whole object, or -1 if the server did not report it
+func rangeResponseBody(resp *http.Response, presignedUrl string, offset int64) (body io.Reader, total int64, err error) {
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, _, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return nil, -1, &RangeError{presignedUrl, offset, err.Error()}
+		}
+		if start != offset {
+			return nil, -1, &RangeError{presignedUrl, offset, fmt.Sprintf("server sent bytes starting at %v", start)}
+		}
+		return resp.Body, total, nil
+
+	case http.StatusOK:
+		// The server ignored the Range header and is sending the whole object
+		total = resp.ContentLength
+		if offset > 0 {
+			if offset > ignoredRangeSkipLimit {
+				return nil, -1, &RangeError{presignedUrl, offset, "server does not support range requests"}
+			}
+			FuseLog(fmt.Sprintf("%v ignored the Range header, skipping %v bytes", stripQuery(presignedUrl), offset))
+			skipped, err := io.CopyN(ioutil.Discard, resp.Body, offset)
+			if err == io.EOF && skipped == total {
+				return resp.Body, total, nil
+			}
+			if err != nil {
+				return nil, -1, err
+			}
+		}
+		return resp.Body, total, nil
+	}
+
+	return nil, -1, &RangeError{presignedUrl, offset, fmt.Sprintf("unexpected status code %v", resp.StatusCode)}
+}
+
+// parseContentRange parses a Content-Range header of the form
+// "bytes first-last/total", where total may be "*"
+func parseContentRange(header string) (first int64, last int64, total int64, err error) {
+	total = -1
+	if !strings.HasPrefix(header, "bytes ") {
+		return 0, 0, -1, fmt.Errorf("malformed Content-Range %q", header)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(header, "bytes "), "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, -1, fmt.Errorf("malformed Content-Range %q", header)
+	}
+	bounds := strings.SplitN(parts[0], "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, -1, fmt.Errorf("malformed Content-Range %q", header)
+	}
+	first, err = strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return 0, 0, -1, fmt.Errorf("malformed Content-Range %q", header)
+	}
+	last, err = strconv.ParseInt(bounds[1], 10, 64)
+	if err != nil || last < first {
+		return 0, 0, -1, fmt.Errorf("malformed Content-Range %q", header)
+	}
+	if parts[1] != "*" {
+		total, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return 0, 0, -1, fmt.Errorf("malformed Content-Range %q", header)
+		}
+	}
+	return first, last, total, nil
+}
+
+// readRangeBody reads length bytes from a body positioned at offset. Running
+// out of data is only accepted at the end of the object.
+func readRangeBody(body io.Reader, offset int64, length int64, total int64) (byteContents []byte, err error) {
+	byteContents = make([]byte, length)
+	bytesRead, err := io.ReadFull(body, byteContents)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if total >= 0 && offset+int64(bytesRead) == total {
+			return byteContents[:bytesRead], nil
+		}
+		return nil, ErrShortBody
+	}
+	if err != nil {
+		return nil, err
+	}
+	return byteContents, nil
+}
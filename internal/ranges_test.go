@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+)
+
+// rangeServer serves content the way a storage backend might, optionally
+// misbehaving, and records the Range headers it receives
+type rangeServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	ranges []string
+}
+
+func newRangeServer(t *testing.T, content []byte, mode string) *rangeServer {
+	server := &rangeServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mu.Lock()
+		server.ranges = append(server.ranges, r.Header.Get("Range"))
+		server.mu.Unlock()
+
+		switch mode {
+		case "compliant":
+			http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(content))
+		case "ignores-range":
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(content)
+		case "wrong-start":
+			first, last := requestedRange(r, len(content))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first+1, last+1, len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content[first+1 : last+2])
+		case "truncated":
+			first, last := requestedRange(r, len(content))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(content)))
+			w.Header().Set("Content-Length", fmt.Sprint(last-first+1))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content[first : first+10])
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// requestedRange returns the bounds of the Range header of r, reading an
+// open-ended range as running to the end of the content
+func requestedRange(r *http.Request, size int) (first int64, last int64) {
+	last = int64(size) - 1
+	fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &first, &last)
+	return first, last
+}
+
+var rangeCases = []struct {
+	offset int64
+	size   int
+}{
+	{0, 1},
+	{0, 1000},
+	{0, 4096},
+	{1, 998},
+	{123, 456},
+	{500, 500},
+	{999, 1},
+	{999, 10},
+	{998, 2},
+	{1000, 10},
+	{1500, 10},
+	{10, 0},
+}
+
+func expectedRange(content []byte, offset int64, size int) []byte {
+	start := int(offset)
+	if start > len(content) {
+		start = len(content)
+	}
+	end := start + size
+	if end > len(content) {
+		end = len(content)
+	}
+	return content[start:end]
+}
+
+// readModes run each read with a one-off ranged request, or through ReadFile
+// over the stream of the open file handle
+var readModes = []string{"ranged", "stream"}
+
+func readAtInMode(t *testing.T, fs *Gen3Fuse, mode string, handle fuseops.HandleID, offset int64, size int) ([]byte, error) {
+	if mode == "ranged" {
+		openHandle, _ := fs.handles.Get(handle)
+		dst := make([]byte, size)
+		bytesRead, err := fs.readRange(context.Background(), openHandle, nil, dst, offset)
+		return dst[:bytesRead], err
+	}
+	op := &fuseops.ReadFileOp{Inode: testInode, Handle: handle, Offset: offset, Dst: make([]byte, size)}
+	err := fs.ReadFile(context.Background(), op)
+	return op.Dst[:op.BytesRead], err
+}
+
+func TestReadFileRangeEdgeCases(t *testing.T) {
+	content := make([]byte, 1000)
+	rand.Read(content)
+
+	for _, serverMode := range []string{"compliant", "ignores-range"} {
+		for _, mode := range readModes {
+			server := newRangeServer(t, content, serverMode)
+			fs := newTestFs(&Gen3FuseConfig{RetryInitialBackoff: time.Millisecond}, len(content))
+			handle := openTestFile(fs, server.URL)
+
+			for _, c := range rangeCases {
+				data, err := readAtInMode(t, fs, mode, handle, c.offset, c.size)
+				assert.Nil(t, err, "%v server, %v read at %v size %v", serverMode, mode, c.offset, c.size)
+				assert.Equal(t, expectedRange(content, c.offset, c.size), data, "%v server, %v read at %v size %v", serverMode, mode, c.offset, c.size)
+			}
+		}
+	}
+}
+
+func TestReadFileRequestsExactRanges(t *testing.T) {
+	content := make([]byte, 1000)
+	server := newRangeServer(t, content, "compliant")
+	fs := newTestFs(&Gen3FuseConfig{RetryInitialBackoff: time.Millisecond}, len(content))
+	handle := openTestFile(fs, server.URL)
+
+	for _, c := range rangeCases {
+		_, err := readAtInMode(t, fs, "ranged", handle, c.offset, c.size)
+		assert.Nil(t, err)
+	}
+
+	// reads at or past the end of the file, or of zero bytes, never hit the network
+	assert.Equal(t, []string{
+		"bytes=0-0",
+		"bytes=0-999",
+		"bytes=0-999",
+		"bytes=1-998",
+		"bytes=123-578",
+		"bytes=500-999",
+		"bytes=999-999",
+		"bytes=999-999",
+		"bytes=998-999",
+	}, server.ranges)
+}
+
+func TestReadFileRejectsMismatchedRanges(t *testing.T) {
+	content := make([]byte, 1000)
+	rand.Read(content)
+
+	for _, serverMode := range []string{"wrong-start", "truncated"} {
+		for _, mode := range readModes {
+			server := newRangeServer(t, content, serverMode)
+			fs := newTestFs(&Gen3FuseConfig{RetryInitialBackoff: time.Millisecond}, len(content))
+			handle := openTestFile(fs, server.URL)
+
+			_, err := readAtInMode(t, fs, mode, handle, 100, 200)
+			assert.NotNil(t, err, "%v server, %v read", serverMode, mode)
+		}
+	}
+}
+
+func TestReadFileObjectShorterThanIndexed(t *testing.T) {
+	// Indexd claims 1000 bytes but the object only holds 900
+	content := make([]byte, 900)
+	rand.Read(content)
+
+	for _, mode := range readModes {
+		server := newRangeServer(t, content, "compliant")
+		fs := newTestFs(&Gen3FuseConfig{RetryInitialBackoff: time.Millisecond}, 1000)
+		handle := openTestFile(fs, server.URL)
+
+		data, err := readAtInMode(t, fs, mode, handle, 850, 100)
+		assert.Nil(t, err)
+		assert.Equal(t, content[850:], data)
+
+		data, err = readAtInMode(t, fs, mode, handle, 950, 10)
+		assert.Nil(t, err)
+		assert.Empty(t, data)
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	first, last, total, err := parseContentRange("bytes 0-99/1000")
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{0, 99, 1000}, []int64{first, last, total})
+
+	first, last, total, err = parseContentRange("bytes 10-19/*")
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{10, 19, -1}, []int64{first, last, total})
+
+	for _, header := range []string{"", "bytes */1000", "bytes 5-1/10", "items 0-1/2", "bytes 0-x/10"} {
+		_, _, _, err = parseContentRange(header)
+		assert.NotNil(t, err, header)
+	}
+}
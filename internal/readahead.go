@@ -0,0 +1,329 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultReadAheadMinWindow int64 = 1024 * 1024
+	DefaultReadAheadMaxWindow int64 = 64 * 1024 * 1024
+	DefaultReadAheadMaxMemory int64 = 512 * 1024 * 1024
+
+	// Number of back to back reads after which a file counts as being streamed
+	sequentialReadThreshold = 2
+
+	// Reads that land this close to where the previous read ended still count
+	// as sequential, since the kernel may deliver a stream's reads out of
+	// order. It is the size of a kernel read, so that random reads close to
+	// each other do not start read-ahead.
+	sequentialReadTolerance int64 = 128 * 1024
+
+	// Prefetched data that nobody has asked for in this long may be dropped to
+	// make room for other files
+	readAheadIdleTimeout = 30 * time.Second
+)
+
+// readAheadTracker detects sequential readers and prefetches data ahead of
+// them in the background, within a global memory budget
+type readAheadTracker struct {
+	fs *Gen3Fuse
+
+	minWindow int64
+	maxWindow int64
+	maxMemory int64
+
+	// Canceled on unmount, to stop the downloads in flight
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	used       int64
+	readAheads map[*readAhead]struct{}
+}
+
+// readAhead holds the access pattern and the prefetched data of one open file
+type readAhead struct {
+	// Canceled when the file is closed, to stop its downloads in flight
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu sync.Mutex
+
+	// Where the next read of a sequential stream is expected to start
+	nextOffset int64
+	sequential int
+	window     int64
+
+	// Prefetched or in-flight ranges, ordered by offset
+	buffers        []*prefetchBuffer
+	prefetchedUpTo int64
+
+	lastAccess time.Time
+}
+
+type prefetchBuffer struct {
+	offset int64
+	size   int64
+
+	// closed once data and err are set
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// failed tells whether the download of the buffer is over and failed
+func (buffer *prefetchBuffer) failed() bool {
+	select {
+	case <-buffer.done:
+		return buffer.err != nil
+	default:
+		return false
+	}
+}
+
+func newReadAheadTracker(fs *Gen3Fuse, gen3FuseConfig *Gen3FuseConfig) *readAheadTracker {
+	tracker := &readAheadTracker{
+		fs:         fs,
+		minWindow:  gen3FuseConfig.ReadAheadMinWindow,
+		maxWindow:  gen3FuseConfig.ReadAheadMaxWindow,
+		maxMemory:  gen3FuseConfig.ReadAheadMaxMemory,
+		readAheads: make(map[*readAhead]struct{}),
+	}
+	tracker.ctx, tracker.cancel = context.WithCancel(context.Background())
+	if tracker.minWindow <= 0 {
+		tracker.minWindow = DefaultReadAheadMinWindow
+	}
+	if tracker.maxWindow <= 0 {
+		tracker.maxWindow = DefaultReadAheadMaxWindow
+	}
+	if tracker.maxWindow < tracker.minWindow {
+		tracker.maxWindow = tracker.minWindow
+	}
+	if tracker.maxMemory <= 0 {
+		tracker.maxMemory = DefaultReadAheadMaxMemory
+	}
+	return tracker
+}
+
+// Register starts tracking a newly opened file
+func (tracker *readAheadTracker) Register() *readAhead {
+	ra := &readAhead{window: tracker.minWindow, lastAccess: time.Now()}
+	ra.ctx, ra.cancel = context.WithCancel(tracker.ctx)
+
+	tracker.mu.Lock()
+	tracker.readAheads[ra] = struct{}{}
+	tracker.mu.Unlock()
+	return ra
+}
+
+// Unregister drops the prefetched data of a file that has been closed
+func (tracker *readAheadTracker) Unregister(ra *readAhead) {
+	ra.cancel()
+	tracker.mu.Lock()
+	delete(tracker.readAheads, ra)
+	tracker.mu.Unlock()
+
+	ra.mu.Lock()
+	tracker.discardLocked(ra, 0, 0)
+	ra.mu.Unlock()
+}
+
+// Close stops every download in flight, once the file system is unmounted
+func (tracker *readAheadTracker) Close() {
+	tracker.cancel()
+}
+
+// reserve claims prefetch memory for self, dropping idle prefetched data of
+// other files if the budget is exhausted
+func (tracker *readAheadTracker) reserve(self *readAhead, size int64) bool {
+	if tracker.tryReserve(size) {
+		return true
+	}
+
+	tracker.mu.Lock()
+	readAheads := make([]*readAhead, 0, len(tracker.readAheads))
+	for ra := range tracker.readAheads {
+		readAheads = append(readAheads, ra)
+	}
+	tracker.mu.Unlock()
+
+	idleSince := time.Now().Add(-readAheadIdleTimeout)
+	for _, ra := range readAheads {
+		// never block on a file that is being read right now
+		if ra == self || !ra.mu.TryLock() {
+			continue
+		}
+		if ra.lastAccess.Before(idleSince) {
+			tracker.discardLocked(ra, 0, 0)
+		}
+		ra.mu.Unlock()
+	}
+
+	return tracker.tryReserve(size)
+}
+
+func (tracker *readAheadTracker) tryReserve(size int64) bool {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	if tracker.used+size > tracker.maxMemory {
+		return false
+	}
+	tracker.used += size
+	return true
+}
+
+func (tracker *readAheadTracker) release(buffer *prefetchBuffer) {
+	go func() {
+		// the memory stays in use until the download finishes
+		<-buffer.done
+		tracker.mu.Lock()
+		tracker.used -= buffer.size
+		tracker.mu.Unlock()
+	}()
+}
+
+// discardLocked drops every buffer that does not overlap [start, end). ra.mu must be held.
+func (tracker *readAheadTracker) discardLocked(ra *readAhead, start int64, end int64) {
+	kept := ra.buffers[:0]
+	for _, buffer := range ra.buffers {
+		if buffer.offset < end && buffer.offset+buffer.size > start {
+			kept = append(kept, buffer)
+		} else {
+			tracker.release(buffer)
+		}
+	}
+	ra.buffers = kept
+	if len(ra.buffers) == 0 {
+		ra.prefetchedUpTo = 0
+	}
+}
+
+// Read serves as much of dst as possible from prefetched data, then updates
+// the access pattern of the file and schedules more prefetching if it is being
+// read sequentially. Whatever is not served must be fetched by the caller.
+func (tracker *readAheadTracker) Read(ra *readAhead, handle *fileHandle, dst []byte, offset int64) (bytesRead int) {
+	fullsize := int64(handle.info.attributes.Size)
+	if offset >= fullsize {
+		return 0
+	}
+	readEnd := offset + int64(len(dst))
+	if readEnd > fullsize {
+		readEnd = fullsize
+	}
+
+	ra.mu.Lock()
+	ra.lastAccess = time.Now()
+
+	if offset >= ra.nextOffset-sequentialReadTolerance && offset <= ra.nextOffset+sequentialReadTolerance {
+		ra.sequential++
+	} else {
+		ra.sequential = 0
+		ra.window = tracker.minWindow
+		tracker.discardLocked(ra, offset, readEnd)
+	}
+	if readEnd > ra.nextOffset || ra.sequential == 0 {
+		ra.nextOffset = readEnd
+	}
+
+	// Collect the buffers covering this read before waiting on any of them
+	covering := []*prefetchBuffer{}
+	position := offset
+	for _, buffer := range ra.buffers {
+		if buffer.offset <= position && position < buffer.offset+buffer.size {
+			covering = append(covering, buffer)
+			position = buffer.offset + buffer.size
+		}
+	}
+
+	if ra.sequential >= sequentialReadThreshold {
+		tracker.prefetchLocked(ra, handle, readEnd)
+	}
+	ra.mu.Unlock()
+
+	for _, buffer := range covering {
+		<-buffer.done
+		position := offset + int64(bytesRead)
+		if buffer.err != nil || position < buffer.offset || position >= buffer.offset+int64(len(buffer.data)) {
+			break
+		}
+		bytesRead += copy(dst[bytesRead:readEnd-offset], buffer.data[position-buffer.offset:])
+		if offset+int64(bytesRead) >= readEnd {
+			break
+		}
+	}
+
+	// Prefetched data that has been read is not needed anymore. A failed
+	// download is dropped with everything after it, so that the range is
+	// prefetched again rather than left to synchronous reads.
+	ra.mu.Lock()
+	for _, buffer := range ra.buffers {
+		if buffer.failed() && buffer.offset < ra.prefetchedUpTo {
+			ra.prefetchedUpTo = buffer.offset
+		}
+	}
+	kept := ra.buffers[:0]
+	for _, buffer := range ra.buffers {
+		if buffer.offset+buffer.size <= offset+int64(bytesRead) || buffer.offset >= ra.prefetchedUpTo {
+			tracker.release(buffer)
+		} else {
+			kept = append(kept, buffer)
+		}
+	}
+	ra.buffers = kept
+	ra.mu.Unlock()
+
+	return bytesRead
+}
+
+// prefetchLocked starts downloading the window that follows readEnd. ra.mu must be held.
+func (tracker *readAheadTracker) prefetchLocked(ra *readAhead, handle *fileHandle, readEnd int64) {
+	info := handle.info
+	fullsize := int64(info.attributes.Size)
+	start := ra.prefetchedUpTo
+	if start < readEnd {
+		start = readEnd
+	}
+	end := readEnd + ra.window
+	if end > fullsize {
+		end = fullsize
+	}
+
+	// Wait until there is a worthwhile amount to fetch, unless this is the end of the file
+	if end <= start || (end-start < ra.window/2 && end < fullsize) {
+		return
+	}
+
+	size := end - start
+	if !tracker.reserve(ra, size) {
+		FuseLog(fmt.Sprintf("Read-ahead memory exhausted, not prefetching %v bytes of %v", size, info.DID))
+		return
+	}
+
+	buffer := &prefetchBuffer{
+		offset: start,
+		size:   size,
+		done:   make(chan struct{}),
+	}
+	ra.buffers = append(ra.buffers, buffer)
+	ra.prefetchedUpTo = end
+
+	ra.window *= 2
+	if ra.window > tracker.maxWindow {
+		ra.window = tracker.maxWindow
+	}
+
+	go func() {
+		defer close(buffer.done)
+		data := make([]byte, size)
+		bytesRead, err := tracker.fs.readRange(ra.ctx, handle, nil, data, start)
+		if err != nil && ra.ctx.Err() == nil {
+			FuseLog(fmt.Sprintf("Prefetching %v bytes of %v at offset %v failed: %v", size, info.DID, start, err))
+		}
+		buffer.data = data[:bytesRead]
+		buffer.err = err
+	}()
+}
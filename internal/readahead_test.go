@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+)
+
+func readAheadTestConfig() *Gen3FuseConfig {
+	return &Gen3FuseConfig{
+		ReadAheadMinWindow: 64 * 1024,
+		ReadAheadMaxWindow: 256 * 1024,
+		ReadAheadMaxMemory: 1024 * 1024,
+	}
+}
+
+// newReadAheadServer serves content, counting the requests if requests is
+// not nil. The ranged requests of prefetches, which name their last byte, are
+// handed to prefetch instead if it is not nil. The handles reading from it
+// have to be released before it can shut down.
+func newReadAheadServer(t *testing.T, content []byte, requests *int32, prefetch func(w http.ResponseWriter, r *http.Request, start, end int64)) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests != nil {
+			atomic.AddInt32(requests, 1)
+		}
+		var start, end int64
+		if n, _ := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); n == 2 && prefetch != nil {
+			prefetch(w, r, start, end)
+			return
+		}
+		http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func readAt(t *testing.T, fs *Gen3Fuse, handle fuseops.HandleID, offset int64, size int) []byte {
+	op := &fuseops.ReadFileOp{Inode: testInode, Handle: handle, Offset: offset, Dst: make([]byte, size)}
+	assert.Nil(t, fs.ReadFile(context.Background(), op))
+	return op.Dst[:op.BytesRead]
+}
+
+func TestReadAheadPrefetchesSequentialReads(t *testing.T) {
+	content := make([]byte, 2*1024*1024+123)
+	rand.Read(content)
+	var requests int32
+	fs := newTestFs(readAheadTestConfig(), len(content), withReadAhead())
+	handle := openTestFile(fs, newReadAheadServer(t, content, &requests, nil))
+	t.Cleanup(func() { fs.releaseHandle(handle) })
+
+	readSize := 4096
+	for offset := 0; offset < len(content); offset += readSize {
+		expectedEnd := offset + readSize
+		if expectedEnd > len(content) {
+			expectedEnd = len(content)
+		}
+		if !assert.Equal(t, content[offset:expectedEnd], readAt(t, fs, handle, int64(offset), readSize)) {
+			return
+		}
+	}
+
+	// 513 reads, almost all of them served from prefetched windows
+	assert.Less(t, atomic.LoadInt32(&requests), int32(30))
+
+	// closing the file drops whatever was prefetched past the end of the reads
+	assert.Nil(t, fs.ReleaseFileHandle(context.Background(), &fuseops.ReleaseFileHandleOp{Handle: handle}))
+
+	// everything prefetched was consumed, so the memory budget is free again
+	assert.Eventually(t, func() bool {
+		fs.readAhead.mu.Lock()
+		defer fs.readAhead.mu.Unlock()
+		return fs.readAhead.used == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestReadAheadIgnoresRandomReads(t *testing.T) {
+	content := make([]byte, 8*1024*1024)
+	rand.Read(content)
+	var requests int32
+	fs := newTestFs(readAheadTestConfig(), len(content), withReadAhead())
+	handle := openTestFile(fs, newReadAheadServer(t, content, &requests, nil))
+	t.Cleanup(func() { fs.releaseHandle(handle) })
+
+	offsets := []int64{5000000, 12345, 7000000, 3000000, 100, 6000000, 2500000, 4100000}
+	for _, offset := range offsets {
+		assert.Equal(t, content[offset:offset+4096], readAt(t, fs, handle, offset, 4096))
+	}
+
+	// every read reopens the stream at a new offset, and nothing is prefetched
+	assert.Equal(t, int32(len(offsets)), atomic.LoadInt32(&requests))
+	openHandle, _ := fs.handles.Get(handle)
+	ra := openHandle.readAhead
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	assert.Empty(t, ra.buffers)
+}
+
+func TestReadAheadRetriesFailedPrefetches(t *testing.T) {
+	content := make([]byte, 1024*1024)
+	rand.Read(content)
+	var mu sync.Mutex
+	var ranges [][2]int64
+	url := newReadAheadServer(t, content, nil, func(w http.ResponseWriter, r *http.Request, start, end int64) {
+		mu.Lock()
+		ranges = append(ranges, [2]int64{start, end})
+		failed := len(ranges) == 1
+		mu.Unlock()
+		if failed {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(content))
+	})
+	fs := newTestFs(readAheadTestConfig(), len(content), withReadAhead())
+	handle := openTestFile(fs, url)
+	t.Cleanup(func() { fs.releaseHandle(handle) })
+
+	for offset := 0; offset < len(content); offset += 4096 {
+		assert.Equal(t, content[offset:offset+4096], readAt(t, fs, handle, int64(offset), 4096))
+	}
+
+	// The range of the failed prefetch is prefetched again
+	mu.Lock()
+	defer mu.Unlock()
+	failed := ranges[0]
+	refetched := false
+	for _, r := range ranges[1:] {
+		refetched = refetched || (r[0] <= failed[1] && r[1] >= failed[0])
+	}
+	assert.True(t, refetched, "ranges %v", ranges)
+	assert.Greater(t, atomic.LoadInt64(&fs.stats.readAheadBytes), int64(len(content)/2))
+}
+
+func TestReadAheadIgnoresNearbyRandomReads(t *testing.T) {
+	content := make([]byte, 4*1024*1024)
+	rand.Read(content)
+	var prefetches int32
+	url := newReadAheadServer(t, content, nil, func(w http.ResponseWriter, r *http.Request, start, end int64) {
+		atomic.AddInt32(&prefetches, 1)
+		http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(content))
+	})
+	fs := newTestFs(readAheadTestConfig(), len(content), withReadAhead())
+	handle := openTestFile(fs, url)
+	t.Cleanup(func() { fs.releaseHandle(handle) })
+
+	for offset := int64(0); offset < int64(len(content)); offset += 300000 {
+		assert.Equal(t, content[offset:offset+4096], readAt(t, fs, handle, offset, 4096))
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&prefetches))
+}
+
+func TestReadAheadStopsPrefetchesOnClose(t *testing.T) {
+	content := make([]byte, 1024*1024)
+	rand.Read(content)
+	started := make(chan struct{}, 1)
+	canceled := make(chan struct{}, 1)
+	url := newReadAheadServer(t, content, nil, func(w http.ResponseWriter, r *http.Request, start, end int64) {
+		started <- struct{}{}
+		<-r.Context().Done()
+		canceled <- struct{}{}
+	})
+	fs := newTestFs(readAheadTestConfig(), len(content), withReadAhead())
+	handle := openTestFile(fs, url)
+	t.Cleanup(func() { fs.releaseHandle(handle) })
+
+	readAt(t, fs, handle, 0, 4096)
+	readAt(t, fs, handle, 4096, 4096)
+	<-started
+	assert.Nil(t, fs.ReleaseFileHandle(context.Background(), &fuseops.ReleaseFileHandleOp{Handle: handle}))
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Error("the prefetch was not canceled")
+	}
+}
@@ -0,0 +1,258 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// hangups hands SIGHUP on to every mounted manifest. The signal is caught
+// once for the process, however many manifests a MultiFuse mounts.
+var hangups struct {
+	once sync.Once
+
+	mu          sync.Mutex
+	subscribers map[chan struct{}]bool
+}
+
+// subscribeHangup returns a channel that receives SIGHUP, and the function
+// to call once it is no longer read
+func subscribeHangup() (hangup <-chan struct{}, unsubscribe func()) {
+	hangups.once.Do(func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGHUP)
+		go func() {
+			for range signals {
+				FuseLog("Got SIGHUP, reloading the manifests")
+				broadcastHangup()
+			}
+		}()
+	})
+
+	// A hangup that comes while the last one is being handled is enough to
+	// reload again, so the channel holds at most one
+	subscriber := make(chan struct{}, 1)
+	hangups.mu.Lock()
+	defer hangups.mu.Unlock()
+	if hangups.subscribers == nil {
+		hangups.subscribers = make(map[chan struct{}]bool)
+	}
+	hangups.subscribers[subscriber] = true
+	return subscriber, func() {
+		hangups.mu.Lock()
+		defer hangups.mu.Unlock()
+		delete(hangups.subscribers, subscriber)
+	}
+}
+
+func broadcastHangup() {
+	hangups.mu.Lock()
+	defer hangups.mu.Unlock()
+	for subscriber := range hangups.subscribers {
+		select {
+		case subscriber <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// watchManifest reloads the manifest on SIGHUP and, when
+// ManifestReloadInterval is set, whenever the manifest file changes, until
+// stop is closed
+func (fs *Gen3Fuse) watchManifest(stop <-chan struct{}) {
+	hangup, unsubscribe := subscribeHangup()
+	defer unsubscribe()
+
+	var poll <-chan time.Time
+	if fs.gen3FuseConfig.ManifestReloadInterval > 0 {
+		ticker := time.NewTicker(fs.gen3FuseConfig.ManifestReloadInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	last, _ := os.Stat(fs.status.manifestFilePath)
+
+	for {
+		select {
+		case <-hangup:
+			FuseLog(fmt.Sprintf("Reloading the manifest %v", fs.status.manifestFilePath))
+		case <-poll:
+			current, err := os.Stat(fs.status.manifestFilePath)
+			if err != nil || (last != nil && current.ModTime().Equal(last.ModTime()) && current.Size() == last.Size()) {
+				continue
+			}
+			last = current
+			FuseLog("The manifest has changed, reloading it")
+		case <-stop:
+			return
+		}
+
+		if err := fs.ReloadManifest(); err != nil {
+			FuseLog(fmt.Sprintf("Error: could not reload the manifest %v, keeping the files mounted: %v", fs.status.manifestFilePath, err))
+		}
+	}
+}
+
+// ReloadManifest reads the manifest file again and updates the mounted files
+// in place. Only the DIDs that were not mounted yet are looked up. Files
+// that are still in the manifest keep their inodes, and files that were
+// removed can still be read through the handles open on them. The new
+// manifest is only applied once all of it could be mounted, so that on
+// errors the file system stays as it was.
+func (fs *Gen3Fuse) ReloadManifest() error {
+	fs.reloadMu.Lock()
+	defer fs.reloadMu.Unlock()
+
+	manifestJSON, report, err := parseManifest(fs.status.manifestFilePath, fs.gen3FuseConfig)
+	if err != nil {
+		// The file may be in the middle of being written
+		return err
+	}
+	logManifestWarnings(fs.status.manifestFilePath, report)
+	manifest := newManifestState(manifestJSON)
+	// Why DIDs of the new manifest could not be mounted
+	unresolved := &mountStatus{}
+
+	var newDIDs []string
+	for _, did := range manifest.DIDs {
+		if _, ok := fs.fileInfos[did]; !ok {
+			newDIDs = append(newDIDs, did)
+		}
+	}
+	resolved := make(map[string]*FileInfo)
+	if len(newDIDs) > 0 {
+		resolved, err = fs.resolveDIDs(newDIDs, manifest.DIDsToCommonsHostnames, unresolved)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Records of mounted files are shared with their inodes, so the manifest
+	// fields go on copies
+	didToFileInfo := make(map[string]*FileInfo)
+	for _, did := range manifest.DIDs {
+		if fileInfo, ok := fs.fileInfos[did]; ok {
+			copied := *fileInfo
+			didToFileInfo[did] = &copied
+		} else if fileInfo, ok := resolved[did]; ok {
+			didToFileInfo[did] = fileInfo
+		}
+	}
+	manifest.annotateFileInfos(didToFileInfo)
+	unresolved.findUnresolved(manifest.DIDs, didToFileInfo)
+
+	inodes, err := InitializeInodes(didToFileInfo, fs.gen3FuseConfig)
+	if err != nil {
+		return err
+	}
+
+	fs.applyManifest(manifest)
+	fs.status.replaceUnresolved(unresolved)
+	fs.replaceInodes(inodes)
+	fs.fetchExternalIDPTokens()
+
+	removed := 0
+	for did := range fs.fileInfos {
+		if _, ok := didToFileInfo[did]; !ok {
+			removed++
+		}
+	}
+	FuseLog(fmt.Sprintf("Reloaded the manifest %v: %v files mounted, %v added, %v removed",
+		fs.status.manifestFilePath, len(didToFileInfo), len(didToFileInfo)-len(fs.fileInfos)+removed, removed))
+	fs.fileInfos = didToFileInfo
+	return nil
+}
+
+// inodePaths maps the path of every inode reachable from the root to its ID
+func inodePaths(inodes map[fuseops.InodeID]*inodeInfo) map[string]fuseops.InodeID {
+	paths := map[string]fuseops.InodeID{"": fuseops.RootInodeID}
+	pending := []string{""}
+	for len(pending) > 0 {
+		path := pending[0]
+		pending = pending[1:]
+		info, ok := inodes[paths[path]]
+		if !ok || !info.dir {
+			continue
+		}
+		for _, child := range info.Children {
+			childPath := path + "/" + child.Name
+			paths[childPath] = child.Inode
+			pending = append(pending, childPath)
+		}
+	}
+	return paths
+}
+
+// sameKind tells whether an inode can stand in for another: a file of the
+// same DID, or a directory, symlink or control file in both
+func sameKind(a *inodeInfo, b *inodeInfo) bool {
+	return a.dir == b.dir && a.DID == b.DID && a.symlink == b.symlink && a.control == b.control
+}
+
+// replaceInodes swaps in a freshly built inode table. The new inodes take the
+// IDs of the inodes at the same paths in the current table, so that the
+// kernel's references stay valid, and other inodes get IDs never used
+// before. Removed inodes that are still open are kept, outside of any
+// directory, until a later reload finds them closed.
+//
+// This version of the FUSE library cannot send invalidation notifications.
+// Lookups and attributes are answered with no expiration, so the kernel
+// never caches them and listings show the new tree right away; giving them
+// an expiration would keep the kernel on the old tree until it expires.
+func (fs *Gen3Fuse) replaceInodes(inodes map[fuseops.InodeID]*inodeInfo) {
+	fs.inodesMu.RLock()
+	current := fs.inodes
+	fs.inodesMu.RUnlock()
+
+	if fs.lastInodeID < fuseops.RootInodeID {
+		fs.lastInodeID = fuseops.RootInodeID
+	}
+	for id := range current {
+		if id > fs.lastInodeID {
+			fs.lastInodeID = id
+		}
+	}
+
+	currentPaths := inodePaths(current)
+	renumbered := map[fuseops.InodeID]fuseops.InodeID{fuseops.RootInodeID: fuseops.RootInodeID}
+	taken := map[fuseops.InodeID]bool{fuseops.RootInodeID: true}
+	for path, id := range inodePaths(inodes) {
+		currentID, ok := currentPaths[path]
+		if !ok || taken[currentID] || current[currentID] == nil || !sameKind(current[currentID], inodes[id]) {
+			continue
+		}
+		if _, ok := renumbered[id]; ok {
+			continue
+		}
+		renumbered[id] = currentID
+		taken[currentID] = true
+	}
+	for id := range inodes {
+		if _, ok := renumbered[id]; !ok {
+			fs.lastInodeID++
+			renumbered[id] = fs.lastInodeID
+		}
+	}
+
+	replacement := make(map[fuseops.InodeID]*inodeInfo, len(inodes))
+	for id, info := range inodes {
+		children := make([]fuseutil.Dirent, len(info.Children))
+		for i, child := range info.Children {
+			child.Inode = renumbered[child.Inode]
+			children[i] = child
+		}
+		info.Children = children
+		replacement[renumbered[id]] = info
+	}
+	for id, info := range fs.handles.OpenInodes() {
+		if _, ok := replacement[id]; !ok {
+			replacement[id] = info
+		}
+	}
+	fs.setInodes(replacement)
+}
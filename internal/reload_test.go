@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeIndexd stands in for Indexd, recording which DIDs it was asked for
+// and failing lookups of dg.FAIL DIDs. It returns the config reaching it.
+func newFakeIndexd(t *testing.T) (config *Gen3FuseConfig, lookedUp *[]string) {
+	var mu sync.Mutex
+	lookedUp = &[]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var dids []string
+		json.NewDecoder(r.Body).Decode(&dids)
+		mu.Lock()
+		*lookedUp = append(*lookedUp, dids...)
+		mu.Unlock()
+		for _, did := range dids {
+			if strings.HasPrefix(did, "dg.FAIL/") {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		records := make([]*FileInfo, 0, len(dids))
+		for _, did := range dids {
+			records = append(records, &FileInfo{DID: did, Filesize: 10, URLs: []string{fmt.Sprintf("s3://bucket/%v.bam", did)}})
+		}
+		json.NewEncoder(w).Encode(records)
+	}))
+	t.Cleanup(server.Close)
+
+	return &Gen3FuseConfig{Hostname: server.URL, IndexdBulkFileInfoPath: "/index/bulk/documents"}, lookedUp
+}
+
+func TestReloadManifest(t *testing.T) {
+	config, lookedUp := newFakeIndexd(t)
+	fs := newTestFs(config, 0, withManifest(t, `[{"object_id": "dg.TEST/1"}, {"object_id": "dg.TEST/2"}]`))
+	manifestFilePath := fs.status.manifestFilePath
+	// only the lookups of the reloads count
+	*lookedUp = nil
+	one := lookUpPath(t, fs, "by-guid/dg.TEST/1")
+	oneByName := lookUpPath(t, fs, "by-filename/1.bam")
+	byGUID := lookUpPath(t, fs, "by-guid")
+	two := lookUpPath(t, fs, "by-guid/dg.TEST/2")
+
+	assert.Nil(t, ioutil.WriteFile(manifestFilePath,
+		[]byte(`[{"object_id": "dg.TEST/1"}, {"object_id": "dg.TEST/3"}]`), 0644))
+	assert.Nil(t, fs.ReloadManifest())
+
+	// Only the new DID is looked up
+	assert.Equal(t, []string{"dg.TEST/3"}, *lookedUp)
+
+	// Unchanged paths keep their inodes
+	assert.Equal(t, one, lookUpPath(t, fs, "by-guid/dg.TEST/1"))
+	assert.Equal(t, oneByName, lookUpPath(t, fs, "by-filename/1.bam"))
+	assert.Equal(t, byGUID, lookUpPath(t, fs, "by-guid"))
+
+	// New files get inodes that were never used
+	three := lookUpPath(t, fs, "by-guid/dg.TEST/3")
+	assert.True(t, three > two)
+
+	err := fs.LookUpInode(context.Background(), &fuseops.LookUpInodeOp{Parent: lookUpPath(t, fs, "by-guid/dg.TEST"), Name: "2"})
+	assert.NotNil(t, err)
+}
+
+func TestReloadManifestKeepsOpenFiles(t *testing.T) {
+	config, _ := newFakeIndexd(t)
+	fs := newTestFs(config, 0, withManifest(t, `[{"object_id": "dg.TEST/1"}, {"object_id": "dg.TEST/2"}]`))
+	manifestFilePath := fs.status.manifestFilePath
+	two := lookUpPath(t, fs, "by-guid/dg.TEST/2")
+	handle := fs.handles.Add(&fileHandle{inode: two, info: fs.inodes[two]})
+
+	assert.Nil(t, ioutil.WriteFile(manifestFilePath, []byte(`[{"object_id": "dg.TEST/1"}]`), 0644))
+	assert.Nil(t, fs.ReloadManifest())
+
+	// The removed file is gone from its directory but its inode stays
+	err := fs.LookUpInode(context.Background(), &fuseops.LookUpInodeOp{Parent: lookUpPath(t, fs, "by-guid/dg.TEST"), Name: "2"})
+	assert.NotNil(t, err)
+	attributes := &fuseops.GetInodeAttributesOp{Inode: two}
+	assert.Nil(t, fs.GetInodeAttributes(context.Background(), attributes))
+	assert.Equal(t, uint64(10), attributes.Attributes.Size)
+
+	// Once closed, the next reload lets it go
+	fs.handles.Remove(handle)
+	assert.Nil(t, fs.ReloadManifest())
+	_, ok := fs.getInode(two)
+	assert.False(t, ok)
+}
+
+func TestReloadManifestKeepsTreeOnParseError(t *testing.T) {
+	config, _ := newFakeIndexd(t)
+	fs := newTestFs(config, 0, withManifest(t, `[{"object_id": "dg.TEST/1"}]`))
+	manifestFilePath := fs.status.manifestFilePath
+	one := lookUpPath(t, fs, "by-guid/dg.TEST/1")
+
+	assert.Nil(t, ioutil.WriteFile(manifestFilePath, []byte(`[{"object_id": "dg.TE`), 0644))
+	assert.NotNil(t, fs.ReloadManifest())
+	assert.Equal(t, one, lookUpPath(t, fs, "by-guid/dg.TEST/1"))
+	assert.Equal(t, []string{"dg.TEST/1"}, fs.DIDs)
+}
+
+func TestReloadManifestKeepsStateOnLookupError(t *testing.T) {
+	config, _ := newFakeIndexd(t)
+	fs := newTestFs(config, 0, withManifest(t, `[{"object_id": "dg.TEST/1"}]`))
+	manifestFilePath := fs.status.manifestFilePath
+	one := lookUpPath(t, fs, "by-guid/dg.TEST/1")
+	fs.status.setUnresolved("dg.TEST/9", "no record was found")
+
+	assert.Nil(t, ioutil.WriteFile(manifestFilePath, []byte(`[{"object_id": "dg.TEST/1"}, {"object_id": "dg.FAIL/2", "subject_id": "subject-2"}]`), 0644))
+	assert.NotNil(t, fs.ReloadManifest())
+
+	// The control files still describe the mounted files
+	assert.Equal(t, one, lookUpPath(t, fs, "by-guid/dg.TEST/1"))
+	assert.Equal(t, []string{"dg.TEST/1"}, fs.DIDs)
+	assert.Equal(t, map[string]ManifestRecord{"dg.TEST/1": {ObjectId: "dg.TEST/1"}}, fs.DIDsToManifestRecords)
+	assert.Empty(t, fs.DIDsToSubjectIds)
+	assert.Equal(t, map[string]string{"dg.TEST/9": "no record was found"}, fs.status.unresolved)
+}
+
+// Reloads rely on the kernel never caching lookups or attributes, as the
+// FUSE library cannot tell it to drop them
+func TestLookupsAreNotCached(t *testing.T) {
+	config, _ := newFakeIndexd(t)
+	fs := newTestFs(config, 0, withManifest(t, `[{"object_id": "dg.TEST/1"}]`))
+	parent := lookUpPath(t, fs, "by-guid/dg.TEST")
+	lookUp := &fuseops.LookUpInodeOp{Parent: parent, Name: "1"}
+	assert.Nil(t, fs.LookUpInode(context.Background(), lookUp))
+	assert.True(t, lookUp.Entry.EntryExpiration.IsZero())
+	assert.True(t, lookUp.Entry.AttributesExpiration.IsZero())
+	attributes := &fuseops.GetInodeAttributesOp{Inode: lookUp.Entry.Child}
+	assert.Nil(t, fs.GetInodeAttributes(context.Background(), attributes))
+	assert.True(t, attributes.AttributesExpiration.IsZero())
+
+	commons := newFakeCommons(t, map[string][]byte{"dg.TEST/1": []byte("one")})
+	m, err := NewMultiFuse(&Gen3FuseConfig{})
+	assert.Nil(t, err)
+	defer m.Destroy()
+	assert.Nil(t, m.AddManifest(context.Background(), "example.org", "manifest", commons.config(), writeManifestFile(t, "manifest.json", `[{"object_id": "dg.TEST/1"}]`)))
+	for _, path := range []string{"example.org", "example.org/manifest", "example.org/manifest/by-guid/dg.TEST/1"} {
+		dir, name := filepath.Split(path)
+		parent := fuseops.InodeID(fuseops.RootInodeID)
+		if dir != "" {
+			parent = lookUpMultiPath(t, m, strings.TrimSuffix(dir, "/"))
+		}
+		lookUp := &fuseops.LookUpInodeOp{Parent: parent, Name: name}
+		assert.Nil(t, m.LookUpInode(context.Background(), lookUp), path)
+		assert.True(t, lookUp.Entry.EntryExpiration.IsZero(), path)
+		assert.True(t, lookUp.Entry.AttributesExpiration.IsZero(), path)
+		attributes := &fuseops.GetInodeAttributesOp{Inode: lookUp.Entry.Child}
+		assert.Nil(t, m.GetInodeAttributes(context.Background(), attributes), path)
+		assert.True(t, attributes.AttributesExpiration.IsZero(), path)
+	}
+}
+
+func TestSIGHUPReloadsEveryManifest(t *testing.T) {
+	var stops []chan struct{}
+	var manifests []string
+	var filesystems []*Gen3Fuse
+	for i := 0; i < 2; i++ {
+		config, _ := newFakeIndexd(t)
+		fs := newTestFs(config, 0, withManifest(t, `[{"object_id": "dg.TEST/1"}]`))
+		manifestFilePath := fs.status.manifestFilePath
+		stop := make(chan struct{})
+		go fs.watchManifest(stop)
+		stops = append(stops, stop)
+		manifests = append(manifests, manifestFilePath)
+		filesystems = append(filesystems, fs)
+	}
+	subscribers := func() int {
+		hangups.mu.Lock()
+		defer hangups.mu.Unlock()
+		return len(hangups.subscribers)
+	}
+	assert.Eventually(t, func() bool { return subscribers() == 2 }, time.Second, time.Millisecond)
+
+	for _, manifestFilePath := range manifests {
+		assert.Nil(t, ioutil.WriteFile(manifestFilePath, []byte(`[{"object_id": "dg.TEST/2"}]`), 0644))
+	}
+	assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	for _, fs := range filesystems {
+		assert.Eventually(t, func() bool {
+			fs.manifestMu.RLock()
+			defer fs.manifestMu.RUnlock()
+			return len(fs.DIDs) == 1 && fs.DIDs[0] == "dg.TEST/2"
+		}, 5*time.Second, time.Millisecond)
+	}
+
+	// Unmounted manifests stop listening
+	for _, stop := range stops {
+		close(stop)
+	}
+	assert.Eventually(t, func() bool { return subscribers() == 0 }, time.Second, time.Millisecond)
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultRetryMaxAttempts    = 5
+	DefaultRetryInitialBackoff = 200 * time.Millisecond
+	DefaultRetryMaxBackoff     = 10 * time.Second
+	DefaultRetryDeadline       = 2 * time.Minute
+)
+
+// RetryPolicy controls how failed downloads are retried
+type RetryPolicy struct {
+	// Total number of attempts, including the first one
+	MaxAttempts int
+
+	// The backoff doubles after every attempt, starting at InitialBackoff and
+	// capped at MaxBackoff. Each wait is chosen at random up to the backoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// Time allowed for a single read, including every attempt and wait
+	Deadline time.Duration
+}
+
+func NewRetryPolicy(gen3FuseConfig *Gen3FuseConfig) RetryPolicy {
+	policy := RetryPolicy{
+		MaxAttempts:    gen3FuseConfig.RetryMaxAttempts,
+		InitialBackoff: gen3FuseConfig.RetryInitialBackoff,
+		MaxBackoff:     gen3FuseConfig.RetryMaxBackoff,
+		Deadline:       gen3FuseConfig.RetryDeadline,
+	}
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = DefaultRetryMaxAttempts
+	}
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = DefaultRetryInitialBackoff
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = DefaultRetryMaxBackoff
+	}
+	if policy.MaxBackoff < policy.InitialBackoff {
+		policy.MaxBackoff = policy.InitialBackoff
+	}
+	if policy.Deadline <= 0 {
+		policy.Deadline = DefaultRetryDeadline
+	}
+	return policy
+}
+
+// Backoff returns how long to wait after the given failed attempt, which is
+// counted from 1. A Retry-After hint from the server is honored if it is longer.
+func (policy RetryPolicy) Backoff(attempt int, retryAfter time.Duration) time.Duration {
+	backoff := policy.InitialBackoff
+	for i := 1; i < attempt && backoff < policy.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > policy.MaxBackoff {
+		backoff = policy.MaxBackoff
+	}
+
+	// Full jitter spreads out clients that failed at the same time
+	wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+	if retryAfter > wait {
+		wait = retryAfter
+	}
+	return wait
+}
+
+// IsRetryableError tells transient download failures, which are worth another
+// attempt, from fatal ones. It also returns the delay requested by the server,
+// if any.
+func IsRetryableError(err error) (retryable bool, retryAfter time.Duration) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests,
+			http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true, apiErr.RetryAfter
+		}
+		return false, 0
+	}
+
+	var rangeErr *RangeError
+	if errors.As(err, &rangeErr) {
+		return false, 0
+	}
+
+	if errors.Is(err, ErrShortBody) || errors.Is(err, ErrStreamStalled) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF) || errors.Is(err, context.DeadlineExceeded) {
+		return true, 0
+	}
+
+	// Errors of the connection are only transient if they say so, or if the
+	// connection was reset. An unsupported scheme, a malformed URL or a bad
+	// certificate would fail the same way again.
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true, 0
+	}
+	var temporary interface{ Temporary() bool }
+	if errors.As(err, &temporary) && temporary.Temporary() {
+		return true, 0
+	}
+	if errors.Is(err, syscall.ECONNRESET) {
+		return true, 0
+	}
+
+	return false, 0
+}
+
+// parseRetryAfter reads a Retry-After header given either in seconds or as an HTTP date
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyServer fails the first failures requests with the given status code
+func flakyServer(t *testing.T, content []byte, failures int32, statusCode int, retryAfter string) (server *httptest.Server, requests *int32) {
+	requests = new(int32)
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(requests, 1) <= failures {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(statusCode)
+			return
+		}
+		http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func readWithRetries(fs *Gen3Fuse, url string, size int) (*fuseops.ReadFileOp, error) {
+	op := &fuseops.ReadFileOp{Inode: testInode, Handle: openTestFile(fs, url), Dst: make([]byte, size)}
+	return op, fs.ReadFile(context.Background(), op)
+}
+
+func TestReadFileRetriesTransientFailures(t *testing.T) {
+	content := []byte("some content that is eventually served")
+	for _, statusCode := range []int{500, 502, 503, 504, 429} {
+		server, requests := flakyServer(t, content, 3, statusCode, "")
+		fs := newTestFs(&Gen3FuseConfig{
+			RetryMaxAttempts:    4,
+			RetryInitialBackoff: time.Millisecond,
+			RetryMaxBackoff:     5 * time.Millisecond,
+		}, len(content))
+
+		op, err := readWithRetries(fs, server.URL, 100)
+		assert.Nil(t, err, "status %v", statusCode)
+		assert.Equal(t, content, op.Dst[:op.BytesRead])
+		assert.Equal(t, int32(4), atomic.LoadInt32(requests))
+	}
+}
+
+func TestReadFileGivesUpAfterMaxAttempts(t *testing.T) {
+	content := []byte("never served")
+	server, requests := flakyServer(t, content, 100, 503, "")
+	fs := newTestFs(&Gen3FuseConfig{
+		RetryMaxAttempts:    3,
+		RetryInitialBackoff: time.Millisecond,
+	}, len(content))
+
+	_, err := readWithRetries(fs, server.URL, 100)
+	assert.Equal(t, fuse.EIO, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(requests))
+}
+
+func TestReadFileDoesNotRetryFatalErrors(t *testing.T) {
+	content := []byte("never served")
+	server, requests := flakyServer(t, content, 100, 404, "")
+	fs := newTestFs(&Gen3FuseConfig{RetryInitialBackoff: time.Millisecond}, len(content))
+
+	_, err := readWithRetries(fs, server.URL, 100)
+	assert.Equal(t, fuse.EIO, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+}
+
+func TestReadFileStopsAtDeadline(t *testing.T) {
+	content := []byte("never served")
+	// the server asks for a longer wait than the read is allowed to take
+	server, requests := flakyServer(t, content, 100, 503, "60")
+	fs := newTestFs(&Gen3FuseConfig{
+		RetryMaxAttempts: 10,
+		RetryDeadline:    time.Second,
+	}, len(content))
+
+	start := time.Now()
+	_, err := readWithRetries(fs, server.URL, 100)
+	assert.Equal(t, fuse.EIO, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestReadFileStopsWhenInterrupted(t *testing.T) {
+	content := []byte("never served")
+	server, requests := flakyServer(t, content, 100, 503, "60")
+	fs := newTestFs(&Gen3FuseConfig{
+		RetryMaxAttempts: 10,
+		RetryDeadline:    time.Hour,
+	}, len(content))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	op := &fuseops.ReadFileOp{Inode: testInode, Handle: openTestFile(fs, server.URL), Dst: make([]byte, 100)}
+	assert.Equal(t, fuse.EIO, fs.ReadFile(ctx, op))
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := NewRetryPolicy(&Gen3FuseConfig{
+		RetryInitialBackoff: 100 * time.Millisecond,
+		RetryMaxBackoff:     time.Second,
+	})
+	assert.Equal(t, DefaultRetryMaxAttempts, policy.MaxAttempts)
+	assert.Equal(t, DefaultRetryDeadline, policy.Deadline)
+
+	for i := 0; i < 100; i++ {
+		assert.LessOrEqual(t, int64(policy.Backoff(1, 0)), int64(100*time.Millisecond))
+		assert.LessOrEqual(t, int64(policy.Backoff(3, 0)), int64(400*time.Millisecond))
+		assert.LessOrEqual(t, int64(policy.Backoff(20, 0)), int64(time.Second))
+		assert.Equal(t, 5*time.Second, policy.Backoff(2, 5*time.Second))
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	retryable := []error{
+		&APIError{StatusCode: 500},
+		&APIError{StatusCode: 503},
+		&APIError{StatusCode: 429},
+		ErrShortBody,
+		ErrStreamStalled,
+		io.ErrUnexpectedEOF,
+		context.DeadlineExceeded,
+		&url.Error{Op: "Get", URL: "https://example.org", Err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}},
+		&url.Error{Op: "Get", URL: "https://example.org", Err: &net.DNSError{Err: "server misbehaving", IsTemporary: true}},
+		&net.OpError{Op: "dial", Err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}},
+		fmt.Errorf("wrapped: %w", ErrShortBody),
+	}
+	for _, err := range retryable {
+		ok, _ := IsRetryableError(err)
+		assert.True(t, ok, "%v", err)
+	}
+
+	fatal := []error{
+		&APIError{StatusCode: 400},
+		&APIError{StatusCode: 403},
+		&APIError{StatusCode: 404},
+		&RangeError{Reason: "server sent bytes starting at 1"},
+		errors.New("something else"),
+		&url.Error{Op: "Get", URL: "ftp://example.org", Err: errors.New(`unsupported protocol scheme "ftp"`)},
+		&url.Error{Op: "Get", URL: "https://example.org", Err: x509.UnknownAuthorityError{}},
+		&url.Error{Op: "parse", URL: "https://exa mple.org", Err: url.InvalidHostError(" ")},
+	}
+	for _, err := range fatal {
+		ok, _ := IsRetryableError(err)
+		assert.False(t, ok, "%v", err)
+	}
+
+	_, retryAfter := IsRetryableError(&APIError{StatusCode: 503, RetryAfter: 3 * time.Second})
+	assert.Equal(t, 3*time.Second, retryAfter)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, 120*time.Second, parseRetryAfter("120"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(""))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon"))
+
+	wait := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.Greater(t, int64(wait), int64(50*time.Second))
+}
@@ -0,0 +1,295 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+)
+
+// The sidecar runs next to a workspace and mounts the manifests the user
+// exports from the commons they are logged in to, through the workspace
+// token service (WTS). Every commons gets a directory named after its host
+// below the mount point, holding its latest manifests.
+
+const (
+	DefaultSidecarPollInterval = 10 * time.Second
+	DefaultSidecarMaxManifests = 5
+
+	// The name the log is shown under at the root of the mount, where the
+	// workspace user can read it
+	SidecarLogName = "_manifest-sync-status.log"
+
+	// The IDP of the commons the workspace runs in
+	defaultIDP = "default"
+)
+
+// Sidecar polls the manifest services and keeps the mount up to date
+type Sidecar struct {
+	gen3FuseConfig *Gen3FuseConfig
+	mounts         *MultiFuse
+
+	// Where downloaded manifests and cohort PFBs are kept while mounted
+	manifestDir string
+
+	// The manifests mounted for each domain, oldest first
+	mounted map[string][]mountedManifest
+}
+
+type mountedManifest struct {
+	name             string
+	manifestFilePath string
+}
+
+// identityProvider is a commons the user is logged in to
+type identityProvider struct {
+	IDP     string `json:"idp"`
+	BaseURL string `json:"base_url"`
+}
+
+type externalOIDCResponse struct {
+	Providers []identityProvider `json:"providers"`
+}
+
+type manifestServiceFile struct {
+	Filename string `json:"filename"`
+}
+
+type manifestServiceResponse struct {
+	Manifests []manifestServiceFile `json:"manifests"`
+	Cohorts   []manifestServiceFile `json:"cohorts"`
+}
+
+// NewSidecar returns a sidecar mounting manifests in mounts. gen3FuseConfig
+// gives the commons the workspace runs in, as Hostname, and how to reach
+// WTS.
+func NewSidecar(gen3FuseConfig *Gen3FuseConfig, mounts *MultiFuse, manifestDir string) *Sidecar {
+	return &Sidecar{
+		gen3FuseConfig: gen3FuseConfig,
+		mounts:         mounts,
+		manifestDir:    manifestDir,
+		mounted:        make(map[string][]mountedManifest),
+	}
+}
+
+func (sidecar *Sidecar) pollInterval() time.Duration {
+	if sidecar.gen3FuseConfig.SidecarPollInterval <= 0 {
+		return DefaultSidecarPollInterval
+	}
+	return sidecar.gen3FuseConfig.SidecarPollInterval
+}
+
+func (sidecar *Sidecar) maxManifests() int {
+	if sidecar.gen3FuseConfig.SidecarMaxManifests <= 0 {
+		return DefaultSidecarMaxManifests
+	}
+	return sidecar.gen3FuseConfig.SidecarMaxManifests
+}
+
+// RunSidecar mounts the manifests of the user at mountPoint, polling for new
+// ones until it gets SIGTERM or SIGINT. The log is shown in the mount as
+// SidecarLogName.
+func RunSidecar(gen3FuseConfig *Gen3FuseConfig, mountPoint string, manifestDir string) error {
+	if err := os.MkdirAll(manifestDir, 0700); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	mounts, mfs, err := MountMulti(ctx, mountPoint, gen3FuseConfig)
+	if err != nil {
+		return err
+	}
+	mounts.ShowLog(SidecarLogName)
+	sidecar := NewSidecar(gen3FuseConfig, mounts, manifestDir)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(stop)
+	ticker := time.NewTicker(sidecar.pollInterval())
+	defer ticker.Stop()
+
+	for {
+		sidecar.Poll(ctx)
+		select {
+		case <-ticker.C:
+		case <-stop:
+			FuseLog(fmt.Sprintf("Unmounting %v", mountPoint))
+			if err := fuse.Unmount(mountPoint); err != nil {
+				return err
+			}
+			return mfs.Join(ctx)
+		}
+	}
+}
+
+// Poll mounts the latest manifest and cohort of every commons the user is
+// logged in to, if they are not mounted yet. Failures are logged, and the
+// next poll tries again.
+func (sidecar *Sidecar) Poll(ctx context.Context) {
+	defaultToken, err := GetAccessTokenFromWTS(sidecar.gen3FuseConfig, defaultIDP)
+	if err != nil {
+		FuseLog(fmt.Sprintf("Error: could not get a token from WTS, will retry: %v", err))
+		return
+	}
+
+	IDPs := []identityProvider{{IDP: defaultIDP, BaseURL: sidecar.gen3FuseConfig.Hostname}}
+	var external externalOIDCResponse
+	externalOIDCURL := sidecar.gen3FuseConfig.WTSBaseURL + sidecar.gen3FuseConfig.WTSExternalOIDCPath + "?unexpired=true"
+	if err := getJson(externalOIDCURL, &external, defaultToken); err != nil {
+		FuseLog(fmt.Sprintf("Error: could not list the IDPs at %v: %v", externalOIDCURL, err))
+	}
+	IDPs = append(IDPs, external.Providers...)
+
+	for _, provider := range IDPs {
+		if err := sidecar.pollIDP(ctx, provider); err != nil {
+			FuseLog(fmt.Sprintf("Error: could not check for new manifests with IDP %v at %v: %v", provider.IDP, provider.BaseURL, err))
+		}
+	}
+}
+
+func (sidecar *Sidecar) pollIDP(ctx context.Context, provider identityProvider) error {
+	baseURL, err := url.Parse(provider.BaseURL)
+	if err != nil || baseURL.Host == "" {
+		return fmt.Errorf("invalid base URL %q", provider.BaseURL)
+	}
+	domain := baseURL.Host
+	token, err := GetAccessTokenFromWTS(sidecar.gen3FuseConfig, provider.IDP)
+	if err != nil {
+		return err
+	}
+	manifestServiceURL := strings.TrimRight(provider.BaseURL, "/") + sidecar.gen3FuseConfig.ManifestServicePath
+
+	var manifests manifestServiceResponse
+	if err := getJson(manifestServiceURL+"/", &manifests, token); err != nil {
+		FuseLog(fmt.Sprintf("The manifest service at %v/ did not answer, maybe it is not configured: %v", manifestServiceURL, err))
+	} else if len(manifests.Manifests) > 0 {
+		filename := manifests.Manifests[len(manifests.Manifests)-1].Filename
+		name := sanitizeName(strings.TrimSuffix(filename, filepath.Ext(filename)))
+		if !sidecar.isMounted(domain, name) {
+			// The extension tells the format of the manifest
+			extension := strings.ToLower(filepath.Ext(filename))
+			if _, ok := manifestFormatsByExtension[extension]; !ok {
+				extension = ".json"
+			}
+			manifestFilePath := filepath.Join(sidecar.manifestDir, domain, name+extension)
+			err := downloadFile(manifestServiceURL+"/file/"+url.PathEscape(filename), token, manifestFilePath)
+			if err != nil {
+				return err
+			}
+			if err := sidecar.mount(ctx, provider, domain, name, manifestFilePath); err != nil {
+				return err
+			}
+		}
+	}
+
+	var cohorts manifestServiceResponse
+	if err := getJson(manifestServiceURL+"/cohorts", &cohorts, token); err != nil {
+		FuseLog(fmt.Sprintf("The manifest service at %v/cohorts did not answer, maybe it is not configured: %v", manifestServiceURL, err))
+	} else if len(cohorts.Cohorts) > 0 && cohorts.Cohorts[len(cohorts.Cohorts)-1].Filename != "" {
+		GUID := cohorts.Cohorts[len(cohorts.Cohorts)-1].Filename
+		name := sanitizeName("manifest-" + GUID)
+		if !sidecar.isMounted(domain, name) {
+			FuseLog(fmt.Sprintf("Got the new cohort %v from %v", GUID, domain))
+			manifestFilePath, err := sidecar.downloadCohort(provider, token, domain, GUID, name)
+			if err != nil {
+				return err
+			}
+			if err := sidecar.mount(ctx, provider, domain, name, manifestFilePath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (sidecar *Sidecar) isMounted(domain string, name string) bool {
+	for _, mounted := range sidecar.mounted[domain] {
+		if mounted.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// mount adds a manifest of the commons, removing the oldest of its
+// manifests when there are too many
+func (sidecar *Sidecar) mount(ctx context.Context, provider identityProvider, domain string, name string, manifestFilePath string) error {
+	gen3FuseConfig := *sidecar.gen3FuseConfig
+	gen3FuseConfig.Hostname = provider.BaseURL
+	gen3FuseConfig.WTSIdp = provider.IDP
+	gen3FuseConfig.ApiKey = ""
+	if err := sidecar.mounts.AddManifest(ctx, domain, name, &gen3FuseConfig, manifestFilePath); err != nil {
+		return err
+	}
+	sidecar.mounted[domain] = append(sidecar.mounted[domain], mountedManifest{name: name, manifestFilePath: manifestFilePath})
+
+	for len(sidecar.mounted[domain]) > sidecar.maxManifests() {
+		oldest := sidecar.mounted[domain][0]
+		sidecar.mounted[domain] = sidecar.mounted[domain][1:]
+		FuseLog(fmt.Sprintf("Removing the old manifest %v/%v", domain, oldest.name))
+		if err := sidecar.mounts.RemoveManifest(domain, oldest.name); err != nil {
+			FuseLog(fmt.Sprintf("Error: could not remove %v/%v: %v", domain, oldest.name, err))
+		}
+		os.Remove(oldest.manifestFilePath)
+	}
+	return nil
+}
+
+// downloadCohort downloads the PFB of a cohort, which is mounted as is
+func (sidecar *Sidecar) downloadCohort(provider identityProvider, token string, domain string, GUID string, name string) (manifestFilePath string, err error) {
+	presignedURLEndpoint := strings.TrimRight(provider.BaseURL, "/") + fmt.Sprintf(sidecar.gen3FuseConfig.FencePresignedURLPath, GUID)
+	var presigned presignedURLResponse
+	if err := getJson(presignedURLEndpoint, &presigned, token); err != nil || presigned.Url == "" {
+		return "", fmt.Errorf("could not get a presigned URL for the cohort PFB from %v: %v", presignedURLEndpoint, err)
+	}
+
+	manifestFilePath = filepath.Join(sidecar.manifestDir, domain, name+".avro")
+	// The presigned URL carries its own credentials
+	return manifestFilePath, downloadFile(presigned.Url, "", manifestFilePath)
+}
+
+// downloadFile saves the body of a GET request to path, replacing the file
+// only once the download is complete
+func downloadFile(requestURL string, token string, path string) error {
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := dataClient.Do(req)
+	if err != nil {
+		return stripURLErrorQuery(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// The URL may be presigned, so only its path is logged
+		return fmt.Errorf("GET %v answered with status code %v", stripQuery(requestURL), resp.StatusCode)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
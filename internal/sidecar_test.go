@@ -0,0 +1,213 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeManifestService stands in for a commons: its manifest service, Fence
+// and Indexd. The manifest service only answers requests made with the
+// token WTS hands out for idp.
+type fakeManifestService struct {
+	*httptest.Server
+	idp string
+
+	mu        sync.Mutex
+	manifests []string
+	cohorts   []string
+}
+
+func newFakeManifestService(t *testing.T, idp string) *fakeManifestService {
+	service := &fakeManifestService{idp: idp}
+	authorized := func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("Authorization") != "Bearer token-"+service.idp {
+			w.WriteHeader(http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+	listing := func(key string, names func() []string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !authorized(w, r) {
+				return
+			}
+			files := []map[string]string{}
+			for _, name := range names() {
+				files = append(files, map[string]string{"filename": name})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{key: files})
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/manifests/", listing("manifests", func() []string {
+		service.mu.Lock()
+		defer service.mu.Unlock()
+		return append([]string{}, service.manifests...)
+	}))
+	mux.HandleFunc("/manifests/cohorts", listing("cohorts", func() []string {
+		service.mu.Lock()
+		defer service.mu.Unlock()
+		return append([]string{}, service.cohorts...)
+	}))
+	mux.HandleFunc("/manifests/file/", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/manifests/file/")
+		fmt.Fprintf(w, `[{"object_id": "dg.TEST/%v"}]`, strings.TrimSuffix(name, ".json"))
+	})
+	mux.HandleFunc("/user/data/download/", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		GUID := strings.TrimPrefix(r.URL.Path, "/user/data/download/")
+		json.NewEncoder(w).Encode(map[string]string{"url": service.URL + "/pfb/" + GUID + "?X-Amz-Signature=secret"})
+	})
+	mux.HandleFunc("/pfb/", func(w http.ResponseWriter, r *http.Request) {
+		GUID := strings.TrimPrefix(r.URL.Path, "/pfb/")
+		w.Write(encodeTestPFB(t, "deflate", [][]interface{}{testPFBFile("file-"+GUID, "dg.TEST/"+GUID)}))
+	})
+	mux.HandleFunc("/index/bulk/documents", func(w http.ResponseWriter, r *http.Request) {
+		var dids []string
+		json.NewDecoder(r.Body).Decode(&dids)
+		records := []*FileInfo{}
+		for _, did := range dids {
+			records = append(records, &FileInfo{DID: did, Filesize: 10, URLs: []string{"s3://bucket/" + did}})
+		}
+		json.NewEncoder(w).Encode(records)
+	})
+	service.Server = httptest.NewServer(mux)
+	t.Cleanup(service.Close)
+	return service
+}
+
+func (service *fakeManifestService) export(manifest string) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	service.manifests = append(service.manifests, manifest)
+}
+
+func (service *fakeManifestService) exportCohort(GUID string) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	service.cohorts = append(service.cohorts, GUID)
+}
+
+// newFakeWTS hands out a token per IDP, and lists the external commons
+func newFakeWTS(t *testing.T, external ...*fakeManifestService) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token/", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"token": "token-" + r.URL.Query().Get("idp")})
+	})
+	mux.HandleFunc("/external_oidc/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token-default" || r.URL.Query().Get("unexpired") != "true" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		providers := []identityProvider{}
+		for _, service := range external {
+			providers = append(providers, identityProvider{IDP: service.idp, BaseURL: service.URL})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"providers": providers})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTestSidecar(t *testing.T, commons *fakeManifestService, wts *httptest.Server) (*Sidecar, *MultiFuse) {
+	previousLogFilePath := LogFilePath
+	t.Cleanup(func() { LogFilePath = previousLogFilePath })
+
+	config := &Gen3FuseConfig{
+		LogFilePath:            filepath.Join(t.TempDir(), "fuse_log.txt"),
+		Hostname:               commons.URL,
+		WTSBaseURL:             wts.URL,
+		WTSAccessTokenPath:     "/token/",
+		WTSExternalOIDCPath:    "/external_oidc/",
+		ManifestServicePath:    "/manifests",
+		FencePresignedURLPath:  "/user/data/download/%s",
+		IndexdBulkFileInfoPath: "/index/bulk/documents",
+		SidecarMaxManifests:    2,
+	}
+	mounts, err := NewMultiFuse(config)
+	assert.Nil(t, err)
+	t.Cleanup(mounts.Destroy)
+	return NewSidecar(config, mounts, t.TempDir()), mounts
+}
+
+func TestSidecarMountsLatestManifests(t *testing.T) {
+	commons := newFakeManifestService(t, "default")
+	other := newFakeManifestService(t, "other-idp")
+	sidecar, mounts := newTestSidecar(t, commons, newFakeWTS(t, other))
+	domain := strings.TrimPrefix(commons.URL, "http://")
+	otherDomain := strings.TrimPrefix(other.URL, "http://")
+
+	// Nothing exported yet
+	sidecar.Poll(context.Background())
+	assert.Empty(t, mounts.Manifests())
+
+	commons.export("1.json")
+	other.export("7.json")
+	sidecar.Poll(context.Background())
+	assert.ElementsMatch(t, []string{domain + "/1", otherDomain + "/7"}, mounts.Manifests())
+
+	// Polling again mounts nothing new
+	sidecar.Poll(context.Background())
+	assert.ElementsMatch(t, []string{domain + "/1", otherDomain + "/7"}, mounts.Manifests())
+
+	// Only the latest manifests of each commons are kept
+	for _, manifest := range []string{"2.json", "3.json"} {
+		commons.export(manifest)
+		sidecar.Poll(context.Background())
+	}
+	assert.ElementsMatch(t, []string{domain + "/2", domain + "/3", otherDomain + "/7"}, mounts.Manifests())
+	_, err := os.Stat(filepath.Join(sidecar.manifestDir, domain, "1.json"))
+	assert.True(t, os.IsNotExist(err))
+
+	lookUpMultiPath(t, mounts, domain+"/3/by-guid/dg.TEST/3")
+	lookUpMultiPath(t, mounts, otherDomain+"/7/by-guid/dg.TEST/7")
+
+	// Tokens stay out of the log
+	log, err := ioutil.ReadFile(sidecar.gen3FuseConfig.LogFilePath)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(log), "token-")
+}
+
+func TestSidecarMountsCohorts(t *testing.T) {
+	commons := newFakeManifestService(t, "default")
+	sidecar, mounts := newTestSidecar(t, commons, newFakeWTS(t))
+	domain := strings.TrimPrefix(commons.URL, "http://")
+
+	commons.exportCohort("42")
+	sidecar.Poll(context.Background())
+	assert.Equal(t, []string{domain + "/manifest-42"}, mounts.Manifests())
+	lookUpMultiPath(t, mounts, domain+"/manifest-42/by-guid/dg.TEST/42")
+
+	// The PFB is mounted as is, and removed with the cohort
+	cohortPath := filepath.Join(sidecar.manifestDir, domain, "manifest-42.avro")
+	_, err := os.Stat(cohortPath)
+	assert.Nil(t, err)
+	for _, GUID := range []string{"43", "44"} {
+		commons.exportCohort(GUID)
+		sidecar.Poll(context.Background())
+	}
+	_, err = os.Stat(cohortPath)
+	assert.True(t, os.IsNotExist(err))
+
+	log, err := ioutil.ReadFile(sidecar.gen3FuseConfig.LogFilePath)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(log), "secret")
+}
@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatFSReportsMountedData(t *testing.T) {
+	fs := newTestFs(&Gen3FuseConfig{}, 0, withFiles(map[string]*FileInfo{
+		"dg.TEST/1": &FileInfo{DID: "dg.TEST/1", Filesize: 10 * 4096, URLs: []string{"s3://bucket/a/one.bam"}},
+		"dg.TEST/2": &FileInfo{DID: "dg.TEST/2", Filesize: 4096 + 1, URLs: []string{"s3://bucket/a/two.bam"}},
+	}))
+
+	op := &fuseops.StatFSOp{}
+	assert.Nil(t, fs.StatFS(context.Background(), op))
+	assert.Equal(t, uint32(4096), op.BlockSize)
+	assert.Equal(t, uint32(1024*1024), op.IoSize)
+	// each file is counted once, though it appears in four views
+	assert.Equal(t, uint64(12), op.Blocks)
+	assert.Equal(t, uint64(0), op.BlocksFree)
+	assert.Equal(t, uint64(0), op.BlocksAvailable)
+	// root, 4 views, by-guid/dg.TEST, by-filepath/a, by-subject/_unassigned,
+	// 2 files in each view, and .gen3fuse with its 4 files
+	assert.Equal(t, uint64(21), op.Inodes)
+	assert.Equal(t, uint64(0), op.InodesFree)
+
+	// a cache does not make room on the read-only data
+	cache, err := NewBlockCache(t.TempDir(), 5*4096, 4096)
+	assert.Nil(t, err)
+	fs.blockCache = cache
+
+	op = &fuseops.StatFSOp{}
+	assert.Nil(t, fs.StatFS(context.Background(), op))
+	assert.Equal(t, uint64(12), op.Blocks)
+	assert.Equal(t, uint64(0), op.BlocksFree)
+	assert.Equal(t, uint64(0), op.BlocksAvailable)
+}
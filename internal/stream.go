@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Forward seeks up to this size are served by discarding bytes from the open
+// response rather than reopening it
+const streamSkipLimit int64 = 256 * 1024
+
+// A stream that delivers no data for this long is closed. It is a variable
+// so that tests can shorten it.
+var streamReadTimeout = 60 * time.Second
+
+// ErrStreamStalled is returned by reads of a stream that was closed because
+// it delivered no data for streamReadTimeout
+var ErrStreamStalled = errors.New("the stream stalled")
+
+// dataClient is shared by every download so that connections to the storage
+// backends are kept alive between requests. There is no overall timeout, as
+// streams stay open for as long as a file is being read.
+var dataClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          256,
+		MaxIdleConnsPerHost:   64,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	},
+}
+
+// contentStream keeps a single open-ended ranged GET open for a file handle
+// and keeps reading from it for as long as reads stay contiguous. It is only
+// reopened when the reader seeks.
+type contentStream struct {
+	mu sync.Mutex
+
+	url string
+	// The offset of the next byte the open response will deliver
+	position int64
+	body     io.ReadCloser
+	reader   io.Reader
+	// The size of the object as reported by the server, or -1
+	total int64
+
+	lastUsed time.Time
+}
+
+// ReadAt reads size bytes at offset from the object at presignedUrl, stopping
+// early at the end of the file
+func (stream *contentStream) ReadAt(presignedUrl string, offset int64, size int64, fullsize int64) (byteContents []byte, err error) {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	stream.lastUsed = time.Now()
+
+	if offset+size > fullsize {
+		size = fullsize - offset
+	}
+	if size <= 0 {
+		return []byte{}, nil
+	}
+
+	// The object may turn out to be shorter than its indexed size
+	if stream.body != nil && stream.url == presignedUrl && stream.total >= 0 && offset >= stream.total {
+		return []byte{}, nil
+	}
+
+	gap := offset - stream.position
+	if stream.body == nil || stream.url != presignedUrl || gap < 0 || gap > streamSkipLimit {
+		err = stream.openLocked(presignedUrl, offset)
+		if err == io.EOF {
+			return []byte{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Reads that fail to make progress close the body, which unblocks them.
+	// They then fail with an error of the closed body, which is replaced by
+	// ErrStreamStalled so that the read is retried.
+	body := stream.body
+	var stalled int32
+	timer := time.AfterFunc(streamReadTimeout, func() {
+		atomic.StoreInt32(&stalled, 1)
+		body.Close()
+	})
+	defer timer.Stop()
+
+	if gap := offset - stream.position; gap > 0 {
+		skipped, err := io.CopyN(ioutil.Discard, stream.reader, gap)
+		stream.position += skipped
+		if err != nil {
+			stream.closeLocked()
+			if atomic.LoadInt32(&stalled) == 1 {
+				err = ErrStreamStalled
+			}
+			return nil, err
+		}
+	}
+
+	byteContents, err = readRangeBody(stream.reader, offset, size, stream.total)
+	stream.position += int64(len(byteContents))
+	if err != nil {
+		if atomic.LoadInt32(&stalled) == 1 {
+			err = ErrStreamStalled
+		}
+		FuseLog(fmt.Sprintf("Error reading stream of %v at offset %v: %v", stripQuery(presignedUrl), offset, err))
+		stream.closeLocked()
+		return nil, err
+	}
+	return byteContents, nil
+}
+
+// openLocked starts a new response at offset. It returns io.EOF if offset is
+// past the end of the object.
+func (stream *contentStream) openLocked(presignedUrl string, offset int64) error {
+	stream.closeLocked()
+
+	req, err := http.NewRequest("GET", presignedUrl, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+	resp, err := dataClient.Do(req)
+	if err != nil {
+		err = stripURLErrorQuery(err)
+		FuseLog(err.Error())
+		return err
+	}
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		resp.Body.Close()
+		FuseLog(fmt.Sprintf("Offset %v is past the end of %v", offset, stripQuery(presignedUrl)))
+		return io.EOF
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		return apiErrorFromResponse(resp, presignedUrl)
+	}
+
+	reader, total, err := rangeResponseBody(resp, presignedUrl, offset)
+	if err != nil {
+		resp.Body.Close()
+		FuseLog(err.Error())
+		return err
+	}
+
+	stream.url = presignedUrl
+	stream.position = offset
+	stream.body = resp.Body
+	stream.reader = reader
+	stream.total = total
+	return nil
+}
+
+func (stream *contentStream) closeLocked() {
+	if stream.body != nil {
+		stream.body.Close()
+		stream.body = nil
+		stream.reader = nil
+	}
+}
+
+// CloseIfIdle closes the stream if it has not been read from since idleSince.
+// A stream that is in the middle of a read is never idle.
+func (stream *contentStream) CloseIfIdle(idleSince time.Time) {
+	if !stream.mu.TryLock() {
+		return
+	}
+	defer stream.mu.Unlock()
+	if stream.body != nil && stream.lastUsed.Before(idleSince) {
+		stream.closeLocked()
+	}
+}
+
+// Close releases the connection held by the stream
+func (stream *contentStream) Close() {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	stream.closeLocked()
+}
@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadFileStreamsContiguousReadsOverOneRequest(t *testing.T) {
+	content := make([]byte, 1024*1024)
+	rand.Read(content)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	fs := newTestFs(&Gen3FuseConfig{}, len(content))
+	handle := openTestFile(fs, server.URL)
+	ctx := context.Background()
+
+	read := func(offset int64, size int) []byte {
+		op := &fuseops.ReadFileOp{Inode: testInode, Handle: handle, Offset: offset, Dst: make([]byte, size)}
+		assert.Nil(t, fs.ReadFile(ctx, op))
+		return op.Dst[:op.BytesRead]
+	}
+
+	for offset := int64(0); offset < 64*1024; offset += 4096 {
+		assert.Equal(t, content[offset:offset+4096], read(offset, 4096))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// a short forward seek skips ahead in the open response
+	assert.Equal(t, content[100000:104096], read(100000, 4096))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// seeking backwards reopens the stream
+	assert.Equal(t, content[10:4106], read(10, 4096))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// reading up to the end of the file
+	assert.Equal(t, content[len(content)-100:], read(int64(len(content)-100), 4096))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	// an idle stream is closed, and reopened when the file is read again
+	fs.handles.closeIdleStreams(time.Now())
+	assert.Equal(t, content[len(content)-50:], read(int64(len(content)-50), 4096))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&requests))
+
+	assert.Nil(t, fs.FlushFile(ctx, &fuseops.FlushFileOp{Inode: testInode, Handle: handle}))
+	assert.Nil(t, fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: handle}))
+	_, ok := fs.handles.Get(handle)
+	assert.False(t, ok)
+
+	// the handle cannot be used after it has been released
+	op := &fuseops.ReadFileOp{Inode: testInode, Handle: handle, Dst: make([]byte, 10)}
+	assert.NotNil(t, fs.ReadFile(ctx, op))
+}
+
+func TestReadFileRetriesStalledStreams(t *testing.T) {
+	streamReadTimeout = 100 * time.Millisecond
+	defer func() { streamReadTimeout = 60 * time.Second }()
+
+	content := make([]byte, 64*1024)
+	rand.Read(content)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) > 1 {
+			http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(content))
+			return
+		}
+		// The first response stops halfway through the body
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%v/%v", len(content)-1, len(content)))
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content[:len(content)/2])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	fs := newTestFs(&Gen3FuseConfig{RetryInitialBackoff: time.Millisecond}, len(content))
+	op := &fuseops.ReadFileOp{Inode: testInode, Handle: openTestFile(fs, server.URL), Dst: make([]byte, len(content))}
+	assert.Nil(t, fs.ReadFile(context.Background(), op))
+	assert.Equal(t, content, op.Dst[:op.BytesRead])
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Layouts of the timestamps in Indexd and DRS records. Indexd leaves out the
+// time zone, its times are in UTC.
+var recordTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+}
+
+func parseRecordTime(value string) (parsed time.Time, ok bool) {
+	for _, layout := range recordTimeLayouts {
+		parsed, err := time.ParseInLocation(layout, value, time.UTC)
+		if err == nil {
+			return parsed, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// setFileTimes stamps a file with the times of its record. A file that was
+// never updated keeps its creation time, and one without any times gets the
+// fallback.
+func setFileTimes(attributes *fuseops.InodeAttributes, record *FileInfo, fallback time.Time) {
+	created, createdOk := parseRecordTime(record.CreatedDate)
+	updated, updatedOk := parseRecordTime(record.UpdatedDate)
+	if !createdOk {
+		created = fallback
+		if updatedOk {
+			created = updated
+		}
+	}
+	if !updatedOk {
+		updated = created
+	}
+
+	attributes.Crtime = created
+	attributes.Mtime = updated
+	attributes.Ctime = updated
+	attributes.Atime = updated
+}
+
+// setDirectoryTimes stamps the directory at inodeID and every directory below
+// it with the latest modification time of the files they contain, or with
+// the fallback if they contain none. It returns the time given to inodeID.
+func setDirectoryTimes(inodes map[fuseops.InodeID]*inodeInfo, inodeID fuseops.InodeID, fallback time.Time) time.Time {
+	info := inodes[inodeID]
+	if !info.dir {
+		return info.attributes.Mtime
+	}
+
+	var latest time.Time
+	for _, child := range info.Children {
+		if childInfo, ok := inodes[child.Inode]; !ok || childInfo.control != "" {
+			continue
+		}
+		if childTime := setDirectoryTimes(inodes, child.Inode, fallback); childTime.After(latest) {
+			latest = childTime
+		}
+	}
+	if latest.IsZero() {
+		latest = fallback
+	}
+
+	info.attributes.Crtime = latest
+	info.attributes.Mtime = latest
+	info.attributes.Ctime = latest
+	info.attributes.Atime = latest
+	return latest
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRecordTime(t *testing.T) {
+	for value, expected := range map[string]time.Time{
+		"2020-03-04T19:18:20.712640":   time.Date(2020, 3, 4, 19, 18, 20, 712640000, time.UTC),
+		"2020-03-04T19:18:20":          time.Date(2020, 3, 4, 19, 18, 20, 0, time.UTC),
+		"2020-03-04 19:18:20.5":        time.Date(2020, 3, 4, 19, 18, 20, 500000000, time.UTC),
+		"2020-03-04T19:18:20Z":         time.Date(2020, 3, 4, 19, 18, 20, 0, time.UTC),
+		"2020-03-04T21:18:20.25+02:00": time.Date(2020, 3, 4, 19, 18, 20, 250000000, time.UTC),
+	} {
+		parsed, ok := parseRecordTime(value)
+		assert.True(t, ok, value)
+		assert.True(t, expected.Equal(parsed), value)
+	}
+
+	for _, value := range []string{"", "yesterday", "2020-03-04"} {
+		_, ok := parseRecordTime(value)
+		assert.False(t, ok, value)
+	}
+}
+
+func TestInodeTimesComeFromRecords(t *testing.T) {
+	created := time.Date(2020, 3, 4, 19, 18, 20, 0, time.UTC)
+	updated := time.Date(2021, 5, 6, 7, 8, 9, 0, time.UTC)
+	newer := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	before := time.Now()
+	fs := newTestFs(&Gen3FuseConfig{}, 0, withFiles(map[string]*FileInfo{
+		"dg.TEST/1": &FileInfo{
+			DID:         "dg.TEST/1",
+			URLs:        []string{"s3://bucket/old/one.bam"},
+			CreatedDate: "2020-03-04T19:18:20",
+			UpdatedDate: "2021-05-06T07:08:09",
+		},
+		"dg.TEST/2": &FileInfo{
+			DID:         "dg.TEST/2",
+			URLs:        []string{"s3://bucket/new/two.bam"},
+			CreatedDate: "2022-01-01T00:00:00Z",
+		},
+		"dg.TEST/3": &FileInfo{
+			DID:  "dg.TEST/3",
+			URLs: []string{"s3://bucket/new/three.bam"},
+		},
+	}))
+	after := time.Now()
+
+	attributes := func(path string) fuseops.InodeAttributes {
+		op := &fuseops.GetInodeAttributesOp{Inode: lookUpPath(t, fs, path)}
+		assert.Nil(t, fs.GetInodeAttributes(context.Background(), op))
+		return op.Attributes
+	}
+
+	one := attributes("by-filename/one.bam")
+	assert.Equal(t, created, one.Crtime)
+	assert.Equal(t, updated, one.Mtime)
+	assert.Equal(t, updated, one.Ctime)
+
+	// a record that was never updated keeps its creation time
+	two := attributes("by-filepath/new/two.bam")
+	assert.Equal(t, newer, two.Crtime)
+	assert.Equal(t, newer, two.Mtime)
+
+	// a record without times gets the mount time
+	three := attributes("by-guid/dg.TEST/3")
+	assert.False(t, three.Mtime.Before(before))
+	assert.False(t, three.Mtime.After(after))
+
+	// times do not change from one lookup to the next
+	time.Sleep(time.Millisecond)
+	assert.Equal(t, one, attributes("by-filename/one.bam"))
+	assert.Equal(t, three, attributes("by-guid/dg.TEST/3"))
+
+	// directories get the time of their latest file
+	assert.Equal(t, updated, attributes("by-filepath/old").Mtime)
+	assert.Equal(t, three.Mtime, attributes("by-filepath/new").Mtime)
+	assert.Equal(t, three.Mtime, attributes("by-filepath").Mtime)
+}
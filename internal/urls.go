@@ -0,0 +1,222 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPresignedURLExpiresIn = 15 * time.Minute
+
+	// URLs are refreshed this long before they expire, or after four fifths of
+	// their lifetime for URLs that live less than five times as long
+	urlRefreshMargin = time.Minute
+)
+
+// presignedURL is a signed URL along with the time it stops working
+type presignedURL struct {
+	URL     string
+	Issued  time.Time
+	Expires time.Time
+}
+
+// stripQuery leaves the query out of a URL, which holds the signature of
+// presigned URLs, so that the URL can be logged. The log can be read by the
+// workspace user.
+func stripQuery(rawURL string) string {
+	if i := strings.Index(rawURL, "?"); i >= 0 {
+		return rawURL[:i]
+	}
+	return rawURL
+}
+
+// stripURLErrorQuery leaves the query out of the URL of the url.Error the
+// HTTP client returns, which repeats the URL it was asked for
+func stripURLErrorQuery(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = stripQuery(urlErr.URL)
+	}
+	return err
+}
+
+// newPresignedURL works out when a URL issued at the given time expires. The
+// signature's own expiry is used when the URL carries one, capped at the
+// lifetime that was asked for.
+func newPresignedURL(signedUrl string, issued time.Time, expiresIn time.Duration) *presignedURL {
+	expires := issued.Add(expiresIn)
+	if signed, ok := signedURLExpiry(signedUrl); ok && signed.Before(expires) {
+		expires = signed
+	}
+	return &presignedURL{URL: signedUrl, Issued: issued, Expires: expires}
+}
+
+// signedURLExpiry reads the expiry of an AWS or GCS V4 signed URL from its
+// X-Amz-Date/X-Amz-Expires or X-Goog-Date/X-Goog-Expires query parameters
+func signedURLExpiry(signedUrl string) (expires time.Time, ok bool) {
+	parsed, err := url.Parse(signedUrl)
+	if err != nil {
+		return time.Time{}, false
+	}
+	query := parsed.Query()
+	for _, prefix := range []string{"X-Amz-", "X-Goog-"} {
+		date, err := time.Parse("20060102T150405Z", query.Get(prefix+"Date"))
+		if err != nil {
+			continue
+		}
+		seconds, err := strconv.ParseInt(query.Get(prefix+"Expires"), 10, 64)
+		if err != nil {
+			continue
+		}
+		return date.Add(time.Duration(seconds) * time.Second), true
+	}
+	return time.Time{}, false
+}
+
+// refreshAt is the time after which the URL should no longer be handed out
+func (u *presignedURL) refreshAt() time.Time {
+	margin := urlRefreshMargin
+	if lifetime := u.Expires.Sub(u.Issued); lifetime < 5*margin {
+		margin = lifetime / 5
+	}
+	return u.Expires.Add(-margin)
+}
+
+func (u *presignedURL) Fresh(now time.Time) bool {
+	return now.Before(u.refreshAt())
+}
+
+// urlRefreshInterval is how often the URLs of open files are checked, which
+// is often enough to replace each of them before it is due for a refresh
+func urlRefreshInterval(expiresIn time.Duration) time.Duration {
+	margin := urlRefreshMargin
+	if expiresIn < 5*margin {
+		margin = expiresIn / 5
+	}
+	return margin / 2
+}
+
+// urlManager hands out presigned URLs by DID. URLs are reused until shortly
+// before they expire, and concurrent requests for the same DID share a
+// single call to Fence. URLs are forgotten once no file that uses them is
+// open and they are due for a refresh.
+type urlManager struct {
+	fetch     func(info *inodeInfo) (string, error)
+	expiresIn time.Duration
+
+	mu       sync.Mutex
+	urls     map[string]*presignedURL
+	inflight map[string]*urlRequest
+}
+
+type urlRequest struct {
+	// closed once url and err are set
+	done chan struct{}
+	url  *presignedURL
+	err  error
+}
+
+// presignedURLExpiresIn is the lifetime to ask Fence for
+func presignedURLExpiresIn(gen3FuseConfig *Gen3FuseConfig) time.Duration {
+	if gen3FuseConfig.PresignedURLExpiresIn < time.Second {
+		return DefaultPresignedURLExpiresIn
+	}
+	return gen3FuseConfig.PresignedURLExpiresIn
+}
+
+func newURLManager(fetch func(info *inodeInfo) (string, error), expiresIn time.Duration) *urlManager {
+	return &urlManager{
+		fetch:     fetch,
+		expiresIn: expiresIn,
+		urls:      make(map[string]*presignedURL),
+		inflight:  make(map[string]*urlRequest),
+	}
+}
+
+// Get returns a URL for the file that is good for a while yet
+func (manager *urlManager) Get(info *inodeInfo) (*presignedURL, error) {
+	return manager.Renew(info, time.Now())
+}
+
+// Renew returns a URL for the file that is still fresh at the given time,
+// getting a new one ahead of time if needed
+func (manager *urlManager) Renew(info *inodeInfo, at time.Time) (*presignedURL, error) {
+	manager.mu.Lock()
+	if cached, ok := manager.urls[info.DID]; ok && cached.Fresh(at) {
+		manager.mu.Unlock()
+		return cached, nil
+	}
+	return manager.requestLocked(info)
+}
+
+// Refresh replaces a URL that the storage backend rejected. If another
+// operation has already replaced it, the newer URL is returned right away.
+func (manager *urlManager) Refresh(info *inodeInfo, rejected string) (*presignedURL, error) {
+	manager.mu.Lock()
+	if cached, ok := manager.urls[info.DID]; ok && cached.URL != rejected && cached.Fresh(time.Now()) {
+		manager.mu.Unlock()
+		return cached, nil
+	}
+	delete(manager.urls, info.DID)
+	return manager.requestLocked(info)
+}
+
+// Forget drops the URL of a file once its last handle is closed
+func (manager *urlManager) Forget(DID string) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	delete(manager.urls, DID)
+}
+
+// Prune drops the URLs that are due for a refresh, except for those of open
+// files, which are refreshed instead. They are left behind by lookups of the
+// presigned URL attribute, which do not open the file.
+func (manager *urlManager) Prune(open map[string]bool, now time.Time) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	for DID, url := range manager.urls {
+		if !open[DID] && !url.Fresh(now) {
+			delete(manager.urls, DID)
+		}
+	}
+}
+
+// requestLocked fetches a new URL, or waits for the request already in flight
+// for the same DID. It is called with mu held and releases it.
+func (manager *urlManager) requestLocked(info *inodeInfo) (*presignedURL, error) {
+	if request, ok := manager.inflight[info.DID]; ok {
+		manager.mu.Unlock()
+		<-request.done
+		return request.url, request.err
+	}
+	request := &urlRequest{done: make(chan struct{})}
+	manager.inflight[info.DID] = request
+	manager.mu.Unlock()
+
+	manager.run(info, request)
+	return request.url, request.err
+}
+
+func (manager *urlManager) run(info *inodeInfo, request *urlRequest) {
+	issued := time.Now()
+	signedUrl, err := manager.fetch(info)
+	if err == nil && len(signedUrl) < 3 {
+		err = fmt.Errorf("could not obtain a presigned URL for %v", info.DID)
+	}
+
+	manager.mu.Lock()
+	if err == nil {
+		request.url = newPresignedURL(signedUrl, issued, manager.expiresIn)
+		manager.urls[info.DID] = request.url
+		FuseLog(fmt.Sprintf("Got a presigned URL for %v, expiring at %v", info.DID, request.url.Expires.Format(time.RFC3339)))
+	}
+	request.err = err
+	delete(manager.inflight, info.DID)
+	manager.mu.Unlock()
+	close(request.done)
+}
@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignedURLExpiry(t *testing.T) {
+	expires, ok := signedURLExpiry("https://bucket.s3.amazonaws.com/key?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Date=20240102T030405Z&X-Amz-Expires=900&X-Amz-Signature=abc")
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2024, 1, 2, 3, 19, 5, 0, time.UTC), expires)
+
+	expires, ok = signedURLExpiry("https://storage.googleapis.com/bucket/key?X-Goog-Algorithm=GOOG4-RSA-SHA256&X-Goog-Date=20240102T030405Z&X-Goog-Expires=3600")
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2024, 1, 2, 4, 4, 5, 0, time.UTC), expires)
+
+	for _, signedUrl := range []string{
+		"https://example.com/key",
+		"https://example.com/key?X-Amz-Date=20240102T030405Z",
+		"https://example.com/key?X-Amz-Date=yesterday&X-Amz-Expires=900",
+		"%zz",
+	} {
+		_, ok = signedURLExpiry(signedUrl)
+		assert.False(t, ok, signedUrl)
+	}
+}
+
+func TestNewPresignedURL(t *testing.T) {
+	issued := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// without a signed expiry, the URL lives as long as was asked for
+	url := newPresignedURL("https://example.com/key", issued, 15*time.Minute)
+	assert.Equal(t, issued.Add(15*time.Minute), url.Expires)
+	assert.True(t, url.Fresh(issued.Add(13*time.Minute)))
+	assert.False(t, url.Fresh(issued.Add(14*time.Minute)))
+
+	// a signature that expires sooner wins
+	url = newPresignedURL("https://example.com/key?X-Amz-Date=20240102T030405Z&X-Amz-Expires=60", issued, 15*time.Minute)
+	assert.Equal(t, issued.Add(time.Minute), url.Expires)
+	assert.True(t, url.Fresh(issued.Add(47*time.Second)))
+	assert.False(t, url.Fresh(issued.Add(49*time.Second)))
+
+	// but not one that claims to live longer
+	url = newPresignedURL("https://example.com/key?X-Amz-Date=20240102T030405Z&X-Amz-Expires=86400", issued, 15*time.Minute)
+	assert.Equal(t, issued.Add(15*time.Minute), url.Expires)
+}
+
+func TestURLManagerDeduplicatesConcurrentRequests(t *testing.T) {
+	var requests int32
+	manager := newURLManager(func(info *inodeInfo) (string, error) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(20 * time.Millisecond)
+		return "https://example.com/" + info.DID, nil
+	}, time.Hour)
+
+	info := &inodeInfo{DID: "did"}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			url, err := manager.Get(info)
+			assert.Nil(t, err)
+			assert.Equal(t, "https://example.com/did", url.URL)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// other files get their own URL
+	_, err := manager.Get(&inodeInfo{DID: "other"})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestURLManagerRefresh(t *testing.T) {
+	var requests int32
+	manager := newURLManager(func(info *inodeInfo) (string, error) {
+		n := atomic.AddInt32(&requests, 1)
+		if n == 3 {
+			return "", errors.New("fence is down")
+		}
+		return "https://example.com/" + string(rune('a'+n)), nil
+	}, time.Hour)
+	info := &inodeInfo{DID: "did"}
+
+	first, err := manager.Get(info)
+	assert.Nil(t, err)
+
+	// a rejected URL is replaced, once, however many readers saw it rejected
+	second, err := manager.Refresh(info, first.URL)
+	assert.Nil(t, err)
+	assert.NotEqual(t, first.URL, second.URL)
+	again, err := manager.Refresh(info, first.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, second, again)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// failures are not cached
+	_, err = manager.Refresh(info, second.URL)
+	assert.NotNil(t, err)
+	third, err := manager.Get(info)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&requests))
+	assert.NotEqual(t, second.URL, third.URL)
+}
+
+func TestURLsOfOpenFilesAreRefreshedAheadOfTime(t *testing.T) {
+	var requests int32
+	fs := newTestFs(&Gen3FuseConfig{}, 10)
+	fs.urls = newURLManager(func(info *inodeInfo) (string, error) {
+		n := atomic.AddInt32(&requests, 1)
+		return "https://example.com/" + string(rune('a'+n)), nil
+	}, time.Hour)
+	info := fs.inodes[testInode]
+
+	url, err := fs.urls.Get(info)
+	assert.Nil(t, err)
+	handle := fs.openHandle(testInode, info, url)
+	openHandle, _ := fs.handles.Get(handle)
+
+	// nothing to do while the URL is good for a while yet
+	fs.refreshURLs(time.Now(), time.Minute)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// a handle that is not read from gets a new URL before its current one
+	// is due for a refresh
+	fs.refreshURLs(time.Now().Add(58*time.Minute+30*time.Second), time.Minute)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	assert.NotEqual(t, url.URL, openHandle.URL().URL)
+}
+
+func TestURLsAreForgottenWhenNoLongerNeeded(t *testing.T) {
+	fs := newTestFs(&Gen3FuseConfig{}, 10)
+	fs.urls = newURLManager(func(info *inodeInfo) (string, error) {
+		return "https://example.com/" + info.DID, nil
+	}, time.Hour)
+	info := fs.inodes[testInode]
+
+	url, err := fs.urls.Get(info)
+	assert.Nil(t, err)
+	first := fs.openHandle(testInode, info, url)
+	second := fs.openHandle(testInode, info, url)
+
+	// the URL of an open file is kept, even once it is due for a refresh
+	_, err = fs.urls.Get(&inodeInfo{DID: "other"})
+	assert.Nil(t, err)
+	fs.urls.Prune(fs.handles.openDIDs(), time.Now().Add(2*time.Hour))
+	assert.Equal(t, []string{"did"}, urlDIDs(fs.urls))
+
+	// and dropped when the last handle is closed
+	fs.releaseHandle(first)
+	assert.Equal(t, []string{"did"}, urlDIDs(fs.urls))
+	fs.releaseHandle(second)
+	assert.Empty(t, urlDIDs(fs.urls))
+}
+
+func urlDIDs(manager *urlManager) (DIDs []string) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	for DID := range manager.urls {
+		DIDs = append(DIDs, DID)
+	}
+	return DIDs
+}
+
+// The log can be read by the workspace user, so the signatures of presigned
+// URLs are left out of it
+func TestPresignedURLSignaturesAreNotLogged(t *testing.T) {
+	logFilePath := LogFilePath
+	t.Cleanup(func() { LogFilePath = logFilePath })
+	LogFilePath = filepath.Join(t.TempDir(), "fuse_log.txt")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	defer server.Close()
+
+	fs := newTestFs(&Gen3FuseConfig{RetryMaxAttempts: 2, RetryInitialBackoff: time.Millisecond}, 10)
+	for _, url := range []string{server.URL, closed.URL, "ftp://example.org"} {
+		handle := openTestFile(fs, url+"/object?X-Amz-Signature=secret")
+		op := &fuseops.ReadFileOp{Inode: testInode, Handle: handle, Dst: make([]byte, 10)}
+		assert.NotNil(t, fs.ReadFile(context.Background(), op), url)
+	}
+
+	log, err := ioutil.ReadFile(LogFilePath)
+	assert.Nil(t, err)
+	assert.Contains(t, string(log), "/object")
+	assert.NotContains(t, string(log), "secret")
+	assert.Equal(t, "Fail to fetch https://example.org/object, status code: 403",
+		(&APIError{URL: "https://example.org/object?X-Amz-Signature=secret", StatusCode: 403}).Error())
+}
@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ViewConfig describes a top-level directory laid out by a path template,
+// such as "{subject_id}/{data_format}/{file_name}". Each component of the
+// template mixes text with fields between braces.
+type ViewConfig struct {
+	Name string `yaml:"Name"`
+	Path string `yaml:"Path"`
+}
+
+// Directory holding the files with no value for a field used in a view.
+// Values that would be taken for it are escaped, see escapeUnassigned.
+const unassignedDir = "_unassigned"
+
+// Top-level directories that views cannot be named after
+var builtInViews = []string{"by-guid", "by-filename", "by-filepath", "by-subject", controlDirName}
+
+// by-subject is a view like those of the config
+var bySubjectView = ViewConfig{Name: "by-subject", Path: "{subject_id}/{file_name}"}
+
+// The fields path templates can use, and how to read them from a file
+var templateFields = map[string]func(fileInfo *FileInfo, filename string) string{
+	"did": func(fileInfo *FileInfo, filename string) string { return fileInfo.DID },
+	"guid": func(fileInfo *FileInfo, filename string) string {
+		return fileInfo.DID[strings.LastIndex(fileInfo.DID, "/")+1:]
+	},
+	"file_name": func(fileInfo *FileInfo, filename string) string { return filename },
+	"file_size": func(fileInfo *FileInfo, filename string) string {
+		return strconv.FormatUint(fileInfo.Filesize, 10)
+	},
+	"md5":         func(fileInfo *FileInfo, filename string) string { return fileInfo.Hashes["md5"] },
+	"commons":     func(fileInfo *FileInfo, filename string) string { return fileInfo.CommonsHostname },
+	"subject_id":  func(fileInfo *FileInfo, filename string) string { return fileInfo.SubjectId },
+	"uuid":        func(fileInfo *FileInfo, filename string) string { return fileInfo.Manifest.Uuid },
+	"data_format": func(fileInfo *FileInfo, filename string) string { return fileInfo.Manifest.DataFormat },
+	"data_type":   func(fileInfo *FileInfo, filename string) string { return fileInfo.Manifest.DataType },
+	"submitter_id": func(fileInfo *FileInfo, filename string) string {
+		return fileInfo.Manifest.SubmitterId
+	},
+	"program": func(fileInfo *FileInfo, filename string) string {
+		program, _ := authzProject(fileInfo.Authz)
+		return program
+	},
+	"project": func(fileInfo *FileInfo, filename string) string {
+		if fileInfo.Manifest.ProjectId != "" {
+			return fileInfo.Manifest.ProjectId
+		}
+		if program, project := authzProject(fileInfo.Authz); project != "" {
+			return program + "-" + project
+		}
+		return ""
+	},
+}
+
+// authzProject finds the program and project in an authz resource such as
+// /programs/P/projects/Q
+func authzProject(authz []string) (program string, project string) {
+	for _, resource := range authz {
+		parts := strings.Split(strings.Trim(resource, "/"), "/")
+		if len(parts) >= 2 && parts[0] == "programs" {
+			program = parts[1]
+			if len(parts) >= 4 && parts[2] == "projects" {
+				project = parts[3]
+			}
+			return program, project
+		}
+	}
+	return "", ""
+}
+
+// pathTemplate is a parsed ViewConfig.Path: for each path component, the
+// pieces of text and the fields between them
+type pathTemplate struct {
+	components [][]templatePiece
+}
+
+type templatePiece struct {
+	text  string
+	field string
+}
+
+func knownTemplateFields() string {
+	names := make([]string, 0, len(templateFields))
+	for name := range templateFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// parsePathTemplate checks a view's template and splits it into pieces
+func parsePathTemplate(view ViewConfig) (*pathTemplate, error) {
+	template := &pathTemplate{}
+	for _, component := range strings.Split(strings.Trim(view.Path, "/"), "/") {
+		if component == "" {
+			return nil, fmt.Errorf("View %q: the path template %q has an empty component", view.Name, view.Path)
+		}
+		var pieces []templatePiece
+		for rest := component; rest != ""; {
+			open := strings.IndexAny(rest, "{}")
+			if open < 0 {
+				pieces = append(pieces, templatePiece{text: rest})
+				break
+			}
+			if rest[open] == '}' {
+				return nil, fmt.Errorf("View %q: unexpected } in the path template %q", view.Name, view.Path)
+			}
+			if open > 0 {
+				pieces = append(pieces, templatePiece{text: rest[:open]})
+			}
+			end := strings.IndexAny(rest[open+1:], "{}")
+			if end < 0 || rest[open+1+end] != '}' {
+				return nil, fmt.Errorf("View %q: unclosed { in the path template %q", view.Name, view.Path)
+			}
+			field := rest[open+1 : open+1+end]
+			if _, ok := templateFields[field]; !ok {
+				return nil, fmt.Errorf("View %q: unknown field {%v} in the path template %q, expected one of %v", view.Name, field, view.Path, knownTemplateFields())
+			}
+			pieces = append(pieces, templatePiece{field: field})
+			rest = rest[open+end+2:]
+		}
+		template.components = append(template.components, pieces)
+	}
+	return template, nil
+}
+
+// parseViews checks the views of the config, returning their templates in
+// the same order
+func parseViews(views []ViewConfig) ([]*pathTemplate, error) {
+	names := make(map[string]bool)
+	for _, name := range builtInViews {
+		names[name] = true
+	}
+
+	templates := make([]*pathTemplate, len(views))
+	for i, view := range views {
+		if view.Name == "" || sanitizeName(view.Name) != view.Name {
+			return nil, fmt.Errorf("Invalid view name %q", view.Name)
+		}
+		if names[view.Name] {
+			return nil, fmt.Errorf("There is already a view named %q", view.Name)
+		}
+		names[view.Name] = true
+
+		template, err := parsePathTemplate(view)
+		if err != nil {
+			return nil, err
+		}
+		templates[i] = template
+	}
+	return templates, nil
+}
+
+// Expand gives the path of a file in the view. Values holding a / do not
+// add components, and components whose fields all have no value become
+// unassignedDir, which no value can expand to.
+func (template *pathTemplate) Expand(fileInfo *FileInfo, filename string) []string {
+	paths := make([]string, len(template.components))
+	for i, pieces := range template.components {
+		var component strings.Builder
+		empty := hasField(pieces)
+		for _, piece := range pieces {
+			if piece.field == "" {
+				component.WriteString(piece.text)
+				continue
+			}
+			if value := templateFields[piece.field](fileInfo, filename); value != "" {
+				component.WriteString(value)
+				empty = false
+			}
+		}
+		paths[i] = escapeUnassigned(sanitizeName(component.String()))
+		if empty {
+			paths[i] = unassignedDir
+		}
+	}
+	return paths
+}
+
+// escapeUnassigned adds an underscore in front of the names made of
+// underscores followed by unassignedDir, so that a subject named
+// "_unassigned" gets a directory of its own, "__unassigned", and so on
+func escapeUnassigned(name string) string {
+	if strings.HasSuffix(name, unassignedDir) && strings.Trim(strings.TrimSuffix(name, unassignedDir), "_") == "" {
+		return truncateName("_"+name, "")
+	}
+	return name
+}
+
+func hasField(pieces []templatePiece) bool {
+	for _, piece := range pieces {
+		if piece.field != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+)
+
+// viewsTestFiles are two files, only one of which has a name in the manifest
+func viewsTestFiles() map[string]*FileInfo {
+	return map[string]*FileInfo{
+		"dg.TEST/1": &FileInfo{
+			Filename: "sample.bam",
+			Filesize: 1000,
+			DID:      "dg.TEST/1",
+			URLs:     []string{"s3://bucket/dir/sample.bam"},
+		},
+		"dg.TEST/2": &FileInfo{
+			Filesize: 24,
+			DID:      "dg.TEST/2",
+			URLs:     []string{"s3://bucket/dir/other.bam"},
+		},
+	}
+}
+
+func TestSymlinkSecondaryViews(t *testing.T) {
+	fs := newTestFs(&Gen3FuseConfig{SecondaryViews: SecondaryViewsSymlinks}, 0, withFiles(viewsTestFiles()))
+	guidInode := lookUpPath(t, fs, "by-guid/dg.TEST/1")
+
+	for _, link := range []string{"by-filename/sample.bam", "by-filepath/dir/sample.bam"} {
+		inode := lookUpPath(t, fs, link)
+		assert.NotEqual(t, guidInode, inode)
+
+		attrs := &fuseops.GetInodeAttributesOp{Inode: inode}
+		assert.Nil(t, fs.GetInodeAttributes(context.Background(), attrs))
+		assert.Equal(t, os.ModeSymlink, attrs.Attributes.Mode&os.ModeSymlink)
+
+		op := &fuseops.ReadSymlinkOp{Inode: inode}
+		assert.Nil(t, fs.ReadSymlink(context.Background(), op))
+		assert.Equal(t, uint64(len(op.Target)), attrs.Attributes.Size)
+		assert.Equal(t, guidInode, lookUpPath(t, fs, path.Join(path.Dir(link), op.Target)), link)
+	}
+
+	op := &fuseops.ReadSymlinkOp{Inode: guidInode}
+	assert.Equal(t, fuse.EINVAL, fs.ReadSymlink(context.Background(), op))
+
+	// Symlinks are not files of their own
+	statfs := &fuseops.StatFSOp{}
+	assert.Nil(t, fs.StatFS(context.Background(), statfs))
+	assert.Equal(t, uint64(1), statfs.Blocks)
+	count, size := fs.directoryTotals(fs.inodes[lookUpPath(t, fs, "by-filename")])
+	assert.Equal(t, 2, count)
+	assert.Equal(t, uint64(1024), size)
+}
+
+func TestHardlinkSecondaryViews(t *testing.T) {
+	fs := newTestFs(&Gen3FuseConfig{SecondaryViews: SecondaryViewsHardlinks}, 0, withFiles(viewsTestFiles()))
+	guidInode := lookUpPath(t, fs, "by-guid/dg.TEST/1")
+	assert.Equal(t, guidInode, lookUpPath(t, fs, "by-filename/sample.bam"))
+	assert.Equal(t, guidInode, lookUpPath(t, fs, "by-filepath/dir/sample.bam"))
+	assert.Equal(t, lookUpPath(t, fs, "by-guid/dg.TEST/2"), lookUpPath(t, fs, "by-filename/other.bam"))
+
+	attrs := &fuseops.GetInodeAttributesOp{Inode: guidInode}
+	assert.Nil(t, fs.GetInodeAttributes(context.Background(), attrs))
+	// by-guid, by-filename, by-filepath and by-subject
+	assert.Equal(t, uint32(4), attrs.Attributes.Nlink)
+	assert.Equal(t, uint64(1000), attrs.Attributes.Size)
+}
+
+func TestCopySecondaryViews(t *testing.T) {
+	for _, secondaryViews := range []string{"", SecondaryViewsCopies} {
+		fs := newTestFs(&Gen3FuseConfig{SecondaryViews: secondaryViews}, 0, withFiles(viewsTestFiles()))
+		guidInode := lookUpPath(t, fs, "by-guid/dg.TEST/1")
+		assert.NotEqual(t, guidInode, lookUpPath(t, fs, "by-filename/sample.bam"))
+		assert.NotEqual(t, guidInode, lookUpPath(t, fs, "by-filepath/dir/sample.bam"))
+	}
+}
+
+func TestBySubjectView(t *testing.T) {
+	config := &Gen3FuseConfig{}
+	fs := newTestFs(config, 0, withFiles(map[string]*FileInfo{
+		"dg.TEST/1": &FileInfo{DID: "dg.TEST/1", SubjectId: "10", URLs: []string{"s3://bucket/a/sample.bam"}},
+		"dg.TEST/2": &FileInfo{DID: "dg.TEST/2", SubjectId: "10", URLs: []string{"s3://bucket/b/sample.bam"}},
+		"dg.TEST/3": &FileInfo{DID: "dg.TEST/3", SubjectId: "11/x", Filename: "notes.txt", URLs: []string{"s3://bucket/notes.txt"}},
+		"dg.TEST/4": &FileInfo{DID: "dg.TEST/4", URLs: []string{"s3://bucket/orphan.bam"}},
+		"dg.TEST/5": &FileInfo{DID: "dg.TEST/5", SubjectId: "_unassigned", URLs: []string{"s3://bucket/named.bam"}},
+		"dg.TEST/6": &FileInfo{DID: "dg.TEST/6", SubjectId: "__unassigned", URLs: []string{"s3://bucket/escaped.bam"}},
+	}))
+
+	names := func(path string) []string {
+		var names []string
+		for _, child := range fs.inodes[lookUpPath(t, fs, path)].Children {
+			names = append(names, child.Name)
+		}
+		return names
+	}
+	assert.ElementsMatch(t, []string{"10", "11_x", "_unassigned", "__unassigned", "___unassigned"}, names("by-subject"))
+	assert.ElementsMatch(t, []string{"sample.bam", "sample_2.bam"}, names("by-subject/10"))
+	assert.Equal(t, []string{"notes.txt"}, names("by-subject/11_x"))
+	assert.Equal(t, []string{"orphan.bam"}, names("by-subject/_unassigned"))
+
+	// subjects named like the directory of files without one are kept apart
+	assert.Equal(t, []string{"named.bam"}, names("by-subject/__unassigned"))
+	assert.Equal(t, []string{"escaped.bam"}, names("by-subject/___unassigned"))
+}
+
+func TestTemplateViews(t *testing.T) {
+	config := &Gen3FuseConfig{Views: []ViewConfig{
+		{Name: "by-format", Path: "{subject_id}/{data_format}/{file_name}"},
+		{Name: "by-project", Path: "/{project}/{did}/"},
+		{Name: "sized", Path: "size_{file_size}/{guid}.bin"},
+	}}
+	fs := newTestFs(config, 0, withFiles(map[string]*FileInfo{
+		"dg.TEST/1": &FileInfo{
+			DID:       "dg.TEST/1",
+			Filesize:  10,
+			SubjectId: "10",
+			Authz:     []string{"/programs/prog/projects/proj"},
+			Manifest:  ManifestRecord{DataFormat: "BAM"},
+			URLs:      []string{"s3://bucket/a/sample.bam"},
+		},
+		"dg.TEST/2": &FileInfo{
+			DID:      "dg.TEST/2",
+			Filesize: 20,
+			Manifest: ManifestRecord{ProjectId: "other-proj"},
+			URLs:     []string{"s3://bucket/b/sample.vcf"},
+		},
+	}))
+
+	guidInode := lookUpPath(t, fs, "by-guid/dg.TEST/1")
+	assert.NotEqual(t, guidInode, lookUpPath(t, fs, "by-format/10/BAM/sample.bam"))
+	lookUpPath(t, fs, "by-format/_unassigned/_unassigned/sample.vcf")
+	lookUpPath(t, fs, "by-project/prog-proj/dg.TEST_1")
+	lookUpPath(t, fs, "by-project/other-proj/dg.TEST_2")
+	lookUpPath(t, fs, "sized/size_10/1.bin")
+	lookUpPath(t, fs, "sized/size_20/2.bin")
+}
+
+func TestParseViewsErrors(t *testing.T) {
+	_, err := parseViews([]ViewConfig{{Name: "ok", Path: "{subject_id}/prefix_{file_name}"}})
+	assert.Nil(t, err)
+
+	for _, views := range [][]ViewConfig{
+		{{Name: "v", Path: "{subject}/{file_name}"}},
+		{{Name: "v", Path: "{subject_id/{file_name}"}},
+		{{Name: "v", Path: "subject_id}/{file_name}"}},
+		{{Name: "v", Path: "a//{file_name}"}},
+		{{Name: "by-guid", Path: "{file_name}"}},
+		{{Name: "v", Path: "{did}"}, {Name: "v", Path: "{guid}"}},
+		{{Name: "a/b", Path: "{did}"}},
+		{{Name: "", Path: "{did}"}},
+	} {
+		_, err := parseViews(views)
+		assert.NotNil(t, err, "%v", views)
+	}
+
+	_, err = parseViews([]ViewConfig{{Name: "v", Path: "{subject}/{file_name}"}})
+	assert.Contains(t, err.Error(), `unknown field {subject} in the path template "{subject}/{file_name}"`)
+}
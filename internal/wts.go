@@ -35,6 +35,67 @@ type Gen3FuseConfig struct {
 
 	// An optional parameter the user can provide to talk to WTS from outside the k8s cluster
 	AccessToken string
+
+	// Local block cache configuration. File contents are only cached if CacheDir is set.
+	CacheDir       string `yaml:"CacheDir"`
+	CacheMaxBytes  int64  `yaml:"CacheMaxBytes"`
+	CacheBlockSize int64  `yaml:"CacheBlockSize"`
+
+	// Read-ahead configuration for sequential readers, in bytes. Zero values fall back to the defaults.
+	DisableReadAhead   bool  `yaml:"DisableReadAhead"`
+	ReadAheadMinWindow int64 `yaml:"ReadAheadMinWindow"`
+	ReadAheadMaxWindow int64 `yaml:"ReadAheadMaxWindow"`
+	ReadAheadMaxMemory int64 `yaml:"ReadAheadMaxMemory"`
+
+	// Large downloads are split into chunks of DownloadChunkSize bytes that are
+	// fetched over DownloadConnections parallel connections
+	DownloadConnections int   `yaml:"DownloadConnections"`
+	DownloadChunkSize   int64 `yaml:"DownloadChunkSize"`
+
+	// Retry policy for failed downloads. Durations are given as strings such as "500ms".
+	RetryMaxAttempts    int           `yaml:"RetryMaxAttempts"`
+	RetryInitialBackoff time.Duration `yaml:"RetryInitialBackoff"`
+	RetryMaxBackoff     time.Duration `yaml:"RetryMaxBackoff"`
+	RetryDeadline       time.Duration `yaml:"RetryDeadline"`
+
+	// Lifetime of the presigned URLs requested from Fence, such as "15m"
+	PresignedURLExpiresIn time.Duration `yaml:"PresignedURLExpiresIn"`
+
+	// What to do when a file read from start to end does not match its hash:
+	// "off", "warn" or "enforce"
+	ChecksumPolicy string `yaml:"ChecksumPolicy"`
+
+	// How by-filename and by-filepath refer to the files in by-guid:
+	// "copies", "symlinks" or "hardlinks"
+	SecondaryViews string `yaml:"SecondaryViews"`
+
+	// How to name files that would get the same path as another file:
+	// "suffix", "nest" or "error"
+	FilenameCollisionPolicy string `yaml:"FilenameCollisionPolicy"`
+
+	// Further top-level directories, each laid out by a path template over
+	// manifest and Indexd fields
+	Views []ViewConfig `yaml:"Views"`
+
+	// Manifest fields, such as object_id or subject_id, that columns of TSV
+	// and CSV manifests and keys of NDJSON manifests map to, by column name
+	ManifestColumns map[string]string `yaml:"ManifestColumns"`
+
+	// What to do with manifest records whose object ID is already in the
+	// manifest: "dedupe" or "error"
+	DuplicateObjectIDPolicy string `yaml:"DuplicateObjectIDPolicy"`
+
+	// How often to check the manifest file for changes, such as "30s". The
+	// manifest is only reloaded on SIGHUP when this is 0.
+	ManifestReloadInterval time.Duration `yaml:"ManifestReloadInterval"`
+
+	// Sidecar configuration, see sidecar.go. The manifest service is reached
+	// at ManifestServicePath on every commons the user is logged in to.
+	WTSExternalOIDCPath string        `yaml:"WTSExternalOIDCPath"`
+	ManifestServicePath string        `yaml:"ManifestServicePath"`
+	SidecarPollInterval time.Duration `yaml:"SidecarPollInterval"`
+	// How many manifests to keep mounted for each commons
+	SidecarMaxManifests int `yaml:"SidecarMaxManifests"`
 }
 
 func NewGen3FuseConfigFromYaml(filename string) (gen3FuseConfig *Gen3FuseConfig, err error) {
@@ -145,9 +206,12 @@ func GetAccessTokenFromWTS(gen3FuseConfig *Gen3FuseConfig, idpInput string) (acc
 	access_token := gen3FuseConfig.AccessToken
 	err = getJson(requestUrl, tokenResponse, access_token)
 
-	if len(tokenResponse.Token) == 0 || err != nil {
+	if err == nil && len(tokenResponse.Token) == 0 {
+		err = errors.New("the response has no token")
+	}
+	if err != nil {
 		FuseLog("Error obtaining access token from the workspace token service at " + requestUrl)
-		FuseLog(fmt.Sprintf("WTS returned %s, error %v\n", tokenResponse, err.Error()))
+		FuseLog(fmt.Sprintf("WTS returned error %v\n", err.Error()))
 		return "", errors.New("Error obtaining access token from the workspace token service at " + requestUrl + ". " + err.Error())
 	}
 	return tokenResponse.Token, nil
@@ -1,4 +1,4 @@
-package internal_test
+package internal
 
 import (
 	"bytes"
@@ -55,7 +55,7 @@ func TestGetAccessToken(t *testing.T) {
 		}
 	}
 	myClient.Transport = roundTripFunc(fn)
-	token, err := gen3fuse.GetAccessTokenFromWTS(testConfig)
+	token, err := GetAccessTokenFromWTS(testConfig, "")
 	equals(t, err, nil)
 	equals(t, token, "OK")
 
@@ -66,7 +66,7 @@ func TestGetAccessToken(t *testing.T) {
 		}
 	}
 	myClient.Transport = roundTripFunc(failAccessToken)
-	token, err = GetAccessTokenFromWTS(testConfig)
+	token, err = GetAccessTokenFromWTS(testConfig, "")
 	assert.NotEqual(t, err, nil)
 	assert.Equal(t, token, "")
 }
@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Extended attributes exposing what is known about each file. Lists of
+// values, such as urls and authz, are separated by newlines.
+const (
+	xattrDID       = "user.gen3.did"
+	xattrMD5       = "user.gen3.md5"
+	xattrURLs      = "user.gen3.urls"
+	xattrAuthz     = "user.gen3.authz"
+	xattrCommons   = "user.gen3.commons"
+	xattrSubjectId = "user.gen3.subject_id"
+
+	// Fetched when asked for, and not listed, so that dumping every
+	// attribute of a tree does not ask Fence for a URL for each file
+	xattrPresignedURL = "user.gen3.presigned_url"
+
+	// Directories report the number and total size of the files below them
+	xattrFileCount = "user.gen3.file_count"
+	xattrTotalSize = "user.gen3.total_size"
+)
+
+// xattrs returns the extended attributes of an inode that have a value
+func (fs *Gen3Fuse) xattrs(info *inodeInfo) map[string]string {
+	attrs := make(map[string]string)
+	if info.symlink != "" || info.control != "" {
+		// Symlinks leave attributes to the file they point to, and the
+		// control directory has none
+		return attrs
+	}
+	if info.dir {
+		count, size := fs.directoryTotals(info)
+		attrs[xattrFileCount] = strconv.Itoa(count)
+		attrs[xattrTotalSize] = strconv.FormatUint(size, 10)
+		return attrs
+	}
+
+	attrs[xattrDID] = info.DID
+	if record := info.record; record != nil {
+		attrs[xattrMD5] = record.Hashes["md5"]
+		attrs[xattrURLs] = strings.Join(record.URLs, "\n")
+		attrs[xattrAuthz] = strings.Join(record.Authz, "\n")
+		attrs[xattrCommons] = record.CommonsHostname
+		attrs[xattrSubjectId] = record.SubjectId
+	}
+	for name, value := range attrs {
+		if value == "" {
+			delete(attrs, name)
+		}
+	}
+	return attrs
+}
+
+// directoryTotals counts the distinct files below a directory and adds up
+// their sizes
+func (fs *Gen3Fuse) directoryTotals(dir *inodeInfo) (count int, size uint64) {
+	seen := make(map[string]bool)
+	pending := []*inodeInfo{dir}
+	for len(pending) > 0 {
+		info := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		for _, child := range info.Children {
+			childInfo, ok := fs.getInode(child.Inode)
+			if !ok {
+				continue
+			}
+			if childInfo.control != "" {
+				continue
+			} else if childInfo.symlink != "" && childInfo.record != nil {
+				if !seen[childInfo.DID] {
+					seen[childInfo.DID] = true
+					count++
+					size += childInfo.record.Filesize
+				}
+			} else if childInfo.dir {
+				pending = append(pending, childInfo)
+			} else if !seen[childInfo.DID] {
+				seen[childInfo.DID] = true
+				count++
+				size += childInfo.attributes.Size
+			}
+		}
+	}
+	return count, size
+}
+
+// writeXattr copies value into dst following the getxattr(2) conventions: an
+// empty dst asks for the size of the value only
+func writeXattr(dst []byte, value []byte) (bytesRead int, err error) {
+	if len(dst) == 0 {
+		return len(value), nil
+	}
+	if len(dst) < len(value) {
+		return len(value), syscall.ERANGE
+	}
+	return copy(dst, value), nil
+}
+
+func (fs *Gen3Fuse) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) (err error) {
+	info, ok := fs.getInode(op.Inode)
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	if op.Name == xattrPresignedURL && !info.dir && info.control == "" {
+		url, err := fs.urls.Get(info)
+		if err != nil {
+			FuseLog(fmt.Sprintf("Error: could not obtain a presigned URL for %v: %v", info.DID, err))
+			return fuse.EIO
+		}
+		op.BytesRead, err = writeXattr(op.Dst, []byte(url.URL))
+		return err
+	}
+
+	value, ok := fs.xattrs(info)[op.Name]
+	if !ok {
+		return fuse.ENOATTR
+	}
+	op.BytesRead, err = writeXattr(op.Dst, []byte(value))
+	return err
+}
+
+func (fs *Gen3Fuse) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) (err error) {
+	info, ok := fs.getInode(op.Inode)
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	names := make([]string, 0)
+	for name := range fs.xattrs(info) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// The list is a sequence of NUL-terminated names
+	var list []byte
+	for _, name := range names {
+		list = append(list, name...)
+		list = append(list, 0)
+	}
+	op.BytesRead, err = writeXattr(op.Dst, list)
+	return err
+}
@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+)
+
+// xattrTestFiles are a file with every attribute and one with few of them
+func xattrTestFiles() map[string]*FileInfo {
+	return map[string]*FileInfo{
+		"dg.TEST/1": &FileInfo{
+			Filename:        "sample.bam",
+			Filesize:        1000,
+			DID:             "dg.TEST/1",
+			URLs:            []string{"s3://bucket/dir/sample.bam", "gs://bucket/dir/sample.bam"},
+			Hashes:          map[string]string{"md5": "0123456789abcdef0123456789abcdef"},
+			Authz:           []string{"/programs/test/projects/one"},
+			CommonsHostname: "data.example.org",
+			SubjectId:       "subject-1",
+		},
+		"dg.TEST/2": &FileInfo{
+			Filename: "other.bam",
+			Filesize: 24,
+			DID:      "dg.TEST/2",
+			URLs:     []string{"s3://bucket/dir/other.bam"},
+		},
+	}
+}
+
+// xattrTestURL signs URLs for the files of xattrTestFiles
+func xattrTestURL(info *inodeInfo) (string, error) {
+	return "https://bucket.s3.amazonaws.com/" + info.DID + "?X-Amz-Signature=abc", nil
+}
+
+func lookUpPath(t *testing.T, fs *Gen3Fuse, path string) fuseops.InodeID {
+	inode := fuseops.InodeID(fuseops.RootInodeID)
+	for _, name := range strings.Split(path, "/") {
+		op := &fuseops.LookUpInodeOp{Parent: inode, Name: name}
+		assert.Nil(t, fs.LookUpInode(context.Background(), op), path)
+		inode = op.Entry.Child
+	}
+	return inode
+}
+
+func getXattr(fs *Gen3Fuse, inode fuseops.InodeID, name string) (string, error) {
+	op := &fuseops.GetXattrOp{Inode: inode, Name: name, Dst: make([]byte, 4096)}
+	err := fs.GetXattr(context.Background(), op)
+	return string(op.Dst[:op.BytesRead]), err
+}
+
+func listXattr(t *testing.T, fs *Gen3Fuse, inode fuseops.InodeID) []string {
+	op := &fuseops.ListXattrOp{Inode: inode, Dst: make([]byte, 4096)}
+	assert.Nil(t, fs.ListXattr(context.Background(), op))
+	return strings.Split(strings.TrimSuffix(string(op.Dst[:op.BytesRead]), "\x00"), "\x00")
+}
+
+func TestFileXattrs(t *testing.T) {
+	fs := newTestFs(&Gen3FuseConfig{}, 0, withURLs(xattrTestURL), withFiles(xattrTestFiles()))
+	inode := lookUpPath(t, fs, "by-filename/sample.bam")
+
+	assert.Equal(t, []string{
+		"user.gen3.authz",
+		"user.gen3.commons",
+		"user.gen3.did",
+		"user.gen3.md5",
+		"user.gen3.subject_id",
+		"user.gen3.urls",
+	}, listXattr(t, fs, inode))
+
+	for name, expected := range map[string]string{
+		"user.gen3.did":        "dg.TEST/1",
+		"user.gen3.md5":        "0123456789abcdef0123456789abcdef",
+		"user.gen3.urls":       "s3://bucket/dir/sample.bam\ngs://bucket/dir/sample.bam",
+		"user.gen3.authz":      "/programs/test/projects/one",
+		"user.gen3.commons":    "data.example.org",
+		"user.gen3.subject_id": "subject-1",
+	} {
+		value, err := getXattr(fs, inode, name)
+		assert.Nil(t, err, name)
+		assert.Equal(t, expected, value, name)
+	}
+
+	// the presigned URL is only fetched when asked for
+	value, err := getXattr(fs, inode, "user.gen3.presigned_url")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://bucket.s3.amazonaws.com/dg.TEST/1?X-Amz-Signature=abc", value)
+
+	_, err = getXattr(fs, inode, "user.gen3.nonexistent")
+	assert.Equal(t, fuse.ENOATTR, err)
+
+	// a file without metadata only has its DID
+	other := lookUpPath(t, fs, "by-guid/dg.TEST/2")
+	assert.Equal(t, []string{"user.gen3.did", "user.gen3.urls"}, listXattr(t, fs, other))
+	_, err = getXattr(fs, other, "user.gen3.md5")
+	assert.Equal(t, fuse.ENOATTR, err)
+}
+
+func TestDirectoryXattrs(t *testing.T) {
+	fs := newTestFs(&Gen3FuseConfig{}, 0, withURLs(xattrTestURL), withFiles(xattrTestFiles()))
+
+	// both files appear in several views, but are only counted once
+	for path, expected := range map[string][2]string{
+		"by-guid":         {"2", "1024"},
+		"by-filepath/dir": {"2", "1024"},
+		"by-guid/dg.TEST": {"2", "1024"},
+		"by-filename":     {"2", "1024"},
+		"by-filepath":     {"2", "1024"},
+	} {
+		inode := lookUpPath(t, fs, path)
+		assert.Equal(t, []string{"user.gen3.file_count", "user.gen3.total_size"}, listXattr(t, fs, inode))
+		count, err := getXattr(fs, inode, "user.gen3.file_count")
+		assert.Nil(t, err)
+		size, err := getXattr(fs, inode, "user.gen3.total_size")
+		assert.Nil(t, err)
+		assert.Equal(t, expected, [2]string{count, size}, path)
+	}
+
+	_, err := getXattr(fs, fuseops.RootInodeID, "user.gen3.presigned_url")
+	assert.Equal(t, fuse.ENOATTR, err)
+}
+
+func TestXattrBufferSizes(t *testing.T) {
+	fs := newTestFs(&Gen3FuseConfig{}, 0, withURLs(xattrTestURL), withFiles(xattrTestFiles()))
+	inode := lookUpPath(t, fs, "by-filename/sample.bam")
+
+	// an empty buffer asks for the size of the value
+	op := &fuseops.GetXattrOp{Inode: inode, Name: "user.gen3.did"}
+	assert.Nil(t, fs.GetXattr(context.Background(), op))
+	assert.Equal(t, len("dg.TEST/1"), op.BytesRead)
+
+	op = &fuseops.GetXattrOp{Inode: inode, Name: "user.gen3.did", Dst: make([]byte, 4)}
+	assert.Equal(t, syscall.ERANGE, fs.GetXattr(context.Background(), op))
+
+	list := &fuseops.ListXattrOp{Inode: inode}
+	assert.Nil(t, fs.ListXattr(context.Background(), list))
+	assert.Equal(t, len(strings.Join([]string{
+		"user.gen3.authz", "user.gen3.commons", "user.gen3.did",
+		"user.gen3.md5", "user.gen3.subject_id", "user.gen3.urls",
+	}, "\x00"))+1, list.BytesRead)
+
+	assert.Equal(t, fuse.ENOENT, fs.GetXattr(context.Background(), &fuseops.GetXattrOp{Inode: 12345, Name: "user.gen3.did"}))
+}
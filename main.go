@@ -4,13 +4,23 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 
 	gen3fuse "github.com/uc-cdis/gen3-fuse/api"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sidecar" {
+		sidecar(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		validate(os.Args[2:])
+		return
+	}
+
 	configFileName := flag.String("config", "", "path to config")
-	manifestFilePath := flag.String("manifest", "", "path to manifest")
+	manifestFilePath := flag.String("manifest", "", "path to manifest, a JSON, NDJSON, TSV, CSV or PFB file")
 	mountPoint := flag.String("mount-point", "", "directory to mount")
 	hostname := flag.String("hostname", "", "commons domain")
 	wtsURL := flag.String("wtsURL", "", "workspace-token-service url")
@@ -82,3 +92,90 @@ func main() {
 
 	gen3fuse.InitializeApp(gen3FuseConfig, *manifestFilePath, *mountPoint)
 }
+
+// sidecar mounts the manifests the workspace user exports, see
+// internal/sidecar.go
+func sidecar(args []string) {
+	flags := flag.NewFlagSet("sidecar", flag.ExitOnError)
+	configFileName := flags.String("config", "", "path to config")
+	mountPoint := flags.String("mount-point", "/data", "directory to mount")
+	hostname := flags.String("hostname", "", "URL of the commons the workspace runs in")
+	wtsURL := flags.String("wtsURL", "", "workspace-token-service url")
+	accessToken := flags.String("access-token", "", "access token for workspace-token-service (optional)")
+	manifestDir := flags.String("manifest-dir", filepath.Join(os.TempDir(), "gen3-fuse-manifests"), "directory to keep the mounted manifests in")
+	logFile := flags.String("log-file", filepath.Join(os.TempDir(), "gen3-fuse-sidecar.log"), "path to write the log to, outside the mount point; it is shown in the mount as "+gen3fuse.SidecarLogName)
+	flags.Parse(args)
+
+	if *hostname == "" || *wtsURL == "" {
+		fmt.Fprintln(os.Stderr, `Error: missing args.
+				Usage:
+				gen3-fuse sidecar \
+				-config=<path_to_config> \
+				-hostname=<commons_url> \
+				-wtsURL=<workspace_token_service_url> \
+				-mount-point=<directory_to_mount> \
+				-manifest-dir=<directory_for_manifests> \
+				-log-file=<path_to_log> \
+				-access-token=<access_token>`)
+		os.Exit(1)
+	}
+
+	gen3FuseConfig, err := gen3fuse.NewGen3FuseConfigFromYaml(*configFileName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing yaml from %s: %s\n", *configFileName, err.Error())
+		os.Exit(1)
+	}
+	gen3FuseConfig.Hostname = *hostname
+	gen3FuseConfig.WTSBaseURL = *wtsURL
+	gen3FuseConfig.AccessToken = *accessToken
+	gen3FuseConfig.LogFilePath = *logFile
+
+	gen3fuse.Unmount(*mountPoint)
+	if _, err := os.Stat(*mountPoint); os.IsNotExist(err) {
+		os.Mkdir(*mountPoint, 0777)
+	}
+
+	if err := gen3fuse.RunSidecar(gen3FuseConfig, *mountPoint, *manifestDir); err != nil {
+		fmt.Fprintf(os.Stderr, "Error running the sidecar: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// validate reads a manifest as a mount would and reports what is wrong
+// with it, without mounting it
+func validate(args []string) {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	configFileName := flags.String("config", "", "path to config (optional), for ManifestColumns and DuplicateObjectIDPolicy")
+	manifestFilePath := flags.String("manifest", "", "path to manifest, a JSON, NDJSON, TSV, CSV or PFB file")
+	flags.Parse(args)
+
+	if *manifestFilePath == "" {
+		fmt.Fprintln(os.Stderr, `Error: missing args.
+				Usage:
+				gen3-fuse validate \
+				-manifest=<path_to_manifest> \
+				-config=<path_to_config>`)
+		os.Exit(1)
+	}
+
+	gen3FuseConfig := &gen3fuse.Gen3FuseConfig{}
+	if *configFileName != "" {
+		var err error
+		gen3FuseConfig, err = gen3fuse.NewGen3FuseConfigFromYaml(*configFileName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing yaml from %s: %s\n", *configFileName, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	report, err := gen3fuse.ValidateManifest(gen3FuseConfig, *manifestFilePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *manifestFilePath, err.Error())
+		os.Exit(1)
+	}
+	for _, warning := range report.Warnings {
+		fmt.Printf("%s: warning: %s\n", *manifestFilePath, warning)
+	}
+	fmt.Printf("%s: %s manifest, %d records, %d object IDs, %d warnings\n",
+		*manifestFilePath, report.Format, report.Records, report.ObjectIDs, len(report.Warnings))
+}
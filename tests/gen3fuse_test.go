@@ -229,7 +229,10 @@ func TestInitializeInodesNoFilenameButURLProvided(t *testing.T) {
 		URLs:     []string{"s3://some-s3-bucket/s3test4.txt"},
 	}
 
-	result := gen3fuse.InitializeInodes(didToFileInfo)
+	result, err := gen3fuse.InitializeInodes(didToFileInfo, &gen3fuse.Gen3FuseConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	var structStr string = fmt.Sprintf("%+v", result)
 	fmt.Println("\n InitInodes result: " + structStr + "\n")